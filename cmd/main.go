@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/sirupsen/logrus"
@@ -17,15 +18,24 @@ const (
 	defaultEndpoint  = "unix:///var/lib/kubelet/plugins_registry/nexentastor-csi-driver.nexenta.com/csi.sock"
 	defaultConfigDir = "/config"
 	defaultRole      = driver.RoleAll
+
+	// envNodeZone - env variable with node zone, can be populated by k8s downward API
+	envNodeZone = "KUBE_NODE_ZONE"
 )
 
 func main() {
 	var (
 		nodeID    = flag.String("nodeid", "", "Kubernetes node ID")
+		nodeIP    = flag.String("nodeip", "", "node IP address to add to NFS share ACLs on volume publish")
+		zone      = flag.String("zone", os.Getenv(envNodeZone), fmt.Sprintf("node zone (default: $%s)", envNodeZone))
+		zoneFile  = flag.String("zone-file", "", "file to read node zone from if zone is not set")
 		endpoint  = flag.String("endpoint", defaultEndpoint, "CSI endpoint")
 		configDir = flag.String("config-dir", defaultConfigDir, "driver config endpoint")
 		role      = flag.String("role", "", fmt.Sprintf("driver role: %v", driver.Roles))
 		version   = flag.Bool("version", false, "Print driver version")
+
+		// must be set for both controller and node, otherwise volumes can't be scheduled
+		applianceTopology = flag.Bool("appliance-topology", false, "report NexentaStor reachability in topology")
 	)
 
 	flag.Parse()
@@ -50,6 +60,10 @@ func main() {
 	l.Info("Run driver with CLI options:")
 	l.Infof("- Role:             '%s'", *role)
 	l.Infof("- Node ID:          '%s'", *nodeID)
+	l.Infof("- Node IP:          '%s'", *nodeIP)
+	l.Infof("- Zone:             '%s'", *zone)
+	l.Infof("- Zone file:        '%s'", *zoneFile)
+	l.Infof("- Appliance topology: %t", *applianceTopology)
 	l.Infof("- CSI endpoint:     '%s'", *endpoint)
 	l.Infof("- Config directory: '%s'", *configDir)
 
@@ -59,6 +73,17 @@ func main() {
 		l.Warn(err)
 	}
 
+	// zone file is used only if zone is not set by CLI option or env variable
+	if *zone == "" && *zoneFile != "" {
+		content, err := ioutil.ReadFile(*zoneFile)
+		if err != nil {
+			l.Warnf("Cannot read zone file '%s': %s", *zoneFile, err)
+		} else {
+			*zone = strings.TrimSpace(string(content))
+			l.Infof("Zone from file: '%s'", *zone)
+		}
+	}
+
 	// initial read and validate config file
 	cfg, err := config.New(*configDir)
 	if err != nil {
@@ -83,14 +108,19 @@ func main() {
 		l.Infof("  - Zone: %s", config.Zone)
 		l.Infof("  - V13Compatibility: %t", config.V13Compatibility)
 		l.Infof("  - InsecureSkipVerify: %+v", *config.InsecureSkipVerify)
+		l.Infof("  - ControllerSharing: %t", config.ControllerSharing)
 	}
 
 	d, err := driver.NewDriver(driver.Args{
 		Role:     validatedRole,
 		NodeID:   *nodeID,
+		NodeIP:   *nodeIP,
+		Zone:     *zone,
 		Endpoint: *endpoint,
 		Config:   cfg,
 		Log:      l,
+
+		ApplianceTopology: *applianceTopology,
 	})
 	if err != nil {
 		writeTerminationMessage(err, l)
@@ -5,26 +5,26 @@ go 1.20
 require (
 	github.com/Nexenta/go-nexentastor v2.7.1+incompatible
 	github.com/antonfisher/nested-logrus-formatter v1.3.0
-	github.com/container-storage-interface/spec v1.7.0
+	github.com/container-storage-interface/spec v1.9.0
 	github.com/educlos/testrail v0.0.0-20190627213040-ca1b25409ae2
 	github.com/golang/protobuf v1.5.4
 	github.com/kubernetes-csi/csi-lib-utils v0.7.0
 	github.com/sirupsen/logrus v1.6.0
 	golang.org/x/net v0.23.0
+	golang.org/x/sys v0.18.0
 	google.golang.org/grpc v1.58.3
 	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/mount-utils v0.0.0
+	k8s.io/utils v0.0.0-20201110183641-67b214c5f920
 )
 
 require (
 	github.com/go-logr/logr v0.4.0 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
-	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
-	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230803162519-f966b187b2e5 // indirect
 	google.golang.org/protobuf v1.34.1 // indirect
 	k8s.io/klog/v2 v2.8.0 // indirect
-	k8s.io/utils v0.0.0-20201110183641-67b214c5f920 // indirect
 )
 
 replace (
@@ -12,6 +12,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/Nexenta/nexentastor-csi-driver/pkg/arrays"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/zfs"
 )
 
 // supported mount filesystem types
@@ -24,6 +25,15 @@ const (
 	DefaultInsecureSkipVerify        = true
 )
 
+// DefaultISCSITargetPrefix - IQN prefix of iSCSI targets created for block volumes
+const DefaultISCSITargetPrefix = "iqn.2005-07.com.nexenta:01:csi"
+
+// DefaultNVMeSubsystemPrefix - NQN prefix of NVMe/TCP subsystems created for block volumes
+const DefaultNVMeSubsystemPrefix = "nqn.2005-07.com.nexenta:csi"
+
+// DefaultTrashRetention - how long deleted volumes are kept in trash dataset
+const DefaultTrashRetention = 7 * 24 * time.Hour
+
 // SuppertedFsTypeList - list of supported filesystem types to mount
 var SuppertedFsTypeList = []string{FsTypeNFS, FsTypeCIFS}
 
@@ -51,6 +61,57 @@ type NsData struct {
 	V13Compatibility      bool   `yaml:"v13Compatibility,omitempty"`
 	MountPointPermissions string `yaml:"mountPointPermissions"`
 	InsecureSkipVerify    *bool  `yaml:"insecureSkipVerify,omitempty"`
+	// shares are created by the controller and mount source is passed to nodes in volume context,
+	// node driver config may contain no NexentaStor address and credentials in this mode
+	ControllerSharing bool `yaml:"controllerSharing,omitempty"`
+	// iSCSI target portal [host[:port]] for block volumes, defaultDataIp is used if not set
+	ISCSIPortal       string `yaml:"iscsiPortal,omitempty"`
+	ISCSITargetPrefix string `yaml:"iscsiTargetPrefix,omitempty"`
+	// NVMe/TCP subsystem transport address [host[:port]], defaultDataIp is used if not set
+	NVMePortal          string `yaml:"nvmePortal,omitempty"`
+	NVMeSubsystemPrefix string `yaml:"nvmeSubsystemPrefix,omitempty"`
+	// share of new volumes for `weighted` placement policy, 1 if not set
+	PlacementWeight int `yaml:"placementWeight,omitempty"`
+	// new volumes are not placed on the NexentaStor if its pool has less free space (percents)
+	MinPoolFreePercent int `yaml:"minPoolFreePercent,omitempty"`
+	// NFS/SMB volumes are created in `<dataset>/<pvc-namespace>` parent filesystems
+	NamespaceDatasets bool `yaml:"namespaceDatasets,omitempty"`
+	// aggregate quotas of namespace parent filesystems by namespace, e.g. "team-a: 100Gi"
+	NamespaceQuotas map[string]string `yaml:"namespaceQuotas,omitempty"`
+	// namespace parent filesystem is destroyed when its last volume is deleted
+	RemoveEmptyNamespaceDatasets bool `yaml:"removeEmptyNamespaceDatasets,omitempty"`
+	// volumes of `deletePolicy: trash` StorageClasses are moved to this dataset on deletion
+	TrashDataset string `yaml:"trashDataset,omitempty"`
+	// volumes are purged from trash dataset after this period, e.g. "72h"
+	TrashRetention string `yaml:"trashRetention,omitempty"`
+}
+
+// GetTrashRetention - how long deleted volumes are kept in trash dataset, DefaultTrashRetention if not set
+func (d NsData) GetTrashRetention() (time.Duration, error) {
+	if d.TrashRetention == "" {
+		return DefaultTrashRetention, nil
+	}
+	retention, err := time.ParseDuration(d.TrashRetention)
+	if err != nil {
+		return 0, err
+	} else if retention < 0 {
+		return 0, fmt.Errorf("retention is negative")
+	}
+	return retention, nil
+}
+
+// GetNamespaceQuota - aggregate quota of namespace parent filesystem in bytes, 0 if it's not set
+func (d NsData) GetNamespaceQuota(namespace string) (int64, error) {
+	value, ok := d.NamespaceQuotas[namespace]
+	if !ok {
+		return 0, nil
+	}
+	return zfs.ParseSize(value)
+}
+
+// HasCredentials - NexentaStor REST API address and credentials are set
+func (d NsData) HasCredentials() bool {
+	return d.Address != "" && d.Username != "" && d.Password != ""
 }
 
 // GetFilePath - get filepath of found config file
@@ -101,7 +162,9 @@ func (c *Config) Validate() error {
 
 	for name, data := range c.NsMap {
 		if data.Address == "" {
-			errors = append(errors, fmt.Sprintf("parameter 'restIp' is missed"))
+			if !data.ControllerSharing {
+				errors = append(errors, fmt.Sprintf("parameter 'restIp' is missed"))
+			}
 		} else {
 			addresses := strings.Split(data.Address, ",")
 			for _, address := range addresses {
@@ -116,11 +179,14 @@ func (c *Config) Validate() error {
 				}
 			}
 		}
-		if data.Username == "" {
-			errors = append(errors, fmt.Sprintf("parameter 'username' is missed"))
-		}
-		if data.Password == "" {
-			errors = append(errors, fmt.Sprintf("parameter 'password' is missed"))
+		// credentials are optional for node driver if shares are created by controller
+		if data.Address != "" || !data.ControllerSharing {
+			if data.Username == "" {
+				errors = append(errors, fmt.Sprintf("parameter 'username' is missed"))
+			}
+			if data.Password == "" {
+				errors = append(errors, fmt.Sprintf("parameter 'password' is missed"))
+			}
 		}
 		if data.DefaultMountFsType != "" && !arrays.ContainsString(SuppertedFsTypeList, data.DefaultMountFsType) {
 			errors = append(
@@ -128,11 +194,40 @@ func (c *Config) Validate() error {
 				fmt.Sprintf("parameter 'defaultMountFsType' must be omitted or one of: [%s, %s]", FsTypeNFS, FsTypeCIFS),
 			)
 		}
+		if data.PlacementWeight < 0 {
+			errors = append(errors, fmt.Sprintf("parameter 'placementWeight' must be 0 or greater"))
+		}
+		if data.MinPoolFreePercent < 0 || data.MinPoolFreePercent > 100 {
+			errors = append(errors, fmt.Sprintf("parameter 'minPoolFreePercent' must be in range [0, 100]"))
+		}
+		for namespace := range data.NamespaceQuotas {
+			if _, err := data.GetNamespaceQuota(namespace); err != nil {
+				errors = append(errors, fmt.Sprintf("parameter 'namespaceQuotas' has invalid quota of '%s': %s",
+					namespace, err))
+			}
+		}
+		if _, err := data.GetTrashRetention(); err != nil {
+			errors = append(errors, fmt.Sprintf("parameter 'trashRetention' is invalid: %s", err))
+		}
+		// volumes are moved to trash by rename, which doesn't work across pools,
+		// node config may have no default dataset
+		if data.TrashDataset != "" && data.DefaultDataset != "" &&
+			strings.Split(data.TrashDataset, "/")[0] != strings.Split(data.DefaultDataset, "/")[0] {
+			errors = append(errors, fmt.Sprintf("parameter 'trashDataset' must be in the pool of 'defaultDataset'"))
+		}
 		if data.InsecureSkipVerify == nil {
 			insecureSkipVerify := DefaultInsecureSkipVerify
 			data.InsecureSkipVerify = &insecureSkipVerify
 			c.NsMap[name] = data
 		}
+		if data.ISCSITargetPrefix == "" {
+			data.ISCSITargetPrefix = DefaultISCSITargetPrefix
+			c.NsMap[name] = data
+		}
+		if data.NVMeSubsystemPrefix == "" {
+			data.NVMeSubsystemPrefix = DefaultNVMeSubsystemPrefix
+			c.NsMap[name] = data
+		}
 
 		if len(errors) != 0 {
 			return fmt.Errorf("[NS: %s] Bad format, fix following issues: %s", name, strings.Join(errors, "; "))
@@ -0,0 +1,36 @@
+// Package connection - helpers shared by iSCSI and NVMe/TCP connectors: portal addresses and connection
+// parameters saved by the node driver, so block devices can be detached when only staging path is known
+package connection
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// NormalizePortal - add default port to portal address if it's not set, IPv6 addresses are bracketed
+func NormalizePortal(portal, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(portal); err == nil {
+		return portal
+	}
+	return net.JoinHostPort(strings.Trim(portal, "[]"), defaultPort)
+}
+
+// Save - write connection parameters to the file as JSON
+func Save(filePath string, conn interface{}) error {
+	content, err := json.Marshal(conn)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, content, 0600)
+}
+
+// Load - read connection parameters written by Save() to conn, not existing file is os.IsNotExist() error
+func Load(filePath string, conn interface{}) error {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, conn)
+}
@@ -2,12 +2,17 @@ package driver
 
 import (
 	"fmt"
+	"net"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	timestamp "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
@@ -16,10 +21,187 @@ import (
 
 	"github.com/Nexenta/go-nexentastor/pkg/ns"
 	"github.com/Nexenta/nexentastor-csi-driver/pkg/config"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/connection"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/iscsi"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/k8s"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/naming"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/nef"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/nvme"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/pagination"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/placement"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/zfs"
 )
 
 const TopologyKeyZone = "topology.kubernetes.io/zone"
 
+// `protocol` StorageClass parameter values to create zvol and export it over iSCSI or NVMe/TCP,
+// volume is shared over NFS/SMB if the parameter is not set
+const (
+	ProtocolISCSI   = "iscsi"
+	ProtocolNVMeTCP = "nvme-tcp"
+)
+
+// zvol size is aligned to 1MiB, 1GiB zvol is created if size is not requested
+const (
+	zvolSizeAlignment = 1024 * 1024
+	defaultZvolSize   = 1024 * 1024 * 1024
+)
+
+// TopologyKeyAppliancePrefix - prefix of per-NexentaStor topology keys, value is "true" if node can reach
+// NexentaStor data IP, key name is a config name from `nexentastor_map`
+const TopologyKeyAppliancePrefix = "appliance.nexentastor-csi-driver.nexenta.com/"
+
+// AnnotationNodeIP - annotation of node IP address (`--nodeip` option) set by node driver on its Node object,
+// controller reads it to add the node to NFS share access list
+const AnnotationNodeIP = "nexentastor-csi-driver.nexenta.com/node-ip"
+
+func getApplianceTopologyKey(configName string) string {
+	return TopologyKeyAppliancePrefix + configName
+}
+
+// userPropertyPublishedNodes - ZFS user property of volume filesystem or zvol with comma separated IDs
+// of the nodes it's published to
+const userPropertyPublishedNodes = "com.nexenta.csi:published_nodes"
+
+// userPropertyProvisioningType - ZFS user property of volume filesystem with its provisioning type,
+// reservation of thick volumes is grown on expansion
+const userPropertyProvisioningType = "com.nexenta.csi:provisioning_type"
+
+// ZFS user properties with Kubernetes metadata of volume filesystems and snapshots, so NexentaStor admin
+// can find their owners, metadata is passed by external-provisioner and external-snapshotter
+// started with `--extra-create-metadata` option
+const (
+	userPropertyPVCName                   = "com.nexenta.csi:pvc_name"
+	userPropertyPVCNamespace              = "com.nexenta.csi:pvc_namespace"
+	userPropertyPVName                    = "com.nexenta.csi:pv_name"
+	userPropertyVolumeSnapshotName        = "com.nexenta.csi:volumesnapshot_name"
+	userPropertyVolumeSnapshotNamespace   = "com.nexenta.csi:volumesnapshot_namespace"
+	userPropertyVolumeSnapshotContentName = "com.nexenta.csi:volumesnapshotcontent_name"
+	userPropertyDriverName                = "com.nexenta.csi:driver_name"
+	userPropertyDriverVersion             = "com.nexenta.csi:driver_version"
+	userPropertyCreatedAt                 = "com.nexenta.csi:created_at"
+)
+
+// volumeMetadataParameters - CreateVolume parameters stored as user properties of volume filesystem
+var volumeMetadataParameters = map[string]string{
+	naming.ParameterPVCName:      userPropertyPVCName,
+	naming.ParameterPVCNamespace: userPropertyPVCNamespace,
+	naming.ParameterPVName:       userPropertyPVName,
+}
+
+// ZFS user properties of volume filesystem with mount parameters from StorageClass, so ListVolumes and
+// ControllerGetVolume report the same volume context as CreateVolume
+const (
+	userPropertyDataIP                = "com.nexenta.csi:data_ip"
+	userPropertyMountOptions          = "com.nexenta.csi:mount_options"
+	userPropertyMountFsType           = "com.nexenta.csi:mount_fs_type"
+	userPropertyMountPointPermissions = "com.nexenta.csi:mount_point_permissions"
+)
+
+// volumeContextParameters - CreateVolume parameters passed in volume context and stored as user properties
+// of volume filesystem
+var volumeContextParameters = map[string]string{
+	"dataIp":                userPropertyDataIP,
+	"mountOptions":          userPropertyMountOptions,
+	"mountFsType":           userPropertyMountFsType,
+	"mountPointPermissions": userPropertyMountPointPermissions,
+}
+
+// snapshotMetadataParameters - CreateSnapshot parameters stored as user properties of snapshot
+var snapshotMetadataParameters = map[string]string{
+	"csi.storage.k8s.io/volumesnapshot/name":        userPropertyVolumeSnapshotName,
+	"csi.storage.k8s.io/volumesnapshot/namespace":   userPropertyVolumeSnapshotNamespace,
+	"csi.storage.k8s.io/volumesnapshotcontent/name": userPropertyVolumeSnapshotContentName,
+}
+
+// volumeContextMetadata - volume context keys of metadata user properties reported by
+// ListVolumes and ControllerGetVolume
+var volumeContextMetadata = map[string]string{
+	userPropertyPVCName:       "pvcName",
+	userPropertyPVCNamespace:  "pvcNamespace",
+	userPropertyPVName:        "pvName",
+	userPropertyDriverName:    "driverName",
+	userPropertyDriverVersion: "driverVersion",
+	userPropertyCreatedAt:     "createdAt",
+}
+
+// userPropertyVolumeName - ZFS user property of volume filesystem with its CSI name, volume dataset name
+// may differ from it if `volumeNameTemplate` is set, so retried requests find the volume by this property
+const userPropertyVolumeName = "com.nexenta.csi:volume_name"
+
+// userPropertyDataset - ZFS user property of volume filesystem with the parent dataset it was created in,
+// templated volume may be created in intermediate filesystems under it
+const userPropertyDataset = "com.nexenta.csi:dataset"
+
+// userPropertyRole - ZFS user property of filesystems created by the driver in the parent dataset,
+// user properties are inherited, so volumes set it explicitly
+const userPropertyRole = "com.nexenta.csi:role"
+
+// `com.nexenta.csi:role` user property values
+const (
+	// roleVolume - filesystem is a volume
+	roleVolume = "volume"
+	// roleParent - filesystem contains volumes: namespace parent or intermediate filesystem of templated name
+	roleParent = "parent"
+	// roleTrash - trash dataset with deleted volumes
+	roleTrash = "trash"
+	// roleRetained - deleted volume kept by 'retain' delete policy
+	roleRetained = "retained"
+)
+
+// userPropertyDeletePolicy - ZFS user property of volume filesystem with its `deletePolicy`,
+// DeleteVolume request has no StorageClass parameters
+const userPropertyDeletePolicy = "com.nexenta.csi:delete_policy"
+
+// ZFS user properties of volume filesystem moved to trash dataset
+const (
+	// userPropertyDeletedAt - deletion time, the volume is purged after trash retention period
+	userPropertyDeletedAt = "com.nexenta.csi:deleted_at"
+	// userPropertyTrashedFrom - volume path before deletion, to restore the volume
+	userPropertyTrashedFrom = "com.nexenta.csi:trashed_from"
+)
+
+// `deletePolicy` StorageClass parameter values, what DeleteVolume does with NFS/SMB volume filesystem
+const (
+	// DeletePolicyDestroy - destroy filesystem with its snapshots
+	DeletePolicyDestroy = "destroy"
+	// DeletePolicyTrash - move filesystem to trash dataset, it's purged after trash retention period
+	DeletePolicyTrash = "trash"
+	// DeletePolicyRetain - unshare filesystem and keep it in place
+	DeletePolicyRetain = "retain"
+)
+
+// DeletePolicies - supported `deletePolicy` values
+var DeletePolicies = []string{DeletePolicyDestroy, DeletePolicyTrash, DeletePolicyRetain}
+
+// trashReaperInterval - how often controller purges volumes with expired retention period from trash datasets
+const trashReaperInterval = 10 * time.Minute
+
+// `provisioningType` StorageClass parameter values
+const (
+	// ProvisioningTypeThin - no space is reserved, unless `reservation` parameter is set
+	ProvisioningTypeThin = "thin"
+	// ProvisioningTypeThick - the whole volume size is reserved
+	ProvisioningTypeThick = "thick"
+)
+
+// cloneSnapshotPrefix - name prefix of intermediate snapshots created to clone a volume,
+// they are not CSI snapshots and are not listed
+const cloneSnapshotPrefix = "k8s-clone-snapshot-"
+
+// `cloneMode` StorageClass parameter values, how a volume is cloned from another volume
+const (
+	// CloneModeSnapshot - clone depends on intermediate snapshot of the source
+	CloneModeSnapshot = "snapshot"
+	// CloneModePromote - clone is promoted and takes over intermediate snapshot, the source depends on it
+	CloneModePromote = "promote"
+	// CloneModeFull - intermediate snapshot is copied to an independent filesystem by send/receive
+	CloneModeFull = "full"
+)
+
+// CloneModes - supported `cloneMode` StorageClass parameter values
+var CloneModes = []string{CloneModeSnapshot, CloneModePromote, CloneModeFull}
+
 // supportedControllerCapabilities - driver controller capabilities
 var supportedControllerCapabilities = []csi.ControllerServiceCapability_RPC_Type{
 	csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
@@ -29,6 +211,10 @@ var supportedControllerCapabilities = []csi.ControllerServiceCapability_RPC_Type
 	csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 	csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	csi.ControllerServiceCapability_RPC_GET_VOLUME,
+	csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+	csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
 }
 
 // supportedVolumeCapabilities - driver volume capabilities
@@ -55,6 +241,23 @@ type ControllerServer struct {
 	nsResolverMap map[string]ns.Resolver
 	config        *config.Config
 	log           *logrus.Entry
+	// add NexentaStor reachability key to volume topology
+	applianceTopology bool
+	// serializes config refresh with config copy of the trash reaper
+	configMutex sync.Mutex
+	// serializes NFS share access list read-modify-write on publish/unpublish
+	nfsShareMutex sync.Mutex
+	// serializes published nodes user property read-modify-write
+	publishedNodesMutex sync.Mutex
+	// picks NexentaStor for new volumes if StorageClass doesn't set configName
+	placer *placement.Placer
+	// reads node IP labels, nil if the driver doesn't run in Kubernetes
+	k8sClient *k8s.Client
+	// volumes walked for the first page of paginated ListVolumes/ListSnapshots by listing IDs
+	datasetVolumesCache      map[string]datasetVolumesCacheEntry
+	datasetVolumesCacheMutex sync.Mutex
+	// serializes volume creation in parent filesystems created by the driver with their destruction
+	parentLocks parentLocks
 }
 
 type ResolveNSParams struct {
@@ -62,6 +265,17 @@ type ResolveNSParams struct {
 	zone            string
 	configName      string
 	IsV13Compatible bool
+	// NexentaStor for a new volume is picked by placement policy if configName is not set,
+	// the first one that has the dataset is used if policy is empty
+	placementPolicy string
+	// space reserved by the new volume, thin volumes may overcommit free space of the parent dataset
+	reservedBytes int64
+	// new volume name relative to the parent dataset and PVC namespace, NexentaStor that already has
+	// the volume is picked without placement, so CreateVolume retry returns the same volume
+	volumeName string
+	csiName    string
+	namespace  string
+	isZvol     bool
 }
 
 type ResolveNSResponse struct {
@@ -71,6 +285,9 @@ type ResolveNSResponse struct {
 }
 
 func (s *ControllerServer) refreshConfig(secret string) error {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+
 	changed, err := s.config.Refresh(secret)
 	if err != nil {
 		return err
@@ -96,11 +313,257 @@ func (s *ControllerServer) refreshConfig(secret string) error {
 	return nil
 }
 
+// getConfigSnapshot - refresh config and copy NexentaStor configs, so background jobs iterate over them
+// while requests refresh the config
+func (s *ControllerServer) getConfigSnapshot() (map[string]config.NsData, error) {
+	if err := s.refreshConfig(""); err != nil {
+		return nil, err
+	}
+
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+
+	nsMap := make(map[string]config.NsData, len(s.config.NsMap))
+	for name, cfg := range s.config.NsMap {
+		nsMap[name] = cfg
+	}
+	return nsMap, nil
+}
+
+// ControllerGetVolume - get volume with its capacity, context, topology and condition
 func (s *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (
 	*csi.ControllerGetVolumeResponse,
 	error,
 ) {
-	return nil, status.Error(codes.Unimplemented, "")
+	l := s.log.WithField("func", "ControllerGetVolume()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+	}
+
+	err := s.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	volInfo, err := ParseVolumeID(volumeID)
+	if err != nil {
+		l.Errorf("Got wrong volumeId, VolumeInfo error: %s", err)
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("VolumeId is in wrong format: %s", volumeID))
+	}
+
+	res := &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId: volumeID,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{},
+	}
+
+	params := ResolveNSParams{
+		datasetPath:     volInfo.Path,
+		configName:      volInfo.ConfigName,
+		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	}
+	resolveResp, err := s.resolveNS(params)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			// volume may be a zvol of iSCSI volume
+			zvolResp, volume, zvolErr := s.resolveZvol(volInfo)
+			if zvolErr == nil {
+				protocol, err := s.getZvolProtocol(
+					zvolResp.nsProvider,
+					s.config.NsMap[zvolResp.configName],
+					volInfo.Path,
+				)
+				if err != nil {
+					return nil, err
+				}
+				res.Volume.CapacityBytes = volume.VolumeSize
+				res.Volume.VolumeContext = map[string]string{"protocol": protocol}
+				res.Volume.AccessibleTopology = s.getAccessibleTopology(
+					zvolResp.configName,
+					s.config.NsMap[zvolResp.configName].Zone,
+				)
+				nefClient, err := nef.New(zvolResp.nsProvider)
+				if err != nil {
+					return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+				}
+				userProperties, err := nefClient.GetVolumeUserProperties(volInfo.Path)
+				if err != nil {
+					return nil, status.Errorf(codes.Internal, "Cannot get user properties of '%s': %s", volInfo.Path, err)
+				}
+				res.Status.PublishedNodeIds = parsePublishedNodes(userProperties[userPropertyPublishedNodes])
+				res.Status.VolumeCondition, err = s.getPoolCondition(zvolResp.nsProvider, volInfo.Path)
+				if err != nil {
+					return nil, err
+				}
+				return res, nil
+			} else if status.Code(zvolErr) != codes.NotFound {
+				return nil, zvolErr
+			}
+			return nil, status.Errorf(codes.NotFound, "Volume '%s' not found on NexentaStor: %s", volInfo.Path, err)
+		}
+		return nil, err
+	}
+
+	nsProvider := resolveResp.nsProvider
+	filesystem, err := nsProvider.GetFilesystem(volInfo.Path)
+	if err != nil {
+		if ns.IsNotExistNefError(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume '%s' not found on NexentaStor %s", volInfo.Path, nsProvider)
+		}
+		return nil, status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", volInfo.Path, err)
+	}
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	userProperties, err := nefClient.GetFilesystemUserProperties(volInfo.Path)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get user properties of '%s': %s", volInfo.Path, err)
+	}
+
+	res.Volume = s.getCSIVolume(volumeID, resolveResp.configName, filesystem, userProperties)
+	res.Status.PublishedNodeIds = parsePublishedNodes(userProperties[userPropertyPublishedNodes])
+	res.Status.VolumeCondition, err = s.getVolumeCondition(nsProvider, filesystem, len(res.Status.PublishedNodeIds) != 0)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Infof("volume '%s': %+v", volumeID, res)
+	return res, nil
+}
+
+// getCSIVolume - build CSI volume from NS filesystem with its capacity, volume context and topology,
+// Kubernetes metadata from filesystem user properties is added to the volume context
+func (s *ControllerServer) getCSIVolume(
+	volumeID string,
+	configName string,
+	filesystem ns.Filesystem,
+	userProperties map[string]string,
+) *csi.Volume {
+	cfg := s.config.NsMap[configName]
+
+	fsType := cfg.DefaultMountFsType
+	if fsType == "" {
+		fsType = config.FsTypeNFS
+	}
+
+	volume := &csi.Volume{
+		VolumeId:      volumeID,
+		CapacityBytes: filesystem.GetReferencedQuotaSize(),
+		VolumeContext: map[string]string{
+			"dataIp":                cfg.DefaultDataIP,
+			"mountFsType":           fsType,
+			"mountPointPermissions": cfg.MountPointPermissions,
+			"sharedOverNfs":         strconv.FormatBool(filesystem.SharedOverNfs),
+			"sharedOverSmb":         strconv.FormatBool(filesystem.SharedOverSmb),
+		},
+	}
+	if cfg.DefaultMountOptions != "" {
+		volume.VolumeContext["mountOptions"] = cfg.DefaultMountOptions
+	}
+	// values of StorageClass parameters the volume was created with override config defaults
+	for key, property := range volumeContextParameters {
+		if value := userProperties[property]; value != "" {
+			volume.VolumeContext[key] = value
+		}
+	}
+	for property, key := range volumeContextMetadata {
+		if value := userProperties[property]; value != "" {
+			volume.VolumeContext[key] = value
+		}
+	}
+	volume.AccessibleTopology = s.getAccessibleTopology(configName, cfg.Zone)
+
+	return volume
+}
+
+// getAccessibleTopology - volume topology: zone and NexentaStor reachability key if enabled
+func (s *ControllerServer) getAccessibleTopology(configName, zone string) []*csi.Topology {
+	segments := map[string]string{}
+	if len(zone) > 0 {
+		segments[TopologyKeyZone] = zone
+	}
+	if s.applianceTopology {
+		segments[getApplianceTopologyKey(configName)] = "true"
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	return []*csi.Topology{
+		{
+			Segments: segments,
+		},
+	}
+}
+
+// getVolumeCondition - check that published volume filesystem is shared and its pool is healthy
+func (s *ControllerServer) getVolumeCondition(
+	nsProvider ns.ProviderInterface,
+	filesystem ns.Filesystem,
+	published bool,
+) (*csi.VolumeCondition, error) {
+	volumePath := filesystem.Path
+
+	if published && !filesystem.SharedOverNfs && !filesystem.SharedOverSmb {
+		return newVolumeCondition(filesystem, nef.Pool{}, published), nil
+	}
+
+	return s.getPoolCondition(nsProvider, volumePath)
+}
+
+// newVolumeCondition - volume is abnormal if its pool is not healthy or its filesystem is not shared
+// while it's published to nodes, volume is shared on publish in controller sharing mode
+func newVolumeCondition(filesystem ns.Filesystem, pool nef.Pool, published bool) *csi.VolumeCondition {
+	if published && !filesystem.SharedOverNfs && !filesystem.SharedOverSmb {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Filesystem '%s' is not shared over NFS or SMB", filesystem.Path),
+		}
+	}
+	return newPoolCondition(filesystem.Path, pool)
+}
+
+// newPoolCondition - volume is abnormal if its pool is not healthy
+func newPoolCondition(volumePath string, pool nef.Pool) *csi.VolumeCondition {
+	if !pool.IsHealthy() {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Pool '%s' of volume '%s' is %s", pool.Name, volumePath, pool.Health),
+		}
+	}
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  fmt.Sprintf("Volume '%s' is available, pool '%s' is %s", volumePath, pool.Name, pool.Health),
+	}
+}
+
+// getPoolCondition - volume is abnormal if its pool is not healthy
+func (s *ControllerServer) getPoolCondition(nsProvider ns.ProviderInterface, volumePath string) (
+	*csi.VolumeCondition,
+	error,
+) {
+	l := s.log.WithField("func", "getPoolCondition()")
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	poolName := strings.Split(volumePath, "/")[0]
+	pool, err := nefClient.GetPool(poolName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get pool '%s' of '%s': %s", poolName, volumePath, err)
+	}
+	condition := newPoolCondition(volumePath, pool)
+	if condition.Abnormal {
+		l.Warn(condition.Message)
+	}
+
+	return condition, nil
 }
 
 func (s *ControllerServer) resolveNS(params ResolveNSParams) (response ResolveNSResponse, err error) {
@@ -115,6 +578,8 @@ func (s *ControllerServer) resolveNS(params ResolveNSParams) (response ResolveNS
 		code := codes.Internal
 		if ns.IsNotExistNefError(err) {
 			code = codes.NotFound
+		} else if _, ok := err.(*placement.NoCandidatesError); ok {
+			code = codes.ResourceExhausted
 		}
 		return response, status.Errorf(
 			code,
@@ -161,7 +626,7 @@ func (s *ControllerServer) resolveCompatibilityConfig(params ResolveNSParams) (r
 }
 
 func (s *ControllerServer) resolveNSNoZone(params ResolveNSParams) (response ResolveNSResponse, err error) {
-	// No zone -> pick NS for given dataset and configName. TODO: load balancing
+	// No zone -> pick NS for given dataset and configName, or by placement policy (default one if not set)
 	l := s.log.WithField("func", "resolveNSNoZone()")
 	l.Infof("Resolving without zone, params: %+v", params)
 
@@ -187,30 +652,17 @@ func (s *ControllerServer) resolveNSNoZone(params ResolveNSParams) (response Res
 			configName:  params.configName,
 		}
 		return response, nil
-	} else {
-		for name, resolver := range s.nsResolverMap {
-			if params.datasetPath == "" {
-				datasetPath = s.config.NsMap[name].DefaultDataset
-			}
-			nsProvider, err = resolver.Resolve(datasetPath)
-			if nsProvider != nil {
-				return ResolveNSResponse{
-					datasetPath: datasetPath,
-					nsProvider:  nsProvider,
-					configName:  name,
-				}, err
-			}
-		}
 	}
-	if strings.Contains(err.Error(), "unknown authority") {
-		return response, status.Errorf(
-			codes.Unauthenticated, fmt.Sprintf("TLS certificate check error: %v", err.Error()))
+
+	// NexentaStor is always picked by placement policy, so the result doesn't depend on config map order
+	if params.placementPolicy == "" {
+		params.placementPolicy = placement.DefaultPolicy
 	}
-	return response, status.Errorf(codes.NotFound, fmt.Sprintf("No nsProvider found for params: %+v", params))
+	return s.resolveNSByPlacement(params)
 }
 
 func (s *ControllerServer) resolveNSWithZone(params ResolveNSParams) (response ResolveNSResponse, err error) {
-	// Pick NS with corresponding zone. TODO: load balancing
+	// Pick NS with corresponding zone by placement policy (default one if not set)
 	l := s.log.WithField("func", "resolveNSWithZone()")
 	l.Infof("Resolving with zone, params: %+v", params)
 	var nsProvider ns.ProviderInterface
@@ -235,36 +687,192 @@ func (s *ControllerServer) resolveNSWithZone(params ResolveNSParams) (response R
 			configName:  params.configName,
 		}
 		return response, nil
-	} else {
-		for name, resolver := range s.nsResolverMap {
-			if params.datasetPath == "" {
-				datasetPath = s.config.NsMap[name].DefaultDataset
-			} else {
-				datasetPath = params.datasetPath
+	}
+
+	// NexentaStor is always picked by placement policy, so the result doesn't depend on config map order
+	if params.placementPolicy == "" {
+		params.placementPolicy = placement.DefaultPolicy
+	}
+	return s.resolveNSByPlacement(params)
+}
+
+// resolveNSByPlacement - resolve dataset on all NexentaStors of the zone (all if zone is not set)
+// and pick one of them by placement policy using their live capacity data
+func (s *ControllerServer) resolveNSByPlacement(params ResolveNSParams) (response ResolveNSResponse, err error) {
+	l := s.log.WithField("func", "resolveNSByPlacement()")
+	l.Infof("Resolving by '%s' placement policy, params: %+v", params.placementPolicy, params)
+
+	// configs are checked in the same order every time
+	names := []string{}
+	for name := range s.nsResolverMap {
+		names = append(names, name)
+	}
+	names = pagination.SortedConfigNames(names)
+
+	resolved := map[string]ResolveNSResponse{}
+	candidates := []placement.Candidate{}
+	for _, name := range names {
+		resolver := s.nsResolverMap[name]
+		cfg := s.config.NsMap[name]
+		if params.zone != "" && params.zone != cfg.Zone {
+			continue
+		}
+		datasetPath := params.datasetPath
+		if datasetPath == "" {
+			datasetPath = cfg.DefaultDataset
+		}
+		nsProvider, resolveErr := resolver.Resolve(datasetPath)
+		if resolveErr != nil {
+			l.Infof("dataset '%s' is not resolved on NexentaStor [%s]: %s", datasetPath, name, resolveErr)
+			err = resolveErr
+			continue
+		}
+		resolved[name] = ResolveNSResponse{
+			datasetPath: datasetPath,
+			nsProvider:  nsProvider,
+			configName:  name,
+		}
+	}
+
+	if params.volumeName != "" {
+		for _, name := range names {
+			response, ok := resolved[name]
+			if !ok {
+				continue
 			}
-			if params.zone == s.config.NsMap[name].Zone {
-				nsProvider, err = resolver.Resolve(datasetPath)
-				if nsProvider != nil {
-					l.Infof("Found dataset %s on NexentaStor [%s]", datasetPath, name)
-					response = ResolveNSResponse{
-						datasetPath: datasetPath,
-						nsProvider:  nsProvider,
-						configName:  name,
-					}
-					l.Infof("configName: %+v", name)
-					return response, nil
-				}
+			volumePath := getNewVolumePath(s.config.NsMap[name], response.datasetPath, params)
+			exists, existsErr := isVolumeCreated(response.nsProvider, volumePath, params.csiName, params.isZvol)
+			if existsErr != nil {
+				return response, status.Errorf(
+					codes.Internal,
+					"Cannot check volume '%s' on NexentaStor [%s]: %s",
+					volumePath,
+					name,
+					existsErr,
+				)
+			} else if exists {
+				l.Infof("volume '%s' already exists on NexentaStor [%s], skip placement", volumePath, name)
+				return response, nil
 			}
 		}
 	}
-	if strings.Contains(err.Error(), "unknown authority") {
-		return response, status.Errorf(
-			codes.Unauthenticated, fmt.Sprintf("TLS certificate check error: %v", err.Error()))
+
+	for _, name := range names {
+		response, ok := resolved[name]
+		if !ok {
+			continue
+		}
+		cfg := s.config.NsMap[name]
+		candidate, candidateErr := getPlacementCandidate(
+			name,
+			cfg,
+			response.nsProvider,
+			response.datasetPath,
+			params.placementPolicy,
+		)
+		if candidateErr != nil {
+			l.Warnf("skip NexentaStor [%s]: %s", name, candidateErr)
+			err = candidateErr
+			continue
+		}
+		l.Infof("placement candidate: %+v", candidate)
+		candidates = append(candidates, candidate)
+	}
+
+	if len(candidates) == 0 {
+		if err != nil && strings.Contains(err.Error(), "unknown authority") {
+			return response, status.Errorf(
+				codes.Unauthenticated, fmt.Sprintf("TLS certificate check error: %v", err.Error()))
+		}
+		return response, status.Errorf(codes.NotFound, fmt.Sprintf("No nsProvider found for params: %+v", params))
+	}
+
+	selected, err := s.placer.Select(params.placementPolicy, candidates, params.reservedBytes)
+	if err != nil {
+		return response, err
+	}
+	l.Infof("NexentaStor [%s] is picked by '%s' placement policy", selected.Name, params.placementPolicy)
+	return resolved[selected.Name], nil
+}
+
+// getNewVolumePath - path of a new volume in the parent dataset, the same as prepareVolumePath() creates
+func getNewVolumePath(cfg config.NsData, datasetPath string, params ResolveNSParams) string {
+	if cfg.NamespaceDatasets && !params.isZvol {
+		return filepath.Join(datasetPath, params.namespace, params.volumeName)
+	}
+	return filepath.Join(datasetPath, params.volumeName)
+}
+
+// isVolumeCreated - true if the volume exists already, filesystems created before CSI name was recorded
+// belong to the volume of the same name
+func isVolumeCreated(nsProvider ns.ProviderInterface, volumePath, csiName string, isZvol bool) (bool, error) {
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return false, err
 	}
-	return response, status.Errorf(codes.NotFound, fmt.Sprintf("No nsProvider found for params: %+v", params))
+
+	if isZvol {
+		_, err = nefClient.GetVolume(volumePath)
+	} else {
+		var userProperties map[string]string
+		userProperties, err = nefClient.GetFilesystemUserProperties(volumePath)
+		if err == nil {
+			name, ok := userProperties[userPropertyVolumeName]
+			return !ok || name == csiName, nil
+		}
+	}
+	if ns.IsNotExistNefError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// getPlacementCandidate - collect capacity data of NexentaStor dataset, the data not used by the policy
+// and the pool free space floor are not requested
+func getPlacementCandidate(
+	name string,
+	cfg config.NsData,
+	nsProvider ns.ProviderInterface,
+	datasetPath string,
+	policy string,
+) (candidate placement.Candidate, err error) {
+	candidate = placement.Candidate{
+		Name:               name,
+		Weight:             cfg.PlacementWeight,
+		MinPoolFreePercent: cfg.MinPoolFreePercent,
+	}
+
+	candidate.FreeBytes, err = nsProvider.GetFilesystemAvailableCapacity(datasetPath)
+	if err != nil {
+		return candidate, fmt.Errorf("Cannot get free space of '%s': %s", datasetPath, err)
+	}
+
+	if cfg.MinPoolFreePercent > 0 {
+		poolName := strings.Split(datasetPath, "/")[0]
+		pool, err := nsProvider.GetFilesystem(poolName)
+		if err != nil {
+			return candidate, fmt.Errorf("Cannot get pool '%s' root filesystem: %s", poolName, err)
+		}
+		candidate.PoolFreeBytes = pool.BytesAvailable
+		candidate.PoolSizeBytes = pool.BytesAvailable + pool.BytesUsed
+	}
+
+	if policy == placement.PolicyFewestVolumes {
+		filesystems, err := nsProvider.GetFilesystems(datasetPath)
+		if err != nil {
+			return candidate, fmt.Errorf("Cannot get filesystems of '%s': %s", datasetPath, err)
+		}
+		volumes, err := nsProvider.GetVolumes(datasetPath)
+		if err != nil {
+			return candidate, fmt.Errorf("Cannot get volumes of '%s': %s", datasetPath, err)
+		}
+		candidate.VolumeCount = len(filesystems) + len(volumes)
+	}
+
+	return candidate, nil
 }
 
-// ListVolumes - list volumes, shows only volumes created in defaultDataset
+// ListVolumes - list volumes, shows only volumes created in defaultDataset and in its parent filesystems
 // TODO return only shared fs?
 func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse,
@@ -283,39 +891,90 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
 	if err != nil {
 		return nil, status.Errorf(codes.Aborted, "Cannot use config file: %s", err)
 	}
+
+	// token is composite: NexentaStors are listed one by one in config name order
+	token, err := pagination.Decode(startingToken)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Invalid starting token: %s", err)
+	}
+	configNames := []string{}
+	for configName := range s.config.NsMap {
+		configNames = append(configNames, configName)
+	}
+	configNames = pagination.SortedConfigNames(configNames)
+	startIndex, err := pagination.StartIndex(configNames, token)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Invalid starting token: %s", err)
+	}
+
+	// parent filesystems are walked once per listing, the next pages reuse the volumes
+	listingID := token.ListingID
+	if listingID == "" && maxEntries > 0 {
+		listingID = pagination.NewListingID()
+	}
+
 	nextToken := ""
 	entries := []*csi.ListVolumesResponse_Entry{}
-	filesystems := []ns.Filesystem{}
-	for configName, _ := range s.config.NsMap {
-		params := ResolveNSParams{
-			configName: configName,
+	cursor := token.Cursor
+	for i := startIndex; i < len(configNames); i++ {
+		configName := configNames[i]
+		limit := 0
+		if maxEntries > 0 {
+			limit = maxEntries - len(entries)
 		}
-		resolveResp, err := s.resolveNS(params)
+
+		resolveResp, err := s.resolveNS(ResolveNSParams{
+			configName: configName,
+		})
 		if err != nil {
 			return nil, err
 		}
 		nsProvider := resolveResp.nsProvider
-		datasetPath := resolveResp.datasetPath
-
-		filesystems, nextToken, err = nsProvider.GetFilesystemsWithStartingToken(
-			datasetPath,
-			startingToken,
-			maxEntries,
+		volumes, err := s.getListingDatasetVolumes(
+			listingID,
+			configName,
+			nsProvider,
+			resolveResp.datasetPath,
+			cursor,
 		)
-		for _, item := range filesystems {
-			entries = append(entries, &csi.ListVolumesResponse_Entry{
-				Volume: &csi.Volume{VolumeId: fmt.Sprintf("%s:%s", configName, item.Path)},
-			})
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	if len(entries) == 0 {
-		return nil, status.Errorf(codes.Aborted, "Cannot get filesystems: %s", err)
-	} else if startingToken != "" && len(entries) == 0 {
-		return nil, status.Errorf(
-			codes.Aborted,
-			fmt.Sprintf("Failed to find filesystem started from token '%s': %s", startingToken, err),
-		)
+		// volumes are sorted by path, cursor is the last returned volume path
+		paths := []string{}
+		for _, path := range volumes.paths() {
+			if path > cursor {
+				paths = append(paths, path)
+			}
+		}
+		cursor = ""
+		nsNextToken := ""
+		if limit > 0 && len(paths) > limit {
+			paths = paths[:limit]
+			nsNextToken = paths[limit-1]
+		}
+
+		if len(paths) != 0 {
+			configEntries, err := s.getListVolumesEntries(nsProvider, configName, volumes, paths)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, configEntries...)
+		}
+
+		if maxEntries > 0 && len(entries) >= maxEntries {
+			if nsNextToken != "" {
+				nextToken = pagination.Token{
+					ConfigName: configName,
+					Cursor:     nsNextToken,
+					ListingID:  listingID,
+				}.Encode()
+			} else if i+1 < len(configNames) {
+				nextToken = pagination.Token{ConfigName: configNames[i+1], ListingID: listingID}.Encode()
+			}
+			break
+		}
 	}
 
 	l.Infof("found %d entries(s)", len(entries))
@@ -326,17 +985,235 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
 	}, nil
 }
 
-// CreateVolume - creates FS on NexentaStor
-func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
-	res *csi.CreateVolumeResponse,
-	err error,
-) {
-	l := s.log.WithField("func", "CreateVolume()")
-	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
-	volumeName := req.GetName()
-	if len(volumeName) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "req.Name must be provided")
-	}
+// datasetVolumes - volume filesystems of the dataset, including the ones in nested parent filesystems,
+// and zvols of the dataset
+type datasetVolumes struct {
+	// filesystems - volume filesystems by their paths
+	filesystems map[string]ns.Filesystem
+	// zvols - zvols by their paths
+	zvols map[string]nef.VolumeProperties
+	// parents - paths of nested parent filesystems
+	parents map[string]bool
+	// userProperties - user properties of volume filesystems and zvols by their paths
+	userProperties map[string]map[string]string
+}
+
+// paths - sorted paths of volume filesystems and zvols
+func (v datasetVolumes) paths() []string {
+	paths := []string{}
+	for path := range v.filesystems {
+		paths = append(paths, path)
+	}
+	for path := range v.zvols {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// getDatasetVolumes - walk the dataset and its parent filesystems created by the driver (namespace parents
+// and intermediate filesystems of templated names), other child filesystems are volumes, zvols are created
+// in the dataset directly
+func (s *ControllerServer) getDatasetVolumes(nsProvider ns.ProviderInterface, datasetPath string) (
+	datasetVolumes,
+	error,
+) {
+	volumes := datasetVolumes{
+		filesystems:    map[string]ns.Filesystem{},
+		zvols:          map[string]nef.VolumeProperties{},
+		parents:        map[string]bool{},
+		userProperties: map[string]map[string]string{},
+	}
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return volumes, err
+	}
+
+	queue := []string{datasetPath}
+	for len(queue) != 0 {
+		parentPath := queue[0]
+		queue = queue[1:]
+
+		filesystems, err := nsProvider.GetFilesystems(parentPath)
+		if err != nil {
+			return volumes, err
+		}
+		userProperties, err := nefClient.GetFilesystemsUserProperties(parentPath)
+		if err != nil {
+			return volumes, err
+		}
+
+		for _, filesystem := range filesystems {
+			switch userProperties[filesystem.Path][userPropertyRole] {
+			case roleParent:
+				volumes.parents[filesystem.Path] = true
+				queue = append(queue, filesystem.Path)
+			case roleTrash, roleRetained:
+				// deleted volumes are not listed
+			default:
+				volumes.filesystems[filesystem.Path] = filesystem
+				volumes.userProperties[filesystem.Path] = userProperties[filesystem.Path]
+			}
+		}
+	}
+
+	zvols, err := nefClient.GetVolumesProperties(datasetPath)
+	if err != nil {
+		return volumes, err
+	}
+	for _, zvol := range zvols {
+		volumes.zvols[zvol.Path] = zvol
+		volumes.userProperties[zvol.Path] = zvol.UserProperties
+	}
+
+	return volumes, nil
+}
+
+// datasetVolumesCacheTTL - volumes of a paginated listing are kept for its next pages during this time
+const datasetVolumesCacheTTL = 5 * time.Minute
+
+// datasetVolumesCacheSize - max number of walked datasets kept, the oldest one is evicted first
+const datasetVolumesCacheSize = 16
+
+// datasetVolumesCacheEntry - volumes of NexentaStor dataset walked for a listing
+type datasetVolumesCacheEntry struct {
+	volumes   datasetVolumes
+	expiresAt time.Time
+}
+
+// getListingDatasetVolumes - volumes of the dataset walked once per paginated listing, not paginated
+// listing (empty listing ID) walks the dataset every time. Listing continued in the middle of the dataset
+// (cursor is set) is Aborted if its walk is expired, evicted or lost on restart, so the CO restarts it
+// instead of getting pages of a different walk.
+func (s *ControllerServer) getListingDatasetVolumes(
+	listingID string,
+	configName string,
+	nsProvider ns.ProviderInterface,
+	datasetPath string,
+	cursor string,
+) (datasetVolumes, error) {
+	if listingID == "" {
+		volumes, err := s.getDatasetVolumes(nsProvider, datasetPath)
+		if err != nil {
+			return volumes, status.Errorf(codes.Internal, "Cannot get volumes of [%s]: %s", configName, err)
+		}
+		return volumes, nil
+	}
+
+	key := fmt.Sprintf("%s:%s:%s", listingID, configName, datasetPath)
+	now := time.Now()
+
+	s.datasetVolumesCacheMutex.Lock()
+	entry, ok := s.datasetVolumesCache[key]
+	for k, e := range s.datasetVolumesCache {
+		if now.After(e.expiresAt) {
+			delete(s.datasetVolumesCache, k)
+		}
+	}
+	s.datasetVolumesCacheMutex.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.volumes, nil
+	} else if cursor != "" {
+		return datasetVolumes{}, status.Errorf(
+			codes.Aborted,
+			"Listing '%s' of [%s] is expired, restart it without starting token",
+			listingID,
+			configName,
+		)
+	}
+
+	volumes, err := s.getDatasetVolumes(nsProvider, datasetPath)
+	if err != nil {
+		return volumes, status.Errorf(codes.Internal, "Cannot get volumes of [%s]: %s", configName, err)
+	}
+
+	s.datasetVolumesCacheMutex.Lock()
+	if len(s.datasetVolumesCache) >= datasetVolumesCacheSize {
+		oldestKey := ""
+		for k, e := range s.datasetVolumesCache {
+			if oldestKey == "" || e.expiresAt.Before(s.datasetVolumesCache[oldestKey].expiresAt) {
+				oldestKey = k
+			}
+		}
+		delete(s.datasetVolumesCache, oldestKey)
+	}
+	s.datasetVolumesCache[key] = datasetVolumesCacheEntry{
+		volumes:   volumes,
+		expiresAt: now.Add(datasetVolumesCacheTTL),
+	}
+	s.datasetVolumesCacheMutex.Unlock()
+
+	return volumes, nil
+}
+
+// getListVolumesEntries - build ListVolumes entries of NexentaStor filesystems and zvols with their capacity,
+// context, topology, published nodes and condition, pools are requested once
+func (s *ControllerServer) getListVolumesEntries(
+	nsProvider ns.ProviderInterface,
+	configName string,
+	volumes datasetVolumes,
+	paths []string,
+) ([]*csi.ListVolumesResponse_Entry, error) {
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+
+	cfg := s.config.NsMap[configName]
+	pools := map[string]nef.Pool{}
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for _, path := range paths {
+		poolName := strings.Split(path, "/")[0]
+		pool, ok := pools[poolName]
+		if !ok {
+			pool, err = nefClient.GetPool(poolName)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "Cannot get pool '%s': %s", poolName, err)
+			}
+			pools[poolName] = pool
+		}
+
+		volumeID := fmt.Sprintf("%s:%s", configName, path)
+		publishedNodes := parsePublishedNodes(volumes.userProperties[path][userPropertyPublishedNodes])
+		entry := &csi.ListVolumesResponse_Entry{
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodes,
+			},
+		}
+		if filesystem, ok := volumes.filesystems[path]; ok {
+			entry.Volume = s.getCSIVolume(volumeID, configName, filesystem, volumes.userProperties[path])
+			entry.Status.VolumeCondition = newVolumeCondition(filesystem, pool, len(publishedNodes) != 0)
+		} else {
+			protocol, err := s.getZvolProtocol(nsProvider, cfg, path)
+			if err != nil {
+				return nil, err
+			}
+			entry.Volume = &csi.Volume{
+				VolumeId:           volumeID,
+				CapacityBytes:      volumes.zvols[path].VolumeSize,
+				VolumeContext:      map[string]string{"protocol": protocol},
+				AccessibleTopology: s.getAccessibleTopology(configName, cfg.Zone),
+			}
+			entry.Status.VolumeCondition = newPoolCondition(path, pool)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// CreateVolume - creates FS on NexentaStor
+func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
+	res *csi.CreateVolumeResponse,
+	err error,
+) {
+	l := s.log.WithField("func", "CreateVolume()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+	csiName := req.GetName()
+	if len(csiName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "req.Name must be provided")
+	}
 	var secret string
 	secrets := req.GetSecrets()
 	for _, v := range secrets {
@@ -368,6 +1245,7 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	var contentSource *csi.VolumeContentSource
 	var nsProvider ns.ProviderInterface
 	var resolveResp ResolveNSResponse
+	var unlockParents func()
 
 	if volumeContentSource := req.GetVolumeContentSource(); volumeContentSource != nil {
 		if sourceSnapshot := volumeContentSource.GetSnapshot(); sourceSnapshot != nil {
@@ -390,6 +1268,12 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		reqParams = make(map[string]string)
 	}
 
+	protocol := reqParams["protocol"]
+	err = validateVolumeProtocol(protocol, volumeCapabilities, contentSource)
+	if err != nil {
+		return nil, err
+	}
+
 	// get dataset path from runtime params, set default if not specified
 	datasetPath := ""
 	if v, ok := reqParams["dataset"]; ok {
@@ -400,16 +1284,149 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		configName = v
 	}
 
+	placementPolicy := placement.DefaultPolicy
+	if v, ok := reqParams["placementPolicy"]; ok {
+		if !placement.IsValidPolicy(v) {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"Unsupported placement policy '%s', supported: %v",
+				v,
+				placement.Policies,
+			)
+		}
+		placementPolicy = v
+	}
+
+	cloneMode := CloneModeSnapshot
+	if v, ok := reqParams["cloneMode"]; ok {
+		cloneMode = ""
+		for _, mode := range CloneModes {
+			if v == mode {
+				cloneMode = v
+			}
+		}
+		if cloneMode == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Unsupported clone mode '%s', supported: %v", v, CloneModes)
+		}
+	}
+
+	// volume dataset name relative to the parent dataset
+	volumeName := csiName
+	if v, ok := reqParams["volumeNameTemplate"]; ok {
+		if isZvolProtocol(protocol) {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"'volumeNameTemplate' parameter is supported for NFS/SMB volumes only, but protocol is '%s'",
+				protocol,
+			)
+		}
+		var nameTemplate *naming.Template
+		nameTemplate, err = naming.ParseTemplate(v)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		volumeName, err = nameTemplate.Render(naming.NewTemplateData(csiName, reqParams))
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	deletePolicy := DeletePolicyDestroy
+	if v, ok := reqParams["deletePolicy"]; ok {
+		deletePolicy = ""
+		for _, policy := range DeletePolicies {
+			if v == policy {
+				deletePolicy = v
+			}
+		}
+		if deletePolicy == "" {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"Unsupported delete policy '%s', supported: %v",
+				v,
+				DeletePolicies,
+			)
+		} else if deletePolicy != DeletePolicyDestroy && isZvolProtocol(protocol) {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"'deletePolicy: %s' is supported for NFS/SMB volumes only, but protocol is '%s'",
+				deletePolicy,
+				protocol,
+			)
+		} else if deletePolicy == DeletePolicyTrash {
+			// checked before anything is created on NexentaStor
+			if err := s.checkTrashDataset(configName, sourceSnapshotId+sourceVolumeId); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	properties, err := zfs.FromParameters(reqParams)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	} else if len(properties) != 0 && isZvolProtocol(protocol) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"'%s*' parameters are supported for NFS/SMB volumes only, but protocol is '%s'",
+			zfs.ParameterPrefix,
+			protocol,
+		)
+	}
+
+	// get requested volume size from runtime params, set default if not specified
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	provisioningType := ProvisioningTypeThin
+	if v, ok := reqParams["provisioningType"]; ok {
+		if v != ProvisioningTypeThin && v != ProvisioningTypeThick {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"Unsupported provisioning type '%s', supported: [%s %s]",
+				v,
+				ProvisioningTypeThin,
+				ProvisioningTypeThick,
+			)
+		}
+		provisioningType = v
+	}
+	reservationBytes, err := getReservation(reqParams, provisioningType, protocol, capacityBytes)
+	if err != nil {
+		return nil, err
+	}
+	var userProperties map[string]string
+	if !isZvolProtocol(protocol) {
+		userProperties = getMetadataUserProperties(reqParams, volumeMetadataParameters, time.Now())
+		userProperties[userPropertyVolumeName] = csiName
+		userProperties[userPropertyRole] = roleVolume
+		userProperties[userPropertyDeletePolicy] = deletePolicy
+		for key, property := range volumeContextParameters {
+			if value := reqParams[key]; value != "" {
+				userProperties[property] = value
+			}
+		}
+		if reservationBytes != 0 {
+			properties["referencedReservationSize"] = reservationBytes
+			userProperties[userPropertyProvisioningType] = provisioningType
+		}
+		properties["userProperties"] = userProperties
+	}
+
+	// thick zvol reserves its whole size
+	placementReservedBytes := reservationBytes
+	if isZvolProtocol(protocol) && provisioningType == ProvisioningTypeThick {
+		placementReservedBytes = getZvolSize(capacityBytes)
+	}
+
 	requirements := req.GetAccessibilityRequirements()
 	zone := s.pickAvailabilityZone(requirements)
 	params := ResolveNSParams{
-		datasetPath: datasetPath,
-		zone:        zone,
-		configName:  configName,
+		datasetPath:     datasetPath,
+		zone:            zone,
+		configName:      configName,
+		placementPolicy: placementPolicy,
+		reservedBytes:   placementReservedBytes,
 	}
 
-	// get requested volume size from runtime params, set default if not specified
-	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
 	if sourceSnapshotId != "" {
 		// create new volume using existing snapshot
 		var volInfo VolumeInfo
@@ -427,8 +1444,23 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		}
 		nsProvider = resolveResp.nsProvider
 		datasetPath = resolveResp.datasetPath
-		volumePath = filepath.Join(datasetPath, volumeName)
-		err = s.createNewVolumeFromSnapshot(nsProvider, volInfo.Path, volumePath, capacityBytes)
+		volumePath, unlockParents, err = s.prepareVolumePath(
+			nsProvider,
+			s.config.NsMap[resolveResp.configName],
+			datasetPath,
+			volumeName,
+			csiName,
+			reqParams[naming.ParameterPVCNamespace],
+			userProperties,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer unlockParents()
+		if err = s.checkReservationSpace(nsProvider, volumePath, reservationBytes); err != nil {
+			return nil, err
+		}
+		err = s.createNewVolumeFromSnapshot(nsProvider, volInfo.Path, volumePath, capacityBytes, properties)
 	} else if sourceVolumeId != "" {
 		// clone existing volume
 		var volInfo VolumeInfo
@@ -446,17 +1478,72 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		}
 		nsProvider = resolveResp.nsProvider
 		datasetPath = resolveResp.datasetPath
-		volumePath = filepath.Join(datasetPath, volumeName)
-		err = s.createClonedVolume(nsProvider, volInfo.Path, volumePath, volumeName, capacityBytes)
+		volumePath, unlockParents, err = s.prepareVolumePath(
+			nsProvider,
+			s.config.NsMap[resolveResp.configName],
+			datasetPath,
+			volumeName,
+			csiName,
+			reqParams[naming.ParameterPVCNamespace],
+			userProperties,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer unlockParents()
+		if err = s.checkReservationSpace(nsProvider, volumePath, reservationBytes); err != nil {
+			return nil, err
+		}
+		err = s.createClonedVolume(
+			nsProvider,
+			volInfo.Path,
+			volumePath,
+			csiName,
+			capacityBytes,
+			cloneMode,
+			properties,
+		)
 	} else {
+		params.volumeName = volumeName
+		params.csiName = csiName
+		params.namespace = reqParams[naming.ParameterPVCNamespace]
+		params.isZvol = isZvolProtocol(protocol)
 		resolveResp, err = s.resolveNS(params)
 		if err != nil {
 			return nil, err
 		}
 		nsProvider = resolveResp.nsProvider
 		datasetPath = resolveResp.datasetPath
-		volumePath = filepath.Join(datasetPath, volumeName)
-		err = s.createNewVolume(nsProvider, volumePath, capacityBytes)
+		volumePath, unlockParents, err = s.prepareVolumePath(
+			nsProvider,
+			s.config.NsMap[resolveResp.configName],
+			datasetPath,
+			volumeName,
+			csiName,
+			reqParams[naming.ParameterPVCNamespace],
+			userProperties,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer unlockParents()
+		if isZvolProtocol(protocol) {
+			capacityBytes = getZvolSize(capacityBytes)
+			// thick zvol reserves its whole size
+			thick := provisioningType == ProvisioningTypeThick
+			if thick {
+				reservationBytes = capacityBytes
+			}
+			if err = s.checkReservationSpace(nsProvider, volumePath, reservationBytes); err != nil {
+				return nil, err
+			}
+			err = s.createNewZvol(nsProvider, volumePath, capacityBytes, !thick)
+		} else {
+			if err = s.checkReservationSpace(nsProvider, volumePath, reservationBytes); err != nil {
+				return nil, err
+			}
+			err = s.createNewVolume(nsProvider, volumePath, capacityBytes, properties)
+		}
 	}
 	if err != nil {
 		return nil, err
@@ -483,12 +1570,18 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 			},
 		},
 	}
-	if len(zone) > 0 {
-		res.Volume.AccessibleTopology = []*csi.Topology{
-			{
-				Segments: map[string]string{TopologyKeyZone: zone},
-			},
+	res.Volume.AccessibleTopology = s.getAccessibleTopology(resolveResp.configName, zone)
+	if isZvolProtocol(protocol) {
+		dataIP := getVolumeDataIP(reqParams, cfg)
+		if protocol == ProtocolNVMeTCP {
+			err = s.exportNVMeZvol(nsProvider, cfg, volumePath, dataIP, res.Volume.VolumeContext)
+		} else {
+			err = s.exportISCSIZvol(nsProvider, cfg, volumePath, dataIP, res.Volume.VolumeContext)
+		}
+		if err != nil {
+			return nil, err
 		}
+		return res, nil
 	}
 	// Create NFS share if passed in params
 	if v, ok := reqParams["nfsAccessList"]; ok {
@@ -497,9 +1590,192 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 			return nil, err
 		}
 	}
+	// share volume and pass mount source to the node, so it doesn't need NexentaStor credentials
+	if cfg.ControllerSharing {
+		readOnly := true
+		for _, reqC := range volumeCapabilities {
+			readOnly = readOnly && isReadOnlyAccessMode(reqC)
+		}
+		fsType := getVolumeMountFsType(reqParams, cfg)
+		mountSource, err := s.shareVolume(nsProvider, volumePath, fsType, getVolumeDataIP(reqParams, cfg), readOnly)
+		if err != nil {
+			return nil, err
+		}
+		res.Volume.VolumeContext["mountSource"] = mountSource
+		res.Volume.VolumeContext["mountFsType"] = fsType
+	}
 	return res, nil
 }
 
+// checkTrashDataset - volume with 'deletePolicy: trash' may be created only on NexentaStors with trash dataset:
+// the one set by configName parameter or the one of the volume source, otherwise any of them may be picked
+func (s *ControllerServer) checkTrashDataset(configName, sourceID string) error {
+	if sourceID != "" {
+		if volInfo, err := ParseVolumeID(sourceID); err == nil && volInfo.ConfigName != "" {
+			configName = volInfo.ConfigName
+		}
+	}
+
+	names := []string{}
+	for name := range s.config.NsMap {
+		names = append(names, name)
+	}
+	for _, name := range pagination.SortedConfigNames(names) {
+		if (configName == "" || name == configName) && s.config.NsMap[name].TrashDataset == "" {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"'deletePolicy: trash' requires 'trashDataset' to be set in driver config of NexentaStor [%s]",
+				name,
+			)
+		}
+	}
+	return nil
+}
+
+// prepareVolumePath - path of a new volume in the parent dataset, creates namespace parent filesystem
+// and intermediate filesystems of templated volume name. Existing filesystem on this path must belong
+// to the same CSI volume. Zvols have no user properties and are created in the parent dataset directly.
+// Returned unlock function must be called after the volume is created, so the parents are not destroyed
+// by destroyEmptyParents() before that.
+func (s *ControllerServer) prepareVolumePath(
+	nsProvider ns.ProviderInterface,
+	cfg config.NsData,
+	datasetPath string,
+	volumeName string,
+	csiName string,
+	namespace string,
+	userProperties map[string]string,
+) (volumePath string, unlock func(), err error) {
+	l := s.log.WithField("func", "prepareVolumePath()")
+
+	namespaceDatasets := cfg.NamespaceDatasets && userProperties != nil
+	if namespaceDatasets {
+		if namespace == "" {
+			return "", nil, status.Error(
+				codes.InvalidArgument,
+				"PVC namespace is required for namespace datasets, set --extra-create-metadata option of csi-provisioner",
+			)
+		} else if err := naming.ValidateName(namespace); err != nil || strings.Contains(namespace, "/") {
+			return "", nil, status.Errorf(codes.InvalidArgument, "Invalid PVC namespace '%s' for dataset name", namespace)
+		}
+		volumeName = filepath.Join(namespace, volumeName)
+	}
+
+	unlock = func() {}
+	topParentPath := getTopParentPath(datasetPath, filepath.Dir(filepath.Join(datasetPath, volumeName)))
+	if topParentPath != "" {
+		lock := s.parentLocks.get(topParentPath)
+		lock.RLock()
+		unlock = lock.RUnlock
+		defer func() {
+			if err != nil {
+				lock.RUnlock()
+			}
+		}()
+	}
+
+	if namespaceDatasets {
+		if err := s.ensureNamespaceDataset(nsProvider, cfg, filepath.Join(datasetPath, namespace), namespace); err != nil {
+			return "", nil, err
+		}
+	}
+
+	volumePath = filepath.Join(datasetPath, volumeName)
+	if err := naming.ValidateDatasetPath(volumePath); err != nil {
+		return "", nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if userProperties != nil {
+		userProperties[userPropertyDataset] = datasetPath
+	}
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return "", nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	existingProperties, err := nefClient.GetFilesystemUserProperties(volumePath)
+	if err == nil {
+		// filesystems created before CSI name was recorded belong to the volume of the same name
+		if name, ok := existingProperties[userPropertyVolumeName]; ok && name != csiName {
+			return "", nil, status.Errorf(
+				codes.AlreadyExists,
+				"Filesystem '%s' already exists and belongs to volume '%s', not to '%s'",
+				volumePath,
+				name,
+				csiName,
+			)
+		}
+		return volumePath, unlock, nil
+	} else if !ns.IsNotExistNefError(err) {
+		return "", nil, status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", volumePath, err)
+	}
+
+	parentPath := datasetPath
+	for _, component := range strings.Split(filepath.Dir(volumeName), "/") {
+		if component == "." {
+			break
+		}
+		parentPath = filepath.Join(parentPath, component)
+		err = nefClient.CreateFilesystem(nef.CreateFilesystemParams{
+			Path: parentPath,
+			Properties: map[string]interface{}{
+				"userProperties": map[string]string{userPropertyRole: roleParent},
+			},
+		})
+		if err != nil && !ns.IsAlreadyExistNefError(err) {
+			return "", nil, status.Errorf(codes.Internal, "Cannot create parent filesystem '%s': %s", parentPath, err)
+		} else if err == nil {
+			l.Infof("parent filesystem '%s' has been created", parentPath)
+		}
+	}
+
+	return volumePath, unlock, nil
+}
+
+// ensureNamespaceDataset - create namespace parent filesystem if it doesn't exist and set its aggregate quota
+// from the config, so quota changes are applied when the next volume of the namespace is created
+func (s *ControllerServer) ensureNamespaceDataset(
+	nsProvider ns.ProviderInterface,
+	cfg config.NsData,
+	parentPath string,
+	namespace string,
+) error {
+	l := s.log.WithField("func", "ensureNamespaceDataset()")
+
+	quota, err := cfg.GetNamespaceQuota(namespace)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "Invalid quota of namespace '%s' in config: %s", namespace, err)
+	}
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	properties := map[string]interface{}{
+		"userProperties": map[string]string{userPropertyRole: roleParent},
+	}
+	if quota != 0 {
+		properties["quotaSize"] = quota
+	}
+	err = nefClient.CreateFilesystem(nef.CreateFilesystemParams{
+		Path:       parentPath,
+		Properties: properties,
+	})
+	if err == nil {
+		l.Infof("namespace filesystem '%s' has been created, quota: %d", parentPath, quota)
+		return nil
+	} else if !ns.IsAlreadyExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot create namespace filesystem '%s': %s", parentPath, err)
+	}
+
+	if quota != 0 {
+		err = nefClient.SetFilesystemProperties(parentPath, map[string]interface{}{"quotaSize": quota})
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot set quota of namespace filesystem '%s': %s", parentPath, err)
+		}
+	}
+	return nil
+}
+
 func (s *ControllerServer) createNfsShare(
 	volumePath string,
 	reqParams string,
@@ -515,7 +1791,6 @@ func (s *ControllerServer) createNfsShare(
 	for _, item := range ruleList {
 		mode, address := "", ""
 		mask := 0
-		etype := "fqdn"
 		if strings.Contains(item, ":") {
 			splittedRule := strings.Split(item, ":")
 			mode, address = strings.TrimSpace(splittedRule[0]), strings.TrimSpace(splittedRule[1])
@@ -531,22 +1806,11 @@ func (s *ControllerServer) createNfsShare(
 				return err
 			}
 		}
-		if mask != 0 {
-			etype = "network"
-		}
 
 		if mode == "ro" {
-			nfsParams.ReadOnlyList = append(nfsParams.ReadOnlyList, ns.NfsRuleList{
-				Entity: address,
-				Etype:  etype,
-				Mask:   mask,
-			})
+			nfsParams.ReadOnlyList = append(nfsParams.ReadOnlyList, newNfsRule(address, mask))
 		} else {
-			nfsParams.ReadWriteList = append(nfsParams.ReadWriteList, ns.NfsRuleList{
-				Entity: address,
-				Etype:  etype,
-				Mask:   mask,
-			})
+			nfsParams.ReadWriteList = append(nfsParams.ReadWriteList, newNfsRule(address, mask))
 		}
 	}
 	err = nsProvider.CreateNfsShare(nfsParams)
@@ -571,44 +1835,46 @@ func (s *ControllerServer) createNewVolume(
 	nsProvider ns.ProviderInterface,
 	volumePath string,
 	capacityBytes int64,
+	properties zfs.Properties,
 ) error {
 	l := s.log.WithField("func", "createNewVolume()")
-	l.Infof("nsProvider: %s, volumePath: %s", nsProvider, volumePath)
-
-	err := nsProvider.CreateFilesystem(ns.CreateFilesystemParams{
-		Path:                volumePath,
-		ReferencedQuotaSize: capacityBytes,
-		//TODO consider to use option:
-		// reservationSize (integer, optional): Sets the minimum amount of disk space guaranteed to a dataset
-		// and its descendants. Value zero means no quota.
-	})
+	l.Infof("nsProvider: %s, volumePath: %s, properties: %v", nsProvider, volumePath, properties)
 
-	if err != nil {
-		if ns.IsAlreadyExistNefError(err) {
-			existingFilesystem, err := nsProvider.GetFilesystem(volumePath)
-			if err != nil {
-				return status.Errorf(
-					codes.Internal,
-					"Volume '%s' already exists, but volume properties request failed: %s",
-					volumePath,
-					err,
-				)
-			} else if capacityBytes != 0 && existingFilesystem.GetReferencedQuotaSize() != capacityBytes {
-				return status.Errorf(
-					codes.AlreadyExists,
-					"Volume '%s' already exists, but with a different size: requested=%d, existing=%d",
-					volumePath,
-					capacityBytes,
-					existingFilesystem.GetReferencedQuotaSize(),
-				)
-			}
+	var err error
+	if len(properties) == 0 {
+		err = nsProvider.CreateFilesystem(ns.CreateFilesystemParams{
+			Path:                volumePath,
+			ReferencedQuotaSize: capacityBytes,
+		})
+	} else {
+		// properties like recordsize apply to data written after they are set, so set them on creation
+		var nefClient *nef.Client
+		nefClient, err = nef.New(nsProvider)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+		}
+		err = nefClient.CreateFilesystem(nef.CreateFilesystemParams{
+			Path:                volumePath,
+			ReferencedQuotaSize: capacityBytes,
+			Properties:          properties,
+		})
+	}
 
+	if err != nil {
+		if ns.IsAlreadyExistNefError(err) {
+			if err := s.checkExistingVolumeSize(nsProvider, volumePath, capacityBytes); err != nil {
+				return err
+			}
 			l.Infof("volume '%s' already exists and can be used", volumePath)
 			return nil
 		}
 
+		code := codes.Internal
+		if nef.IsNoSpaceNefError(err) {
+			code = codes.ResourceExhausted
+		}
 		return status.Errorf(
-			codes.Internal,
+			code,
 			"Cannot create volume '%s': %s",
 			volumePath,
 			err,
@@ -619,243 +1885,1290 @@ func (s *ControllerServer) createNewVolume(
 	return nil
 }
 
-// create new volume using existing snapshot
-func (s *ControllerServer) createNewVolumeFromSnapshot(
+// checkExistingVolumeSize - existing filesystem can be used for the request only if it has requested size
+func (s *ControllerServer) checkExistingVolumeSize(
 	nsProvider ns.ProviderInterface,
-	sourceSnapshotID string,
 	volumePath string,
 	capacityBytes int64,
 ) error {
-	l := s.log.WithField("func", "createNewVolumeFromSnapshot()")
-	l.Infof("snapshot: %s", sourceSnapshotID)
-
-	snapshot, err := nsProvider.GetSnapshot(sourceSnapshotID)
+	existingFilesystem, err := nsProvider.GetFilesystem(volumePath)
 	if err != nil {
-		message := fmt.Sprintf("Failed to find snapshot '%s': %s", sourceSnapshotID, err)
-		if ns.IsNotExistNefError(err) || ns.IsBadArgNefError(err) {
-			return status.Error(codes.NotFound, message)
+		return status.Errorf(
+			codes.Internal,
+			"Volume '%s' already exists, but volume properties request failed: %s",
+			volumePath,
+			err,
+		)
+	} else if capacityBytes != 0 && existingFilesystem.GetReferencedQuotaSize() != capacityBytes {
+		return status.Errorf(
+			codes.AlreadyExists,
+			"Volume '%s' already exists, but with a different size: requested=%d, existing=%d",
+			volumePath,
+			capacityBytes,
+			existingFilesystem.GetReferencedQuotaSize(),
+		)
+	}
+	return nil
+}
+
+// getReservation - space to reserve for NFS/SMB volume filesystem: the whole size of thick volume
+// or explicit `reservation` parameter value, zvol reservation is set by creating not sparse zvol
+func getReservation(
+	reqParams map[string]string,
+	provisioningType string,
+	protocol string,
+	capacityBytes int64,
+) (int64, error) {
+	value, ok := reqParams["reservation"]
+	if !ok {
+		if provisioningType == ProvisioningTypeThick && !isZvolProtocol(protocol) {
+			if capacityBytes == 0 {
+				return 0, status.Error(codes.InvalidArgument, "Thick volume requires capacity to be requested")
+			}
+			return capacityBytes, nil
 		}
-		return status.Error(codes.NotFound, message)
+		return 0, nil
 	}
 
-	err = nsProvider.CloneSnapshot(snapshot.Path, ns.CloneSnapshotParams{
-		TargetPath:          volumePath,
-		ReferencedQuotaSize: capacityBytes,
-	})
+	if provisioningType == ProvisioningTypeThick {
+		return 0, status.Error(
+			codes.InvalidArgument,
+			"'reservation' parameter can't be used with thick provisioning, the whole volume is reserved",
+		)
+	} else if isZvolProtocol(protocol) {
+		return 0, status.Errorf(
+			codes.InvalidArgument,
+			"'reservation' parameter is supported for NFS/SMB volumes only, but protocol is '%s'",
+			protocol,
+		)
+	}
+	reservationBytes, err := zfs.ParseSize(value)
 	if err != nil {
-		if ns.IsAlreadyExistNefError(err) {
-			//TODO validate snapshot's "bytesReferenced" is less than required volume size
-
-			// existingFilesystem, err := nsProvider.GetFilesystem(volumePath)
-			// if err != nil {
-			//  return nil, status.Errorf(
-			//      codes.Internal,
-			//      "Volume '%s' already exists, but volume properties request failed: %s",
-			//      volumePath,
-			//      err,
-			//  )
-			// } else if existingFilesystem.GetReferencedQuotaSize() != capacityBytes {
-			//  return nil, status.Errorf(
-			//      codes.AlreadyExists,
-			//      "Volume '%s' already exists, but with a different size: requested=%d, existing=%d",
-			//      volumePath,
-			//      capacityBytes,
-			//      existingFilesystem.GetReferencedQuotaSize(),
-			//  )
-			// }
+		return 0, status.Errorf(codes.InvalidArgument, "Invalid 'reservation' parameter: %s", err)
+	} else if capacityBytes != 0 && reservationBytes > capacityBytes {
+		return 0, status.Errorf(
+			codes.InvalidArgument,
+			"Reservation %d is greater than requested volume size %d",
+			reservationBytes,
+			capacityBytes,
+		)
+	}
+	return reservationBytes, nil
+}
 
-			l.Infof("volume '%s' already exists and can be used", volumePath)
-			return nil
-		}
+// checkReservationSpace - reservation of a new volume must fit free space of its parent filesystem
+// (it respects namespace quota), existing volume has its space reserved already
+func (s *ControllerServer) checkReservationSpace(
+	nsProvider ns.ProviderInterface,
+	volumePath string,
+	reservationBytes int64,
+) error {
+	if reservationBytes == 0 {
+		return nil
+	}
+	datasetPath := filepath.Dir(volumePath)
+
+	if _, err := nsProvider.GetFilesystem(volumePath); err == nil {
+		return nil
+	}
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	if _, err := nefClient.GetVolume(volumePath); err == nil {
+		return nil
+	}
 
+	availableBytes, err := nsProvider.GetFilesystemAvailableCapacity(datasetPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get free space of '%s': %s", datasetPath, err)
+	} else if availableBytes < reservationBytes {
 		return status.Errorf(
-			codes.Internal,
-			"Cannot create volume '%s' using snapshot '%s': %s",
+			codes.ResourceExhausted,
+			"Cannot reserve %d bytes for volume '%s', only %d bytes are available in '%s'",
+			reservationBytes,
 			volumePath,
-			snapshot.Path,
-			err,
+			availableBytes,
+			datasetPath,
 		)
 	}
+	return nil
+}
 
-	//TODO resize volume after cloning from snapshot if needed
-
-	l.Infof("volume '%s' has been created using snapshot '%s'", volumePath, snapshot.Path)
+// validateCloneSize - volume created from snapshot must fit snapshot data, zero capacity means no quota
+func (s *ControllerServer) validateCloneSize(
+	nsProvider ns.ProviderInterface,
+	snapshotPath string,
+	capacityBytes int64,
+) error {
+	if capacityBytes == 0 {
+		return nil
+	}
+	properties, err := s.getSnapshotProperties(nsProvider, snapshotPath)
+	if err != nil {
+		return err
+	}
+	if capacityBytes < properties.BytesReferenced {
+		return status.Errorf(
+			codes.OutOfRange,
+			"Requested volume size %d is less than size %d of snapshot '%s' data",
+			capacityBytes,
+			properties.BytesReferenced,
+			snapshotPath,
+		)
+	}
 	return nil
 }
 
-func (s *ControllerServer) createClonedVolume(
+// setClonedVolumeProperties - clone doesn't inherit source quota and may not get it on creation,
+// so requested size is set explicitly, it's not less than snapshot data size.
+// ZFS properties from StorageClass are set the same way, they apply to data written to the clone.
+func (s *ControllerServer) setClonedVolumeProperties(
 	nsProvider ns.ProviderInterface,
-	sourceVolumeID string,
 	volumePath string,
-	volumeName string,
 	capacityBytes int64,
+	properties zfs.Properties,
 ) error {
+	if capacityBytes == 0 && len(properties) == 0 {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	for field, value := range properties {
+		fields[field] = value
+	}
+	if capacityBytes != 0 {
+		fields["referencedQuotaSize"] = capacityBytes
+	}
 
-	l := s.log.WithField("func", "createClonedVolume()")
-	l.Infof("clone volume source: %+v, target: %+v", sourceVolumeID, volumePath)
-
-	snapName := fmt.Sprintf("k8s-clone-snapshot-%s", volumeName)
-	snapshotPath := fmt.Sprintf("%s@%s", sourceVolumeID, snapName)
-
-	_, err := s.CreateSnapshotOnNS(nsProvider, sourceVolumeID, snapName)
+	nefClient, err := nef.New(nsProvider)
 	if err != nil {
-		return err
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	err = nefClient.SetFilesystemProperties(volumePath, fields)
+	if err != nil {
+		code := codes.Internal
+		if nef.IsNoSpaceNefError(err) {
+			code = codes.ResourceExhausted
+		}
+		return status.Errorf(code, "Cannot set properties %v of volume '%s': %s", fields, volumePath, err)
 	}
+	return nil
+}
 
-	err = nsProvider.CloneSnapshot(snapshotPath, ns.CloneSnapshotParams{
-		TargetPath:          volumePath,
-		ReferencedQuotaSize: capacityBytes,
-	})
+// createNewZvol - create sparse zvol for iSCSI volume
+func (s *ControllerServer) createNewZvol(
+	nsProvider ns.ProviderInterface,
+	volumePath string,
+	capacityBytes int64,
+	sparse bool,
+) error {
+	l := s.log.WithField("func", "createNewZvol()")
+	l.Infof("nsProvider: %s, volumePath: %s, size: %d, sparse: %t", nsProvider, volumePath, capacityBytes, sparse)
 
+	err := nsProvider.CreateVolume(ns.CreateVolumeParams{
+		Path:         volumePath,
+		VolumeSize:   capacityBytes,
+		SparseVolume: sparse,
+	})
 	if err != nil {
 		if ns.IsAlreadyExistNefError(err) {
-			//TODO validate snapshot's "bytesReferenced" is less than required volume size
-
-			// existingFilesystem, err := nsProvider.GetFilesystem(volumePath)
-			// if err != nil {
-			//  return status.Errorf(
-			//      codes.Internal,
-			//      "Volume '%s' already exists, but volume properties request failed: %s",
-			//      volumePath,
-			//      err,
-			//  )
-			// } else if existingFilesystem.GetReferencedQuotaSize() != capacityBytes {
-			//  return status.Errorf(
-			//      codes.AlreadyExists,
-			//      "Volume '%s' already exists, but with a different size: requested=%d, existing=%d",
-			//      volumePath,
-			//      capacityBytes,
-			//      existingFilesystem.GetReferencedQuotaSize(),
-			//  )
-			// }
+			nefClient, err := nef.New(nsProvider)
+			if err != nil {
+				return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+			}
+			existingVolume, err := nefClient.GetVolume(volumePath)
+			if err != nil {
+				return status.Errorf(
+					codes.Internal,
+					"Volume '%s' already exists, but volume properties request failed: %s",
+					volumePath,
+					err,
+				)
+			} else if existingVolume.VolumeSize != capacityBytes {
+				return status.Errorf(
+					codes.AlreadyExists,
+					"Volume '%s' already exists, but with a different size: requested=%d, existing=%d",
+					volumePath,
+					capacityBytes,
+					existingVolume.VolumeSize,
+				)
+			}
 
 			l.Infof("volume '%s' already exists and can be used", volumePath)
 			return nil
 		}
 
-		return status.Errorf(
-			codes.NotFound,
-			"Cannot create volume '%s' using snapshot '%s': %s",
-			volumePath,
-			snapshotPath,
-			err,
-		)
+		return status.Errorf(codes.Internal, "Cannot create volume '%s': %s", volumePath, err)
 	}
 
-	l.Infof("successfully created cloned volume %+v", volumePath)
+	l.Infof("volume '%s' has been created", volumePath)
 	return nil
 }
 
-// DeleteVolume - destroys FS on NexentaStor
-func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
-	*csi.DeleteVolumeResponse,
-	error,
-) {
-	l := s.log.WithField("func", "DeleteVolume()")
-	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+// exportISCSIZvol - create iSCSI target and target group for zvol, adds connection parameters to volume context
+// for the node, LUN is mapped to the node host group in ControllerPublishVolume()
+func (s *ControllerServer) exportISCSIZvol(
+	nsProvider ns.ProviderInterface,
+	cfg config.NsData,
+	volumePath string,
+	dataIP string,
+	volumeContext map[string]string,
+) error {
+	l := s.log.WithField("func", "exportISCSIZvol()")
 
-	var secret string
-	secrets := req.GetSecrets()
-	for _, v := range secrets {
-		secret = v
+	portal := cfg.ISCSIPortal
+	if portal == "" {
+		portal = dataIP
 	}
-	err := s.refreshConfig(secret)
-	if err != nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	if portal == "" {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"iSCSI portal must be set by 'iscsiPortal' or 'defaultDataIp' config options or 'dataIp' parameter",
+		)
 	}
-
-	volumeId := req.GetVolumeId()
-	if len(volumeId) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+	portal = connection.NormalizePortal(portal, iscsi.DefaultPort)
+	host, portString, err := net.SplitHostPort(portal)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid iSCSI portal '%s': %s", portal, err)
 	}
-
-	volInfo, err := ParseVolumeID(volumeId)
+	port, err := strconv.Atoi(portString)
 	if err != nil {
-		l.Infof("Got wrong volumeId, but that is OK for deletion")
-		l.Infof("VolumeInfo error: %s", err)
-		return &csi.DeleteVolumeResponse{}, nil
+		return status.Errorf(codes.InvalidArgument, "Invalid iSCSI portal port '%s': %s", portal, err)
 	}
 
-	params := ResolveNSParams{
-		datasetPath:     volInfo.Path,
-		configName:      volInfo.ConfigName,
-		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
-	}
+	volumeName := filepath.Base(volumePath)
+	targetName := getISCSITargetName(cfg, volumeName)
+	targetGroupName := getISCSITargetGroupName(volumeName)
 
-	resolveResp, err := s.resolveNS(params)
+	err = nsProvider.CreateISCSITarget(ns.CreateISCSITargetParams{
+		Name:    targetName,
+		Portals: []ns.Portal{{Address: host, Port: port}},
+	})
 	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			l.Infof("volume '%s' not found, that's OK for deletion request", volInfo.Path)
-			return &csi.DeleteVolumeResponse{}, nil
-		}
-		return nil, err
+		return status.Errorf(codes.Internal, "Cannot create iSCSI target '%s': %s", targetName, err)
 	}
-	nsProvider := resolveResp.nsProvider
 
-	// if here, than volumePath exists on some NS
-	err = nsProvider.DestroyFilesystem(volInfo.Path, ns.DestroyFilesystemParams{
-		DestroySnapshots:               true,
-		PromoteMostRecentCloneIfExists: true,
+	err = nsProvider.CreateUpdateTargetGroup(ns.CreateTargetGroupParams{
+		Name:    targetGroupName,
+		Members: []string{targetName},
 	})
-	if err != nil && !ns.IsNotExistNefError(err) {
-		return nil, status.Errorf(
-			codes.Internal,
-			"Cannot delete '%s' volume: %s",
-			volInfo.Path,
-			err,
-		)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create target group '%s': %s", targetGroupName, err)
 	}
 
-	l.Infof("volume '%s' has been deleted", volInfo.Path)
-	return &csi.DeleteVolumeResponse{}, nil
-}
-
-func (s *ControllerServer) CreateSnapshotOnNS(nsProvider ns.ProviderInterface, volumePath, snapName string) (
-	snapshot ns.Snapshot, err error) {
+	volumeContext["protocol"] = ProtocolISCSI
+	volumeContext["targetPortal"] = portal
+	volumeContext["iqn"] = targetName
 
-	l := s.log.WithField("func", "CreateSnapshotOnNS()")
-	l.Infof("creating snapshot %+v@%+v", volumePath, snapName)
-	//TODO req.GetParameters() - read recursive param?
+	l.Infof("volume '%s' is exported over '%s' on %s", volumePath, targetName, portal)
+	return nil
+}
 
-	//K8s doesn't allow to have same named snapshots for different volumes
-	sourcePath := filepath.Dir(volumePath)
+// exportNVMeZvol - create NVMe/TCP subsystem and add zvol to it as a namespace,
+// hosts are allowed to connect to the subsystem in ControllerPublishVolume()
+func (s *ControllerServer) exportNVMeZvol(
+	nsProvider ns.ProviderInterface,
+	cfg config.NsData,
+	volumePath string,
+	dataIP string,
+	volumeContext map[string]string,
+) error {
+	l := s.log.WithField("func", "exportNVMeZvol()")
 
-	existingSnapshots, err := nsProvider.GetSnapshots(sourcePath, true)
+	portal := cfg.NVMePortal
+	if portal == "" {
+		portal = dataIP
+	}
+	if portal == "" {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"NVMe/TCP portal must be set by 'nvmePortal' or 'defaultDataIp' config options or 'dataIp' parameter",
+		)
+	}
+	portal = connection.NormalizePortal(portal, nvme.DefaultPort)
+	host, portString, err := net.SplitHostPort(portal)
 	if err != nil {
-		return snapshot, status.Errorf(codes.NotFound, "Cannot get snapshots list: %s", err)
+		return status.Errorf(codes.InvalidArgument, "Invalid NVMe/TCP portal '%s': %s", portal, err)
 	}
-	for _, s := range existingSnapshots {
-		if s.Name == snapName && s.Parent != volumePath {
-			return snapshot, status.Errorf(
-				codes.AlreadyExists,
-				"Snapshot '%s' already exists for filesystem: %s",
-				snapName,
-				s.Path,
-			)
-		}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid NVMe/TCP portal port '%s': %s", portal, err)
 	}
 
-	snapshotPath := fmt.Sprintf("%s@%s", volumePath, snapName)
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
 
-	// if here, than volumePath exists on some NS
-	err = nsProvider.CreateSnapshot(ns.CreateSnapshotParams{
-		Path: snapshotPath,
+	subsystemName := getNVMeSubsystemName(cfg, filepath.Base(volumePath))
+	err = nefClient.CreateNvmeofSubsystem(nef.CreateNvmeofSubsystemParams{
+		Nqn: subsystemName,
+		Listeners: []nef.NvmeofListener{{
+			Transport: nef.NvmeofTransportTCP,
+			Address:   host,
+			Port:      port,
+		}},
+		AllowAnyHost: false,
 	})
-	if err != nil && !ns.IsAlreadyExistNefError(err) {
-		return snapshot, status.Errorf(codes.Internal, "Cannot create snapshot '%s': %s", snapshotPath, err)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NVMe subsystem '%s': %s", subsystemName, err)
 	}
 
-	snapshot, err = nsProvider.GetSnapshot(snapshotPath)
+	err = nefClient.CreateNvmeofNamespace(subsystemName, volumePath)
 	if err != nil {
-		return snapshot, status.Errorf(
-			codes.Internal,
-			"Snapshot '%s' has been created, but snapshot properties request failed: %s",
-			snapshotPath,
-			err,
-		)
+		return status.Errorf(codes.Internal, "Cannot add '%s' to NVMe subsystem '%s': %s", volumePath, subsystemName, err)
 	}
-	l.Infof("successfully created snapshot %+v@%+v", volumePath, snapName)
-	return snapshot, nil
+
+	namespace, err := nefClient.GetNvmeofNamespace(subsystemName, volumePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get NVMe namespace of '%s': %s", volumePath, err)
+	}
+
+	volumeContext["protocol"] = ProtocolNVMeTCP
+	volumeContext["targetPortal"] = portal
+	volumeContext["nqn"] = subsystemName
+	volumeContext["nguid"] = namespace.Nguid
+
+	l.Infof("volume '%s' is exported as namespace %s of '%s' on %s", volumePath, namespace.Nguid, subsystemName, portal)
+	return nil
+}
+
+// deleteZvol - delete zvol with its iSCSI LUN mappings, target group and target or its NVMe subsystem
+func (s *ControllerServer) deleteZvol(nsProvider ns.ProviderInterface, cfg config.NsData, volumePath string) error {
+	l := s.log.WithField("func", "deleteZvol()")
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	volumeName := filepath.Base(volumePath)
+
+	protocol, err := s.getZvolProtocol(nsProvider, cfg, volumePath)
+	if err != nil {
+		return err
+	}
+
+	switch protocol {
+	case ProtocolISCSI:
+		lunMappings, err := nsProvider.GetLunMappings(ns.GetLunMappingsParams{
+			Volume: volumePath,
+		})
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot get LUN mappings of '%s': %s", volumePath, err)
+		}
+		for _, lunMapping := range lunMappings {
+			err = nsProvider.DestroyLunMapping(lunMapping.Id)
+			if err != nil && !ns.IsNotExistNefError(err) {
+				return status.Errorf(codes.Internal, "Cannot delete LUN mapping '%s': %s", lunMapping.Id, err)
+			}
+		}
+
+		targetGroupName := getISCSITargetGroupName(volumeName)
+		err = nefClient.DeleteTargetGroup(targetGroupName)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot delete target group '%s': %s", targetGroupName, err)
+		}
+		targetName := getISCSITargetName(cfg, volumeName)
+		err = nefClient.DeleteISCSITarget(targetName)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot delete iSCSI target '%s': %s", targetName, err)
+		}
+	case ProtocolNVMeTCP:
+		subsystemName := getNVMeSubsystemName(cfg, volumeName)
+		err = nefClient.DeleteNvmeofSubsystem(subsystemName)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot delete NVMe subsystem '%s': %s", subsystemName, err)
+		}
+	}
+
+	err = nsProvider.DestroyVolume(volumePath, ns.DestroyVolumeParams{
+		DestroySnapshots:               true,
+		PromoteMostRecentCloneIfExists: true,
+	})
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot delete '%s' volume: %s", volumePath, err)
+	}
+
+	l.Infof("volume '%s' has been deleted", volumePath)
+	return nil
+}
+
+// getZvolProtocol - protocol zvol is exported over, empty string if zvol is not exported
+func (s *ControllerServer) getZvolProtocol(
+	nsProvider ns.ProviderInterface,
+	cfg config.NsData,
+	volumePath string,
+) (string, error) {
+	// iSCSI zvol has its own target group, LUN mappings exist only while it's published
+	_, err := nsProvider.GetTargetGroup(getISCSITargetGroupName(filepath.Base(volumePath)))
+	if err == nil {
+		return ProtocolISCSI, nil
+	} else if !ns.IsNotExistNefError(err) {
+		return "", status.Errorf(codes.Internal, "Cannot get iSCSI target group of '%s': %s", volumePath, err)
+	}
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	subsystemName := getNVMeSubsystemName(cfg, filepath.Base(volumePath))
+	_, err = nefClient.GetNvmeofNamespace(subsystemName, volumePath)
+	if err != nil {
+		if ns.IsNotExistNefError(err) {
+			return "", nil
+		}
+		return "", status.Errorf(codes.Internal, "Cannot get NVMe namespace of '%s': %s", volumePath, err)
+	}
+	return ProtocolNVMeTCP, nil
+}
+
+// resolveZvol - resolve NS of existing zvol by its parent filesystem, ns.Resolver looks for filesystems only
+func (s *ControllerServer) resolveZvol(volInfo VolumeInfo) (
+	resolveResp ResolveNSResponse,
+	volume ns.Volume,
+	err error,
+) {
+	resolveResp, err = s.resolveNS(ResolveNSParams{
+		datasetPath:     filepath.Dir(volInfo.Path),
+		configName:      volInfo.ConfigName,
+		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	})
+	if err != nil {
+		return resolveResp, volume, err
+	}
+
+	nefClient, err := nef.New(resolveResp.nsProvider)
+	if err != nil {
+		return resolveResp, volume, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	volume, err = nefClient.GetVolume(volInfo.Path)
+	if err != nil {
+		code := codes.Internal
+		if ns.IsNotExistNefError(err) {
+			code = codes.NotFound
+		}
+		return resolveResp, volume, status.Errorf(code, "Cannot get volume '%s': %s", volInfo.Path, err)
+	}
+
+	return resolveResp, volume, nil
+}
+
+// getZvolSize - zvol size must be a multiple of its block size, round it up to 1MiB
+func getZvolSize(capacityBytes int64) int64 {
+	if capacityBytes <= 0 {
+		return defaultZvolSize
+	}
+	return (capacityBytes + zvolSizeAlignment - 1) / zvolSizeAlignment * zvolSizeAlignment
+}
+
+func getISCSITargetName(cfg config.NsData, volumeName string) string {
+	return fmt.Sprintf("%s.%s", cfg.ISCSITargetPrefix, strings.ToLower(volumeName))
+}
+
+func getISCSITargetGroupName(volumeName string) string {
+	return fmt.Sprintf("csi-%s", volumeName)
+}
+
+// getISCSIHostGroupName - host group of the node initiator, LUNs of volumes published to the node are mapped to it
+func getISCSIHostGroupName(nodeID string) string {
+	return fmt.Sprintf("csi-node-%s", strings.ToLower(nodeID))
+}
+
+func getNVMeSubsystemName(cfg config.NsData, volumeName string) string {
+	return fmt.Sprintf("%s:%s", cfg.NVMeSubsystemPrefix, strings.ToLower(volumeName))
+}
+
+// isZvolProtocol - volumes of these protocols are zvols exported as block devices
+func isZvolProtocol(protocol string) bool {
+	return protocol == ProtocolISCSI || protocol == ProtocolNVMeTCP
+}
+
+// validateVolumeProtocol - block volumes require iSCSI or NVMe/TCP protocol,
+// filesystems on block volumes can't be written from several nodes
+func validateVolumeProtocol(
+	protocol string,
+	volumeCapabilities []*csi.VolumeCapability,
+	contentSource *csi.VolumeContentSource,
+) error {
+	switch protocol {
+	case "":
+		for _, c := range volumeCapabilities {
+			if c.GetBlock() != nil {
+				return status.Errorf(
+					codes.InvalidArgument,
+					"Block volumes require 'protocol' parameter: [%s, %s]",
+					ProtocolISCSI,
+					ProtocolNVMeTCP,
+				)
+			}
+		}
+	case ProtocolISCSI, ProtocolNVMeTCP:
+		if contentSource != nil {
+			return status.Errorf(codes.InvalidArgument, "Volume content source is not supported for %s volumes", protocol)
+		}
+		for _, c := range volumeCapabilities {
+			mode := c.GetAccessMode().GetMode()
+			if c.GetMount() != nil && (mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER ||
+				mode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER) {
+				return status.Errorf(
+					codes.InvalidArgument,
+					"Access mode %s is not supported for %s filesystem volumes, use block volume mode",
+					mode,
+					protocol,
+				)
+			}
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "Unsupported volume protocol: '%s'", protocol)
+	}
+	return nil
+}
+
+// create new volume using existing snapshot
+func (s *ControllerServer) createNewVolumeFromSnapshot(
+	nsProvider ns.ProviderInterface,
+	sourceSnapshotID string,
+	volumePath string,
+	capacityBytes int64,
+	properties zfs.Properties,
+) error {
+	l := s.log.WithField("func", "createNewVolumeFromSnapshot()")
+	l.Infof("snapshot: %s", sourceSnapshotID)
+
+	snapshot, err := nsProvider.GetSnapshot(sourceSnapshotID)
+	if err != nil {
+		message := fmt.Sprintf("Failed to find snapshot '%s': %s", sourceSnapshotID, err)
+		if ns.IsNotExistNefError(err) || ns.IsBadArgNefError(err) {
+			return status.Error(codes.NotFound, message)
+		}
+		return status.Error(codes.NotFound, message)
+	}
+
+	if err := s.validateCloneSize(nsProvider, snapshot.Path, capacityBytes); err != nil {
+		return err
+	}
+
+	err = nsProvider.CloneSnapshot(snapshot.Path, ns.CloneSnapshotParams{
+		TargetPath:          volumePath,
+		ReferencedQuotaSize: capacityBytes,
+	})
+	if err != nil {
+		if ns.IsAlreadyExistNefError(err) {
+			if err := s.checkExistingVolumeSize(nsProvider, volumePath, capacityBytes); err != nil {
+				return err
+			}
+			l.Infof("volume '%s' already exists and can be used", volumePath)
+			return nil
+		}
+
+		return status.Errorf(
+			codes.Internal,
+			"Cannot create volume '%s' using snapshot '%s': %s",
+			volumePath,
+			snapshot.Path,
+			err,
+		)
+	}
+
+	if err := s.setClonedVolumeProperties(nsProvider, volumePath, capacityBytes, properties); err != nil {
+		return err
+	}
+
+	l.Infof("volume '%s' has been created using snapshot '%s'", volumePath, snapshot.Path)
+	return nil
+}
+
+func (s *ControllerServer) createClonedVolume(
+	nsProvider ns.ProviderInterface,
+	sourceVolumeID string,
+	volumePath string,
+	volumeName string,
+	capacityBytes int64,
+	cloneMode string,
+	properties zfs.Properties,
+) error {
+
+	l := s.log.WithField("func", "createClonedVolume()")
+	l.Infof("clone volume source: %+v, target: %+v, mode: %s", sourceVolumeID, volumePath, cloneMode)
+
+	if cloneMode == CloneModeFull {
+		return s.createCopiedVolume(nsProvider, sourceVolumeID, volumePath, volumeName, capacityBytes, properties)
+	}
+
+	snapName := cloneSnapshotPrefix + volumeName
+	snapshotPath := fmt.Sprintf("%s@%s", sourceVolumeID, snapName)
+
+	exists, err := s.filesystemExists(nsProvider, volumePath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := s.checkExistingVolumeSize(nsProvider, volumePath, capacityBytes); err != nil {
+			return err
+		}
+		l.Infof("volume '%s' already exists and can be used", volumePath)
+	} else {
+		_, err = s.CreateSnapshotOnNS(nsProvider, sourceVolumeID, snapName)
+		if err != nil {
+			return err
+		}
+
+		if err := s.validateCloneSize(nsProvider, snapshotPath, capacityBytes); err != nil {
+			s.destroyCloneSnapshot(nsProvider, snapshotPath)
+			return err
+		}
+
+		err = nsProvider.CloneSnapshot(snapshotPath, ns.CloneSnapshotParams{
+			TargetPath:          volumePath,
+			ReferencedQuotaSize: capacityBytes,
+		})
+		if err != nil && !ns.IsAlreadyExistNefError(err) {
+			code := codes.Internal
+			if ns.IsNotExistNefError(err) {
+				code = codes.NotFound
+			}
+			return status.Errorf(
+				code,
+				"Cannot create volume '%s' using snapshot '%s': %s",
+				volumePath,
+				snapshotPath,
+				err,
+			)
+		}
+
+		if err := s.setClonedVolumeProperties(nsProvider, volumePath, capacityBytes, properties); err != nil {
+			return err
+		}
+	}
+
+	// promoted clone takes over the intermediate snapshot, so the source depends on the clone,
+	// the snapshot is on the source until the clone is promoted
+	if cloneMode == CloneModePromote {
+		snapshot, err := nsProvider.GetSnapshot(snapshotPath)
+		if err == nil && snapshot.Parent == sourceVolumeID {
+			if err := nsProvider.PromoteFilesystem(volumePath); err != nil {
+				return status.Errorf(codes.Internal, "Cannot promote cloned volume '%s': %s", volumePath, err)
+			}
+		} else if err != nil && !ns.IsNotExistNefError(err) {
+			return status.Errorf(codes.Internal, "Cannot get snapshot '%s': %s", snapshotPath, err)
+		}
+	}
+
+	l.Infof("successfully created cloned volume %+v", volumePath)
+	return nil
+}
+
+// createCopiedVolume - copy intermediate snapshot of the source to a new independent filesystem
+// by one-time replication service. Request doesn't wait for copying, Aborted is returned while it's
+// in progress and the CO retry checks the same service again.
+func (s *ControllerServer) createCopiedVolume(
+	nsProvider ns.ProviderInterface,
+	sourceVolumeID string,
+	volumePath string,
+	volumeName string,
+	capacityBytes int64,
+	properties zfs.Properties,
+) error {
+	l := s.log.WithField("func", "createCopiedVolume()")
+
+	snapName := cloneSnapshotPrefix + volumeName
+	snapshotPath := fmt.Sprintf("%s@%s", sourceVolumeID, snapName)
+	serviceName := snapName
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+
+	_, err = nefClient.GetReplicationService(serviceName)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot get replication service '%s': %s", serviceName, err)
+	} else if err != nil {
+		exists, err := s.filesystemExists(nsProvider, volumePath)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := s.checkExistingVolumeSize(nsProvider, volumePath, capacityBytes); err != nil {
+				return err
+			}
+			l.Infof("volume '%s' already exists and can be used", volumePath)
+			return nil
+		}
+
+		_, err = s.CreateSnapshotOnNS(nsProvider, sourceVolumeID, snapName)
+		if err != nil {
+			return err
+		}
+		if err := s.validateCloneSize(nsProvider, snapshotPath, capacityBytes); err != nil {
+			s.destroyCloneSnapshot(nsProvider, snapshotPath)
+			return err
+		}
+
+		err = nefClient.CreateReplicationService(nef.CreateReplicationServiceParams{
+			Name:               serviceName,
+			SourceSnapshot:     snapshotPath,
+			DestinationDataset: volumePath,
+		})
+		if err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Cannot create replication service to copy '%s' to '%s': %s",
+				snapshotPath,
+				volumePath,
+				err,
+			)
+		}
+		l.Infof("copying '%s' to '%s'", snapshotPath, volumePath)
+	}
+
+	service, err := nefClient.GetReplicationService(serviceName)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get replication service '%s': %s", serviceName, err)
+	}
+	if service.State == nef.ReplicationServiceStateFaulted {
+		if err := nefClient.DeleteReplicationService(serviceName); err != nil {
+			l.Warnf("cannot delete replication service '%s': %s", serviceName, err)
+		}
+		return status.Errorf(
+			codes.Internal,
+			"Cannot copy '%s' to '%s': %s",
+			snapshotPath,
+			volumePath,
+			service.LastError,
+		)
+	} else if service.State != nef.ReplicationServiceStateCompleted {
+		return status.Errorf(
+			codes.Aborted,
+			"Copying '%s' to '%s' is in progress, state: %s",
+			snapshotPath,
+			volumePath,
+			service.State,
+		)
+	}
+
+	if err := nefClient.DeleteReplicationService(serviceName); err != nil {
+		return status.Errorf(codes.Internal, "Cannot delete replication service '%s': %s", serviceName, err)
+	}
+
+	// received copy of the intermediate snapshot is not needed as well
+	s.destroyCloneSnapshot(nsProvider, fmt.Sprintf("%s@%s", volumePath, snapName))
+	s.destroyCloneSnapshot(nsProvider, snapshotPath)
+
+	if err := s.setClonedVolumeProperties(nsProvider, volumePath, capacityBytes, properties); err != nil {
+		return err
+	}
+
+	l.Infof("volume '%s' has been copied from '%s'", volumePath, snapshotPath)
+	return nil
+}
+
+func (s *ControllerServer) filesystemExists(nsProvider ns.ProviderInterface, path string) (bool, error) {
+	_, err := nsProvider.GetFilesystem(path)
+	if err == nil {
+		return true, nil
+	} else if ns.IsNotExistNefError(err) {
+		return false, nil
+	}
+	return false, status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", path, err)
+}
+
+// destroyCloneSnapshot - intermediate snapshot cleanup is best effort, a leftover is removed with the volume
+func (s *ControllerServer) destroyCloneSnapshot(nsProvider ns.ProviderInterface, snapshotPath string) {
+	err := nsProvider.DestroySnapshot(snapshotPath)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		s.log.WithField("func", "destroyCloneSnapshot()").Warnf("cannot delete snapshot '%s': %s", snapshotPath, err)
+	}
+}
+
+// getVolumeOrigin - CSI name of the volume and the parent dataset it was created in, volumes without
+// these user properties are named by CSI name directly in the parent dataset
+func getVolumeOrigin(volumePath string, userProperties map[string]string) (csiName string, datasetPath string) {
+	csiName = filepath.Base(volumePath)
+	datasetPath = filepath.Dir(volumePath)
+	if v := userProperties[userPropertyVolumeName]; v != "" {
+		csiName = v
+	}
+	if v := userProperties[userPropertyDataset]; v != "" {
+		datasetPath = v
+	}
+	return csiName, datasetPath
+}
+
+// getCloneSnapshotNames - names of intermediate snapshots the volume is related to: the one it's cloned from
+// (it's on the source, or on the volume if it's promoted) and the ones its promoted clones were cloned from
+func (s *ControllerServer) getCloneSnapshotNames(
+	nsProvider ns.ProviderInterface,
+	datasetPath string,
+	volumePath string,
+	csiName string,
+) ([]string, error) {
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, err
+	}
+	snapshotsProperties, err := nefClient.GetSnapshotsProperties(datasetPath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{cloneSnapshotPrefix + csiName}
+	for path, properties := range snapshotsProperties {
+		name := path[strings.LastIndex(path, "@")+1:]
+		if !strings.HasPrefix(name, cloneSnapshotPrefix) {
+			continue
+		}
+		for _, clone := range properties.Clones {
+			if clone == volumePath {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// destroyUnusedCloneSnapshots - destroy intermediate snapshots with given names, which have no clones anymore
+func (s *ControllerServer) destroyUnusedCloneSnapshots(
+	nsProvider ns.ProviderInterface,
+	datasetPath string,
+	names []string,
+) {
+	l := s.log.WithField("func", "destroyUnusedCloneSnapshots()")
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		l.Warnf("cannot create NEF client: %s", err)
+		return
+	}
+	snapshotsProperties, err := nefClient.GetSnapshotsProperties(datasetPath, true)
+	if err != nil {
+		l.Warnf("cannot get snapshots of '%s': %s", datasetPath, err)
+		return
+	}
+
+	for path, properties := range snapshotsProperties {
+		name := path[strings.LastIndex(path, "@")+1:]
+		for _, n := range names {
+			if name == n && len(properties.Clones) == 0 {
+				l.Infof("intermediate snapshot '%s' has no clones, deleting it", path)
+				s.destroyCloneSnapshot(nsProvider, path)
+			}
+		}
+	}
+}
+
+// parentLocks - locks of top parent filesystems created by the driver (namespace datasets and the first
+// intermediate filesystems of templated names) by their paths: volumes are created under read lock,
+// so they don't wait for each other, empty parents are destroyed under write lock
+type parentLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.RWMutex
+}
+
+func (p *parentLocks) get(path string) *sync.RWMutex {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.locks == nil {
+		p.locks = map[string]*sync.RWMutex{}
+	}
+	lock, ok := p.locks[path]
+	if !ok {
+		lock = &sync.RWMutex{}
+		p.locks[path] = lock
+	}
+	return lock
+}
+
+// getTopParentPath - path of the top parent filesystem of the parent path in the dataset,
+// empty if the parent path is the dataset itself
+func getTopParentPath(datasetPath, parentPath string) string {
+	if !strings.HasPrefix(parentPath, datasetPath+"/") {
+		return ""
+	}
+	return filepath.Join(datasetPath, strings.Split(strings.TrimPrefix(parentPath, datasetPath+"/"), "/")[0])
+}
+
+// destroyEmptyParents - destroy parent filesystems created by the driver up to the parent dataset,
+// which have no volumes anymore. Filesystem with children or snapshots isn't destroyed by NexentaStor,
+// and volumes are not created in the parents meanwhile, so a volume created concurrently is not lost.
+func (s *ControllerServer) destroyEmptyParents(nsProvider ns.ProviderInterface, datasetPath, parentPath string) {
+	l := s.log.WithField("func", "destroyEmptyParents()")
+
+	topParentPath := getTopParentPath(datasetPath, parentPath)
+	if topParentPath == "" {
+		return
+	}
+	lock := s.parentLocks.get(topParentPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		l.Warnf("cannot create NEF client: %s", err)
+		return
+	}
+
+	for ; strings.HasPrefix(parentPath, datasetPath+"/"); parentPath = filepath.Dir(parentPath) {
+		userProperties, err := nefClient.GetFilesystemUserProperties(parentPath)
+		if err != nil {
+			l.Warnf("cannot get user properties of '%s': %s", parentPath, err)
+			return
+		} else if userProperties[userPropertyRole] != roleParent {
+			return
+		}
+
+		children, err := nsProvider.GetFilesystems(parentPath)
+		if err != nil {
+			l.Warnf("cannot get filesystems of '%s': %s", parentPath, err)
+			return
+		} else if len(children) != 0 {
+			return
+		}
+
+		err = nsProvider.DestroyFilesystem(parentPath, ns.DestroyFilesystemParams{})
+		if err != nil && !ns.IsNotExistNefError(err) {
+			l.Warnf("cannot destroy empty parent filesystem '%s': %s", parentPath, err)
+			return
+		}
+		l.Infof("empty parent filesystem '%s' has been destroyed", parentPath)
+	}
+}
+
+// DeleteVolume - destroys FS on NexentaStor
+func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
+	*csi.DeleteVolumeResponse,
+	error,
+) {
+	l := s.log.WithField("func", "DeleteVolume()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	var secret string
+	secrets := req.GetSecrets()
+	for _, v := range secrets {
+		secret = v
+	}
+	err := s.refreshConfig(secret)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	volumeId := req.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+	}
+
+	volInfo, err := ParseVolumeID(volumeId)
+	if err != nil {
+		l.Infof("Got wrong volumeId, but that is OK for deletion")
+		l.Infof("VolumeInfo error: %s", err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	params := ResolveNSParams{
+		datasetPath:     volInfo.Path,
+		configName:      volInfo.ConfigName,
+		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	}
+
+	resolveResp, err := s.resolveNS(params)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			// volume may be a zvol of iSCSI volume
+			zvolResp, _, zvolErr := s.resolveZvol(volInfo)
+			if zvolErr == nil {
+				err = s.deleteZvol(zvolResp.nsProvider, s.config.NsMap[zvolResp.configName], volInfo.Path)
+				if err != nil {
+					return nil, err
+				}
+				return &csi.DeleteVolumeResponse{}, nil
+			} else if status.Code(zvolErr) != codes.NotFound {
+				return nil, zvolErr
+			}
+			l.Infof("volume '%s' not found, that's OK for deletion request", volInfo.Path)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, err
+	}
+	nsProvider := resolveResp.nsProvider
+	cfg := s.config.NsMap[resolveResp.configName]
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	// delete policy is not known if user properties can't be read, so the volume is kept until the next retry
+	userProperties, err := nefClient.GetFilesystemUserProperties(volInfo.Path)
+	if err != nil {
+		if ns.IsNotExistNefError(err) {
+			l.Infof("volume '%s' not found, that's OK for deletion request", volInfo.Path)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "Cannot get user properties of '%s': %s", volInfo.Path, err)
+	}
+	csiName, datasetPath := getVolumeOrigin(volInfo.Path, userProperties)
+
+	switch userProperties[userPropertyDeletePolicy] {
+	case DeletePolicyRetain:
+		if err := s.unshareVolume(nsProvider, volInfo.Path); err != nil {
+			return nil, err
+		}
+		err = nefClient.SetFilesystemUserProperties(volInfo.Path, map[string]string{
+			userPropertyRole: roleRetained,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot mark volume '%s' as retained: %s", volInfo.Path, err)
+		}
+		l.Infof("volume '%s' has been unshared and retained", volInfo.Path)
+		return &csi.DeleteVolumeResponse{}, nil
+	case DeletePolicyTrash:
+		if err := s.moveVolumeToTrash(nsProvider, cfg, volInfo.Path); err != nil {
+			return nil, err
+		}
+	default:
+		if err := s.destroyVolume(nsProvider, volInfo.Path, csiName, datasetPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RemoveEmptyNamespaceDatasets {
+		s.destroyEmptyParents(nsProvider, datasetPath, filepath.Dir(volInfo.Path))
+	}
+
+	l.Infof("volume '%s' has been deleted", volInfo.Path)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// destroyVolume - destroy volume filesystem with its snapshots and intermediate clone snapshots
+// it was the last clone of
+func (s *ControllerServer) destroyVolume(
+	nsProvider ns.ProviderInterface,
+	volumePath string,
+	csiName string,
+	datasetPath string,
+) error {
+	l := s.log.WithField("func", "destroyVolume()")
+
+	// intermediate clone snapshots the volume is related to are collected before the volume is destroyed
+	cloneSnapshotNames, err := s.getCloneSnapshotNames(nsProvider, datasetPath, volumePath, csiName)
+	if err != nil {
+		l.Warnf("cannot get intermediate clone snapshots of '%s': %s", volumePath, err)
+	}
+
+	err = nsProvider.DestroyFilesystem(volumePath, ns.DestroyFilesystemParams{
+		DestroySnapshots:               true,
+		PromoteMostRecentCloneIfExists: true,
+	})
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(
+			codes.Internal,
+			"Cannot delete '%s' volume: %s",
+			volumePath,
+			err,
+		)
+	}
+
+	if len(cloneSnapshotNames) != 0 {
+		s.destroyUnusedCloneSnapshots(nsProvider, datasetPath, cloneSnapshotNames)
+	}
+	return nil
+}
+
+// unshareVolume - delete NFS and SMB shares of volume filesystem
+func (s *ControllerServer) unshareVolume(nsProvider ns.ProviderInterface, volumePath string) error {
+	filesystem, err := nsProvider.GetFilesystem(volumePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", volumePath, err)
+	}
+
+	if filesystem.SharedOverNfs {
+		err = nsProvider.DeleteNfsShare(volumePath)
+		if err != nil && !ns.IsNotExistNefError(err) {
+			return status.Errorf(codes.Internal, "Cannot delete NFS share of '%s': %s", volumePath, err)
+		}
+	}
+	if filesystem.SharedOverSmb {
+		err = nsProvider.DeleteSmbShare(volumePath)
+		if err != nil && !ns.IsNotExistNefError(err) {
+			return status.Errorf(codes.Internal, "Cannot delete SMB share of '%s': %s", volumePath, err)
+		}
+	}
+	return nil
+}
+
+// moveVolumeToTrash - unshare volume filesystem and move it to trash dataset with deletion time,
+// trash dataset must be in the same pool
+func (s *ControllerServer) moveVolumeToTrash(
+	nsProvider ns.ProviderInterface,
+	cfg config.NsData,
+	volumePath string,
+) error {
+	l := s.log.WithField("func", "moveVolumeToTrash()")
+
+	if cfg.TrashDataset == "" {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"Volume '%s' has 'trash' delete policy, but 'trashDataset' is not set in driver config",
+			volumePath,
+		)
+	}
+
+	if err := s.unshareVolume(nsProvider, volumePath); err != nil {
+		return err
+	}
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	err = nefClient.CreateFilesystem(nef.CreateFilesystemParams{
+		Path: cfg.TrashDataset,
+		Properties: map[string]interface{}{
+			"userProperties": map[string]string{userPropertyRole: roleTrash},
+		},
+	})
+	if err != nil && !ns.IsAlreadyExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot create trash dataset '%s': %s", cfg.TrashDataset, err)
+	}
+
+	// deletion time is set before the volume is moved, so trash never has volumes the reaper can't purge
+	deletedAt := time.Now()
+	err = nefClient.SetFilesystemUserProperties(volumePath, map[string]string{
+		userPropertyDeletedAt:   deletedAt.UTC().Format(time.RFC3339),
+		userPropertyTrashedFrom: volumePath,
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot set deletion time of '%s': %s", volumePath, err)
+	}
+
+	trashPath := filepath.Join(cfg.TrashDataset, fmt.Sprintf("%s-%d", filepath.Base(volumePath), deletedAt.Unix()))
+	err = nefClient.RenameFilesystem(volumePath, trashPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot move volume '%s' to trash '%s': %s", volumePath, trashPath, err)
+	}
+
+	l.Infof("volume '%s' has been moved to trash '%s'", volumePath, trashPath)
+	return nil
+}
+
+// runTrashReaper - periodically purge volumes with expired retention period from trash datasets
+func (s *ControllerServer) runTrashReaper() {
+	l := s.log.WithField("func", "runTrashReaper()")
+
+	ticker := time.NewTicker(trashReaperInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		nsMap, err := s.getConfigSnapshot()
+		if err != nil {
+			l.Warnf("cannot use config file: %s", err)
+			continue
+		}
+		for configName, cfg := range nsMap {
+			if cfg.TrashDataset != "" {
+				s.purgeTrash(configName, cfg)
+			}
+		}
+	}
+}
+
+// purgeTrash - destroy volumes which are in trash dataset longer than trash retention period
+func (s *ControllerServer) purgeTrash(configName string, cfg config.NsData) {
+	l := s.log.WithField("func", "purgeTrash()")
+
+	retention, err := cfg.GetTrashRetention()
+	if err != nil {
+		l.Warnf("[%s] invalid trash retention: %s", configName, err)
+		return
+	}
+
+	resolveResp, err := s.resolveNS(ResolveNSParams{
+		datasetPath: cfg.TrashDataset,
+		configName:  configName,
+	})
+	if err != nil {
+		// trash dataset is created when the first volume is moved to it
+		if status.Code(err) != codes.NotFound {
+			l.Warnf("[%s] cannot resolve trash dataset '%s': %s", configName, cfg.TrashDataset, err)
+		}
+		return
+	}
+	nsProvider := resolveResp.nsProvider
+
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		l.Warnf("[%s] cannot create NEF client: %s", configName, err)
+		return
+	}
+	trashUserProperties, err := nefClient.GetFilesystemsUserProperties(cfg.TrashDataset)
+	if err != nil {
+		l.Warnf("[%s] cannot get filesystems of trash dataset '%s': %s", configName, cfg.TrashDataset, err)
+		return
+	}
+
+	for volumePath, userProperties := range trashUserProperties {
+		deletedAt, err := time.Parse(time.RFC3339, userProperties[userPropertyDeletedAt])
+		if err != nil {
+			l.Warnf("[%s] '%s' in trash has no valid deletion time, skipping: %s", configName, volumePath, err)
+			continue
+		} else if time.Since(deletedAt) < retention {
+			continue
+		}
+
+		csiName, datasetPath := getVolumeOrigin(volumePath, userProperties)
+		if err := s.destroyVolume(nsProvider, volumePath, csiName, datasetPath); err != nil {
+			l.Warnf("[%s] cannot purge '%s' from trash: %s", configName, volumePath, err)
+			continue
+		}
+		l.Infof("[%s] volume '%s' deleted at %s has been purged from trash", configName, volumePath, deletedAt)
+	}
+}
+
+func (s *ControllerServer) CreateSnapshotOnNS(nsProvider ns.ProviderInterface, volumePath, snapName string) (
+	snapshot ns.Snapshot, err error) {
+
+	l := s.log.WithField("func", "CreateSnapshotOnNS()")
+	l.Infof("creating snapshot %+v@%+v", volumePath, snapName)
+	//TODO req.GetParameters() - read recursive param?
+
+	//K8s doesn't allow to have same named snapshots for different volumes
+	sourcePath := filepath.Dir(volumePath)
+
+	existingSnapshots, err := nsProvider.GetSnapshots(sourcePath, true)
+	if err != nil {
+		return snapshot, status.Errorf(codes.NotFound, "Cannot get snapshots list: %s", err)
+	}
+	for _, s := range existingSnapshots {
+		if s.Name == snapName && s.Parent != volumePath {
+			return snapshot, status.Errorf(
+				codes.AlreadyExists,
+				"Snapshot '%s' already exists for filesystem: %s",
+				snapName,
+				s.Path,
+			)
+		}
+	}
+
+	snapshotPath := fmt.Sprintf("%s@%s", volumePath, snapName)
+
+	// if here, than volumePath exists on some NS
+	err = nsProvider.CreateSnapshot(ns.CreateSnapshotParams{
+		Path: snapshotPath,
+	})
+	if err != nil && !ns.IsAlreadyExistNefError(err) {
+		return snapshot, status.Errorf(codes.Internal, "Cannot create snapshot '%s': %s", snapshotPath, err)
+	}
+
+	snapshot, err = nsProvider.GetSnapshot(snapshotPath)
+	if err != nil {
+		return snapshot, status.Errorf(
+			codes.Internal,
+			"Snapshot '%s' has been created, but snapshot properties request failed: %s",
+			snapshotPath,
+			err,
+		)
+	}
+	l.Infof("successfully created snapshot %+v@%+v", volumePath, snapName)
+	return snapshot, nil
 }
 
 // CreateSnapshot creates a snapshot of given volume
@@ -863,478 +3176,1538 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 	*csi.CreateSnapshotResponse,
 	error,
 ) {
-	l := s.log.WithField("func", "CreateSnapshot()")
+	l := s.log.WithField("func", "CreateSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	err := s.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	sourceVolumeId := req.GetSourceVolumeId()
+	if len(sourceVolumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot source volume ID must be provided")
+	}
+
+	volInfo, err := ParseVolumeID(sourceVolumeId)
+	if err != nil {
+		l.Infof("VolumeInfo error: %s", err)
+		return nil, err
+	}
+
+	name := req.GetName()
+	if len(name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot name must be provided")
+	}
+
+	params := ResolveNSParams{
+		datasetPath:     volInfo.Path,
+		configName:      volInfo.ConfigName,
+		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	}
+
+	resolveResp, err := s.resolveNS(params)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotPath := fmt.Sprintf("%s@%s", volInfo.Path, name)
+	createdSnapshot, err := s.CreateSnapshotOnNS(resolveResp.nsProvider, volInfo.Path, name)
+	if err != nil {
+		return nil, err
+	}
+	// snapshot creation time is used, so retried request sets the same properties
+	if err := s.setSnapshotMetadata(
+		resolveResp.nsProvider,
+		snapshotPath,
+		getMetadataUserProperties(req.GetParameters(), snapshotMetadataParameters, createdSnapshot.CreationTime),
+	); err != nil {
+		return nil, err
+	}
+	properties, err := s.getSnapshotProperties(resolveResp.nsProvider, snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	creationTime := &timestamp.Timestamp{
+		Seconds: createdSnapshot.CreationTime.Unix(),
+	}
+
+	snapshotId := fmt.Sprintf("%s:%s", resolveResp.configName, snapshotPath)
+	res := &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     snapshotId,
+			SourceVolumeId: sourceVolumeId,
+			CreationTime:   creationTime,
+			SizeBytes:      properties.BytesReferenced,
+			ReadyToUse:     true,
+		},
+	}
+
+	if ns.IsAlreadyExistNefError(err) {
+		l.Infof("snapshot '%s' already exists and can be used", snapshotId)
+		return res, nil
+	}
+
+	l.Infof("snapshot '%s' has been created", snapshotId)
+	return res, nil
+}
+
+// DeleteSnapshot deletes snapshots
+func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
+	*csi.DeleteSnapshotResponse,
+	error,
+) {
+	l := s.log.WithField("func", "DeleteSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	err := s.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	snapshotId := req.GetSnapshotId()
+	if len(snapshotId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID must be provided")
+	}
+
+	volume := ""
+	snapshot := ""
+	splittedString := strings.Split(snapshotId, "@")
+	if len(splittedString) == 2 {
+		volume = splittedString[0]
+		snapshot = splittedString[1]
+	} else {
+		l.Infof("snapshot '%s' not found, that's OK for deletion request", snapshotId)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	volInfo, err := ParseVolumeID(volume)
+	if err != nil {
+		l.Infof("VolumeInfo error: %s", err)
+		return nil, err
+	}
+
+	params := ResolveNSParams{
+		datasetPath:     volInfo.Path,
+		configName:      volInfo.ConfigName,
+		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	}
+
+	resolveResp, err := s.resolveNS(params)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			l.Infof("snapshot '%s' not found, that's OK for deletion request", snapshotId)
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+		return nil, err
+	}
+	nsProvider := resolveResp.nsProvider
+
+	// if here, than volumePath exists on some NS
+	snapshotPath := strings.Join([]string{volInfo.Path, snapshot}, "@")
+	err = nsProvider.DestroySnapshot(snapshotPath)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		message := fmt.Sprintf("Failed to delete snapshot '%s'", snapshotPath)
+		if ns.IsBusyNefError(err) {
+			message += ", it has dependent filesystem"
+		}
+		return nil, status.Errorf(codes.Internal, "%s: %s", message, err)
+	}
+
+	l.Infof("snapshot '%s' has been deleted", snapshotPath)
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots returns the list of snapshots
+func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse,
+	error,
+) {
+	l := s.log.WithField("func", "ListSnapshots()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	//TODO try this when list issue is solved
+	err := s.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	if req.GetSnapshotId() != "" {
+		// identity information for a specific snapshot, can be used to list only a specific snapshot
+		return s.getSnapshotListWithSingleSnapshot(req.GetSnapshotId(), req)
+	} else if req.GetSourceVolumeId() != "" {
+		// identity information for the source volume, can be used to list snapshots by volume
+		return s.getFilesystemSnapshotList(req.GetSourceVolumeId(), req)
+	} else {
+		// return list of all snapshots from default datasets
+		return s.getAllSnapshotsList(req)
+	}
+}
+
+// getAllSnapshotsList - list volume snapshots of all NexentaStors, token is composite: NexentaStors are listed
+// one by one in config name order, cursor is the last returned snapshot path
+func (s *ControllerServer) getAllSnapshotsList(req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse,
+	error,
+) {
+	l := s.log.WithField("func", "getAllSnapshotsList()")
+
+	maxEntries := int(req.GetMaxEntries())
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "req.MaxEntries must be 0 or greater, got: %d", maxEntries)
+	}
+
+	token, err := pagination.Decode(req.GetStartingToken())
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Invalid starting token: %s", err)
+	}
+	configNames := []string{}
+	for configName := range s.config.NsMap {
+		configNames = append(configNames, configName)
+	}
+	configNames = pagination.SortedConfigNames(configNames)
+	startIndex, err := pagination.StartIndex(configNames, token)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Invalid starting token: %s", err)
+	}
+
+	// parent filesystems are walked once per listing, the next pages reuse the volumes
+	listingID := token.ListingID
+	if listingID == "" && maxEntries > 0 {
+		listingID = pagination.NewListingID()
+	}
+
+	nextToken := ""
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	cursor := token.Cursor
+	for i := startIndex; i < len(configNames); i++ {
+		configName := configNames[i]
+
+		resolveResp, err := s.resolveNS(ResolveNSParams{
+			configName: configName,
+		})
+		if err != nil {
+			return nil, err
+		}
+		snapshots, err := resolveResp.nsProvider.GetSnapshots(resolveResp.datasetPath, true)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot get snapshot list for '%s' on [%s]: %s",
+				resolveResp.datasetPath,
+				configName,
+				err,
+			)
+		}
+
+		volumes, err := s.getListingDatasetVolumes(
+			listingID,
+			configName,
+			resolveResp.nsProvider,
+			resolveResp.datasetPath,
+			cursor,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshotsProperties, err := s.getSnapshotsProperties(resolveResp.nsProvider, resolveResp.datasetPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// snapshots deleted between the two list requests are skipped
+		volumeSnapshots := []ns.Snapshot{}
+		for _, snapshot := range snapshots {
+			if _, ok := snapshotsProperties[snapshot.Path]; !ok {
+				continue
+			}
+			if isVolumeSnapshot(snapshot, resolveResp.datasetPath, volumes.parents) && snapshot.Path > cursor {
+				volumeSnapshots = append(volumeSnapshots, snapshot)
+			}
+		}
+		sort.Slice(volumeSnapshots, func(a, b int) bool {
+			return volumeSnapshots[a].Path < volumeSnapshots[b].Path
+		})
+		cursor = ""
+
+		for j, snapshot := range volumeSnapshots {
+			entries = append(
+				entries,
+				convertNSSnapshotToCSISnapshot(snapshot, snapshotsProperties[snapshot.Path], configName),
+			)
+			if maxEntries > 0 && len(entries) == maxEntries {
+				if j+1 < len(volumeSnapshots) {
+					nextToken = pagination.Token{
+						ConfigName: configName,
+						Cursor:     snapshot.Path,
+						ListingID:  listingID,
+					}.Encode()
+				} else if i+1 < len(configNames) {
+					nextToken = pagination.Token{ConfigName: configNames[i+1], ListingID: listingID}.Encode()
+				}
+				break
+			}
+		}
+		if maxEntries > 0 && len(entries) == maxEntries {
+			break
+		}
+	}
+
+	l.Infof("found %d snapshot(s)", len(entries))
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// isVolumeSnapshot - snapshot is created by the driver: it's a snapshot of a volume in the dataset or in its
+// parent filesystems, but not of the dataset itself, parent or volume nested filesystems,
+// and not an intermediate clone snapshot
+func isVolumeSnapshot(snapshot ns.Snapshot, datasetPath string, parents map[string]bool) bool {
+	parentPath := filepath.Dir(snapshot.Parent)
+	return (parentPath == datasetPath || parents[parentPath]) &&
+		!parents[snapshot.Parent] &&
+		!strings.HasPrefix(snapshot.Name, cloneSnapshotPrefix)
+}
+
+func (s *ControllerServer) getSnapshotListWithSingleSnapshot(snapshotId string, req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse,
+	error,
+) {
+	l := s.log.WithField("func", "getSnapshotListWithSingleSnapshot()")
+	l.Infof("Snapshot path: %s", snapshotId)
+
+	response := csi.ListSnapshotsResponse{
+		Entries: []*csi.ListSnapshotsResponse_Entry{},
+	}
+
+	splittedSnapshotPath := strings.Split(snapshotId, "@")
+	if len(splittedSnapshotPath) != 2 {
+		// bad snapshotID format, but it's ok, driver should return empty response
+		l.Infof("Bad snapshot format: %s", splittedSnapshotPath)
+		return &response, nil
+	}
+
+	volInfo, err := ParseVolumeID(splittedSnapshotPath[0])
+	if err != nil {
+		l.Infof("VolumeInfo error: %s", err)
+		return nil, err
+	}
+
+	params := ResolveNSParams{
+		datasetPath:     volInfo.Path,
+		configName:      volInfo.ConfigName,
+		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	}
+
+	resolveResp, err := s.resolveNS(params)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			l.Infof("filesystem '%s' not found, that's OK for list request", volInfo.Path)
+			return &response, nil
+		}
+		return nil, err
+	}
+	nsProvider := resolveResp.nsProvider
+	snapshotPath := fmt.Sprintf("%s@%s", volInfo.Path, splittedSnapshotPath[1])
+	snapshot, err := nsProvider.GetSnapshot(snapshotPath)
+	if err != nil {
+		if ns.IsNotExistNefError(err) {
+			return &response, nil
+		}
+		return nil, status.Errorf(codes.Internal, "Cannot get snapshot '%s' for snapshot list: %s", snapshotPath, err)
+	}
+	properties, err := s.getSnapshotProperties(nsProvider, snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	response.Entries = append(
+		response.Entries,
+		convertNSSnapshotToCSISnapshot(snapshot, properties, resolveResp.configName),
+	)
+	l.Infof("snapshot '%s' found for '%s' filesystem", snapshot.Path, volInfo.Path)
+	return &response, nil
+}
+
+// getFilesystemSnapshotList - list snapshots of the volume, token cursor is the last returned snapshot path
+func (s *ControllerServer) getFilesystemSnapshotList(volumeId string, req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse,
+	error,
+) {
+	l := s.log.WithField("func", "getFilesystemSnapshotList()")
+	l.Infof("filesystem path: %s", volumeId)
+
+	maxEntries := int(req.GetMaxEntries())
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "req.MaxEntries must be 0 or greater, got: %d", maxEntries)
+	}
+
+	token, err := pagination.Decode(req.GetStartingToken())
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Invalid starting token: %s", err)
+	}
+
+	response := csi.ListSnapshotsResponse{
+		Entries: []*csi.ListSnapshotsResponse_Entry{},
+	}
+	splittedVol := strings.Split(volumeId, ":")
+	volumePath := ""
+	configName := ""
+	params := ResolveNSParams{}
+	if len(splittedVol) == 2 {
+		configName, volumePath = splittedVol[0], splittedVol[1]
+		params.datasetPath = volumePath
+		params.configName = configName
+	} else {
+		volumePath = volumeId
+		params.datasetPath = volumePath
+	}
+	resolveResp, err := s.resolveNS(params)
+	if err != nil {
+		l.Infof("volume '%s' not found, that's OK for list request", volumePath)
+		return &response, nil
+	}
+	if token.ConfigName != "" && token.ConfigName != resolveResp.configName {
+		return nil, status.Errorf(
+			codes.Aborted,
+			"Invalid starting token: NexentaStor [%s] doesn't match volume '%s'",
+			token.ConfigName,
+			volumeId,
+		)
+	}
+
+	nsProvider := resolveResp.nsProvider
+	snapshots, err := nsProvider.GetSnapshots(volumePath, true)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get snapshot list for '%s': %s", volumePath, err)
+	}
+
+	snapshotsProperties, err := s.getSnapshotsProperties(nsProvider, volumePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// intermediate clone snapshots and snapshots deleted between the two list requests are filtered out
+	// before paging, so pages are never short
+	volumeSnapshots := []ns.Snapshot{}
+	for _, snapshot := range snapshots {
+		if _, ok := snapshotsProperties[snapshot.Path]; !ok {
+			continue
+		}
+		if !strings.HasPrefix(snapshot.Name, cloneSnapshotPrefix) && snapshot.Path > token.Cursor {
+			volumeSnapshots = append(volumeSnapshots, snapshot)
+		}
+	}
+	sort.Slice(volumeSnapshots, func(a, b int) bool {
+		return volumeSnapshots[a].Path < volumeSnapshots[b].Path
+	})
+
+	for i, snapshot := range volumeSnapshots {
+		response.Entries = append(
+			response.Entries,
+			convertNSSnapshotToCSISnapshot(snapshot, snapshotsProperties[snapshot.Path], resolveResp.configName),
+		)
+
+		// if the requested maximum is reached (and specified) than set next token
+		if maxEntries > 0 && len(response.Entries) == maxEntries {
+			if i+1 < len(volumeSnapshots) {
+				l.Infof(
+					"max entries count (%d) has been reached while getting snapshots for '%s' filesystem, "+
+						"send response with next_token for pagination",
+					maxEntries,
+					volumePath,
+				)
+				response.NextToken = pagination.Token{
+					ConfigName: resolveResp.configName,
+					Cursor:     snapshot.Path,
+				}.Encode()
+			}
+			break
+		}
+	}
+
+	l.Infof("found %d snapshot(s) for %s filesystem", len(response.Entries), volumePath)
+
+	return &response, nil
+}
+
+// setSnapshotMetadata - set Kubernetes metadata user properties of the snapshot
+func (s *ControllerServer) setSnapshotMetadata(
+	nsProvider ns.ProviderInterface,
+	snapshotPath string,
+	userProperties map[string]string,
+) error {
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	err = nefClient.SetSnapshotUserProperties(snapshotPath, userProperties)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot set user properties of snapshot '%s': %s", snapshotPath, err)
+	}
+	return nil
+}
+
+// getSnapshotProperties - referenced bytes and clones of the snapshot
+func (s *ControllerServer) getSnapshotProperties(nsProvider ns.ProviderInterface, snapshotPath string) (
+	nef.SnapshotProperties,
+	error,
+) {
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nef.SnapshotProperties{}, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	properties, err := nefClient.GetSnapshotProperties(snapshotPath)
+	if err != nil {
+		return properties, status.Errorf(codes.Internal, "Cannot get snapshot '%s' properties: %s", snapshotPath, err)
+	}
+	return properties, nil
+}
+
+// getSnapshotsProperties - referenced bytes of all snapshots of the parent and its children by snapshot paths,
+// requested with paged snapshot list, so listings don't make a request per snapshot
+func (s *ControllerServer) getSnapshotsProperties(nsProvider ns.ProviderInterface, parentPath string) (
+	map[string]nef.SnapshotProperties,
+	error,
+) {
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	properties, err := nefClient.GetSnapshotsProperties(parentPath, true)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get snapshot properties of '%s': %s", parentPath, err)
+	}
+	return properties, nil
+}
+
+// convertNSSnapshotToCSISnapshot - ZFS snapshot is created atomically and is not listed before it's committed
+// (received snapshots are not listed until replication stream is completed), so existing snapshot is ready to use
+func convertNSSnapshotToCSISnapshot(
+	snapshot ns.Snapshot,
+	properties nef.SnapshotProperties,
+	configName string,
+) *csi.ListSnapshotsResponse_Entry {
+	return &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     fmt.Sprintf("%s:%s", configName, snapshot.Path),
+			SourceVolumeId: fmt.Sprintf("%s:%s", configName, snapshot.Parent),
+			CreationTime: &timestamp.Timestamp{
+				Seconds: snapshot.CreationTime.Unix(),
+			},
+			SizeBytes:  properties.BytesReferenced,
+			ReadyToUse: true,
+		},
+	}
+}
+
+// ValidateVolumeCapabilities validates volume capabilities
+// Shall return confirmed only if all the volume
+// capabilities specified in the request are supported.
+func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (
+	*csi.ValidateVolumeCapabilitiesResponse,
+	error,
+) {
+	l := s.log.WithField("func", "ValidateVolumeCapabilities()")
 	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-	err := s.refreshConfig("")
+	volumeId := req.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+	}
+
+	// not clear why we need to check VolumeID format only, without checking pathes
+	volInfo, err := ParseVolumeID(volumeId)
+	if err != nil {
+		l.Errorf("Got wrong volumeId, VolumeInfo error: %s", err)
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("VolumeId is in wrong format: %s", volumeId))
+	}
+
+	volumeCapabilities := req.GetVolumeCapabilities()
+	if volumeCapabilities == nil {
+		return nil, status.Error(codes.InvalidArgument, "req.VolumeCapabilities must be provided")
+	}
+
+	// volume attributes are passed from ControllerServer.CreateVolume()
+	volumeContext := req.GetVolumeContext()
+
+	var secret string
+	secrets := req.GetSecrets()
+	for _, v := range secrets {
+		secret = v
+	}
+	err = s.refreshConfig(secret)
 	if err != nil {
 		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
 	}
 
-	sourceVolumeId := req.GetSourceVolumeId()
-	if len(sourceVolumeId) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Snapshot source volume ID must be provided")
+	params := ResolveNSParams{
+		datasetPath:     volInfo.Path,
+		configName:      volInfo.ConfigName,
+		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
 	}
 
-	volInfo, err := ParseVolumeID(sourceVolumeId)
+	nsProvider, err := s.resolveNS(params)
 	if err != nil {
-		l.Infof("VolumeInfo error: %s", err)
 		return nil, err
 	}
 
-	name := req.GetName()
-	if len(name) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Snapshot name must be provided")
+	l.Infof("resolved NS: %s, %+v", nsProvider, params)
+
+	for _, reqC := range volumeCapabilities {
+		supported := validateVolumeCapability(reqC)
+		l.Infof("requested capability: '%s', supported: %t", reqC.GetAccessMode().GetMode(), supported)
+		if !supported {
+			message := fmt.Sprintf("Driver does not support volume capability mode: %s", reqC.GetAccessMode().GetMode())
+			l.Warn(message)
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: message,
+			}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeCapabilities: supportedVolumeCapabilities,
+			VolumeContext:      volumeContext,
+		},
+	}, nil
+}
+
+// ControllerGetCapabilities - controller capabilities
+func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (
+	*csi.ControllerGetCapabilitiesResponse,
+	error,
+) {
+	s.log.WithField("func", "ControllerGetCapabilities()").Infof("request: '%+v'", req)
+
+	var capabilities []*csi.ControllerServiceCapability
+	for _, c := range supportedControllerCapabilities {
+		capabilities = append(capabilities, newControllerServiceCapability(c))
+	}
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: capabilities,
+	}, nil
+}
+
+func newControllerServiceCapability(cap csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: cap,
+			},
+		},
+	}
+}
+
+func validateVolumeCapability(requestedVolumeCapability *csi.VolumeCapability) bool {
+	// block access type is supported for iSCSI volumes only, it's checked by validateVolumeProtocol()
+	requestedMode := requestedVolumeCapability.GetAccessMode().GetMode()
+	for _, volumeCapability := range supportedVolumeCapabilities {
+		if volumeCapability.GetAccessMode().GetMode() == requestedMode {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
+	*csi.GetCapacityResponse,
+	error,
+) {
+	l := s.log.WithField("func", "GetCapacity()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	err := s.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	reqParams := req.GetParameters()
+	if reqParams == nil {
+		reqParams = make(map[string]string)
+	}
+
+	// get dataset path from runtime params, set default if not specified
+	datasetPath := ""
+	if v, ok := reqParams["dataset"]; ok {
+		datasetPath = v
+	}
+	configName := ""
+	if v, ok := reqParams["configName"]; ok {
+		configName = v
+		if _, ok := s.nsResolverMap[configName]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown NexentaStor config name: '%s'", configName)
+		}
+	}
+
+	// capacity of NexentaStors matching requested topology segment is summed up,
+	// max volume size is limited by the NexentaStor with the most free space
+	segments := req.GetAccessibleTopology().GetSegments()
+	var availableCapacity, maximumVolumeSize int64
+	for name, resolver := range s.nsResolverMap {
+		cfg := s.config.NsMap[name]
+		if configName != "" && name != configName {
+			continue
+		}
+		if zone, ok := segments[TopologyKeyZone]; ok && zone != cfg.Zone {
+			continue
+		}
+		if !IsApplianceSegmentMatched(segments, name) {
+			continue
+		}
+
+		path := datasetPath
+		if path == "" {
+			path = cfg.DefaultDataset
+		}
+		nsProvider, err := resolver.Resolve(path)
+		if err != nil {
+			l.Warnf("skip NexentaStor [%s], cannot resolve '%s': %s", name, path, err)
+			continue
+		}
+		candidate, err := getPlacementCandidate(name, cfg, nsProvider, path, "")
+		if err != nil {
+			l.Warnf("skip NexentaStor [%s]: %s", name, err)
+			continue
+		}
+		// new volumes are not placed on NexentaStors below pool free space floor
+		if candidate.PoolFreePercent() < float64(candidate.MinPoolFreePercent) {
+			l.Infof("NexentaStor [%s] pool free space is below %d%%", name, candidate.MinPoolFreePercent)
+			continue
+		}
+
+		l.Infof("NexentaStor [%s] dataset '%s' available capacity: %d bytes", name, path, candidate.FreeBytes)
+		availableCapacity += candidate.FreeBytes
+		if candidate.FreeBytes > maximumVolumeSize {
+			maximumVolumeSize = candidate.FreeBytes
+		}
+	}
+
+	res := &csi.GetCapacityResponse{
+		AvailableCapacity: availableCapacity,
+		MaximumVolumeSize: &wrappers.Int64Value{Value: maximumVolumeSize},
+	}
+	// zvol size is rounded up to the alignment, filesystems have no minimum size
+	if isZvolProtocol(reqParams["protocol"]) {
+		res.MinimumVolumeSize = &wrappers.Int64Value{Value: zvolSizeAlignment}
+	}
+
+	l.Infof("Available capacity: '%+v' bytes, max volume size: '%+v' bytes", availableCapacity, maximumVolumeSize)
+	return res, nil
+}
+
+// IsApplianceSegmentMatched - false if topology segment tells the NexentaStor is not reachable,
+// segments of other NexentaStors don't matter
+func IsApplianceSegmentMatched(segments map[string]string, configName string) bool {
+	return segments[getApplianceTopologyKey(configName)] != "false"
+}
+
+// ControllerPublishVolume - add node address to NFS share access list of the volume
+func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (
+	*csi.ControllerPublishVolumeResponse,
+	error,
+) {
+	l := s.log.WithField("func", "ControllerPublishVolume()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+	}
+	nodeID := req.GetNodeId()
+	if len(nodeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID must be provided")
+	}
+	volumeCapability := req.GetVolumeCapability()
+	if volumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability must be provided")
+	}
+	if !validateVolumeCapability(volumeCapability) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"Driver does not support volume capability mode: %s",
+			volumeCapability.GetAccessMode().GetMode(),
+		)
+	}
+
+	var secret string
+	secrets := req.GetSecrets()
+	for _, v := range secrets {
+		secret = v
+	}
+	err := s.refreshConfig(secret)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	volInfo, err := ParseVolumeID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "VolumeId is in wrong format: %s", volumeID)
+	}
+
+	// iSCSI LUNs are visible to initiators of the host groups they are mapped to only
+	if req.GetVolumeContext()["protocol"] == ProtocolISCSI {
+		publishContext, err := s.publishISCSIZvol(volInfo, nodeID)
+		if err != nil {
+			return nil, err
+		}
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: publishContext,
+		}, nil
 	}
 
-	params := ResolveNSParams{
+	// NVMe subsystems allow connections from hosts in the subsystem host list only
+	if req.GetVolumeContext()["protocol"] == ProtocolNVMeTCP {
+		hostNQN, err := s.publishNVMeZvol(volInfo, nodeID)
+		if err != nil {
+			return nil, err
+		}
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: map[string]string{"hostNqn": hostNQN},
+		}, nil
+	}
+
+	resolveResp, err := s.resolveNS(ResolveNSParams{
 		datasetPath:     volInfo.Path,
 		configName:      volInfo.ConfigName,
 		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
-	}
-
-	resolveResp, err := s.resolveNS(params)
+	})
 	if err != nil {
 		return nil, err
 	}
+	nsProvider := resolveResp.nsProvider
+	cfg := s.config.NsMap[resolveResp.configName]
+	volumeContext := req.GetVolumeContext()
+	fsType := getVolumeMountFsType(volumeContext, cfg)
+	readOnly := req.GetReadonly() || isReadOnlyAccessMode(volumeCapability)
 
-	snapshotPath := fmt.Sprintf("%s@%s", volInfo.Path, name)
-	createdSnapshot, err := s.CreateSnapshotOnNS(resolveResp.nsProvider, volInfo.Path, name)
+	// per-node access lists are supported for NFS shares only, SMB shares are not restricted by node
+	if fsType == config.FsTypeCIFS {
+		l.Infof("volume '%s' is shared over SMB, skip NFS access list update", volumeID)
+		err = s.publishSmbShare(nsProvider, volInfo.Path, readOnly)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		nodeInfo, err := s.getNodeInfo(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		err = s.publishNfsShare(nsProvider, volInfo.Path, nodeInfo, readOnly)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.updatePublishedNodes(nsProvider, volInfo.Path, nodeID, true, false)
 	if err != nil {
 		return nil, err
 	}
-	creationTime := &timestamp.Timestamp{
-		Seconds: createdSnapshot.CreationTime.Unix(),
-	}
 
-	snapshotId := fmt.Sprintf("%s:%s", resolveResp.configName, snapshotPath)
-	res := &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SnapshotId:     snapshotId,
-			SourceVolumeId: sourceVolumeId,
-			CreationTime:   creationTime,
-			ReadyToUse:     true, //TODO use actual state
-			//SizeByte: 0 //TODO size of zero means it is unspecified
-		},
+	// node doesn't create or change shares of volumes published by controller
+	res := &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{"controllerPublished": "true"},
 	}
-
-	if ns.IsAlreadyExistNefError(err) {
-		l.Infof("snapshot '%s' already exists and can be used", snapshotId)
-		return res, nil
+	if cfg.ControllerSharing {
+		// node mounts volume using this mount source without NexentaStor REST API calls
+		mountSource, err := s.shareVolume(nsProvider, volInfo.Path, fsType, getVolumeDataIP(volumeContext, cfg), readOnly)
+		if err != nil {
+			return nil, err
+		}
+		res.PublishContext["mountSource"] = mountSource
+		res.PublishContext["mountFsType"] = fsType
 	}
 
-	l.Infof("snapshot '%s' has been created", snapshotId)
 	return res, nil
 }
 
-// DeleteSnapshot deletes snapshots
-func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
-	*csi.DeleteSnapshotResponse,
-	error,
-) {
-	l := s.log.WithField("func", "DeleteSnapshot()")
-	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+// publishISCSIZvol - map zvol LUN to the host group of the node initiator, returns initiator name
+// the node must log in with and the LUN number
+func (s *ControllerServer) publishISCSIZvol(volInfo VolumeInfo, nodeID string) (map[string]string, error) {
+	l := s.log.WithField("func", "publishISCSIZvol()")
 
-	err := s.refreshConfig("")
+	zvolResp, _, err := s.resolveZvol(volInfo)
 	if err != nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+		return nil, err
 	}
+	nsProvider := zvolResp.nsProvider
 
-	snapshotId := req.GetSnapshotId()
-	if len(snapshotId) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Snapshot ID must be provided")
+	initiatorName := iscsi.InitiatorName(nodeID)
+	hostGroupName := getISCSIHostGroupName(nodeID)
+	err = nsProvider.CreateHostGroup(ns.CreateHostGroupParams{
+		Name:    hostGroupName,
+		Members: []string{initiatorName},
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create host group '%s': %s", hostGroupName, err)
 	}
 
-	volume := ""
-	snapshot := ""
-	splittedString := strings.Split(snapshotId, "@")
-	if len(splittedString) == 2 {
-		volume = splittedString[0]
-		snapshot = splittedString[1]
-	} else {
-		l.Infof("snapshot '%s' not found, that's OK for deletion request", snapshotId)
-		return &csi.DeleteSnapshotResponse{}, nil
+	lunMappings, err := nsProvider.GetLunMappings(ns.GetLunMappingsParams{
+		Volume:    volInfo.Path,
+		HostGroup: hostGroupName,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get LUN mappings of '%s': %s", volInfo.Path, err)
+	}
+	if len(lunMappings) == 0 {
+		err = nsProvider.CreateLunMapping(ns.CreateLunMappingParams{
+			HostGroup:   hostGroupName,
+			Volume:      volInfo.Path,
+			TargetGroup: getISCSITargetGroupName(filepath.Base(volInfo.Path)),
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot create LUN mapping for '%s': %s", volInfo.Path, err)
+		}
+		lunMappings, err = nsProvider.GetLunMappings(ns.GetLunMappingsParams{
+			Volume:    volInfo.Path,
+			HostGroup: hostGroupName,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot get LUN mappings of '%s': %s", volInfo.Path, err)
+		} else if len(lunMappings) == 0 {
+			return nil, status.Errorf(codes.Internal, "LUN mapping of '%s' to '%s' not found", volInfo.Path, hostGroupName)
+		}
 	}
 
-	volInfo, err := ParseVolumeID(volume)
+	err = s.updatePublishedNodes(nsProvider, volInfo.Path, nodeID, true, true)
 	if err != nil {
-		l.Infof("VolumeInfo error: %s", err)
 		return nil, err
 	}
 
-	params := ResolveNSParams{
-		datasetPath:     volInfo.Path,
-		configName:      volInfo.ConfigName,
-		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	l.Infof("volume '%s' is mapped as LUN %d to node '%s' (%s)", volInfo.Path, lunMappings[0].Lun, nodeID, initiatorName)
+	return map[string]string{
+		"initiatorName": initiatorName,
+		"lun":           strconv.Itoa(lunMappings[0].Lun),
+	}, nil
+}
+
+// publishNVMeZvol - add node host NQN to NVMe subsystem host list, returns host NQN the node must connect with
+func (s *ControllerServer) publishNVMeZvol(volInfo VolumeInfo, nodeID string) (string, error) {
+	l := s.log.WithField("func", "publishNVMeZvol()")
+
+	zvolResp, _, err := s.resolveZvol(volInfo)
+	if err != nil {
+		return "", err
+	}
+	nefClient, err := nef.New(zvolResp.nsProvider)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
 	}
 
-	resolveResp, err := s.resolveNS(params)
+	subsystemName := getNVMeSubsystemName(s.config.NsMap[zvolResp.configName], filepath.Base(volInfo.Path))
+	hostNQN := nvme.HostNQN(nodeID)
+	err = nefClient.AddNvmeofSubsystemHost(subsystemName, hostNQN)
 	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			l.Infof("snapshot '%s' not found, that's OK for deletion request", snapshotId)
-			return &csi.DeleteSnapshotResponse{}, nil
-		}
-		return nil, err
+		return "", status.Errorf(
+			codes.Internal,
+			"Cannot add host '%s' to NVMe subsystem '%s': %s",
+			hostNQN,
+			subsystemName,
+			err,
+		)
 	}
-	nsProvider := resolveResp.nsProvider
 
-	// if here, than volumePath exists on some NS
-	snapshotPath := strings.Join([]string{volInfo.Path, snapshot}, "@")
-	err = nsProvider.DestroySnapshot(snapshotPath)
-	if err != nil && !ns.IsNotExistNefError(err) {
-		message := fmt.Sprintf("Failed to delete snapshot '%s'", snapshotPath)
-		if ns.IsBusyNefError(err) {
-			message += ", it has dependent filesystem"
-		}
-		return nil, status.Errorf(codes.Internal, "%s: %s", message, err)
+	err = s.updatePublishedNodes(zvolResp.nsProvider, volInfo.Path, nodeID, true, true)
+	if err != nil {
+		return "", err
 	}
 
-	l.Infof("snapshot '%s' has been deleted", snapshotPath)
-	return &csi.DeleteSnapshotResponse{}, nil
+	l.Infof("node '%s' is allowed to connect to NVMe subsystem '%s' as '%s'", nodeID, subsystemName, hostNQN)
+	return hostNQN, nil
 }
 
-// ListSnapshots returns the list of snapshots
-func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (
-	*csi.ListSnapshotsResponse,
-	error,
-) {
-	l := s.log.WithField("func", "ListSnapshots()")
-	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+// publishNfsShare - share filesystem to the node or add the node to existing NFS share access list
+func (s *ControllerServer) publishNfsShare(
+	nsProvider ns.ProviderInterface,
+	volumePath string,
+	nodeInfo NodeInfo,
+	readOnly bool,
+) error {
+	l := s.log.WithField("func", "publishNfsShare()")
 
-	//TODO try this when list issue is solved
-	err := s.refreshConfig("")
+	rule := newNfsRule(nodeInfo.Address, 0)
+
+	s.nfsShareMutex.Lock()
+	defer s.nfsShareMutex.Unlock()
+
+	filesystem, err := nsProvider.GetFilesystem(volumePath)
 	if err != nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+		if ns.IsNotExistNefError(err) {
+			return status.Errorf(codes.NotFound, "Filesystem '%s' not found: %s", volumePath, err)
+		}
+		return status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", volumePath, err)
 	}
 
-	if req.GetSnapshotId() != "" {
-		// identity information for a specific snapshot, can be used to list only a specific snapshot
-		return s.getSnapshotListWithSingleSnapshot(req.GetSnapshotId(), req)
-	} else if req.GetSourceVolumeId() != "" {
-		// identity information for the source volume, can be used to list snapshots by volume
-		return s.getFilesystemSnapshotList(req.GetSourceVolumeId(), req)
-	} else {
-		// return list of all snapshots from default datasets
-		response := csi.ListSnapshotsResponse{
-			Entries: []*csi.ListSnapshotsResponse_Entry{},
+	if !filesystem.SharedOverNfs {
+		// share filesystem to this node only
+		params := ns.CreateNfsShareParams{
+			Filesystem: filesystem.Path,
 		}
-		for _, cfg := range s.config.NsMap {
-			resp, _ := s.getFilesystemSnapshotList(cfg.DefaultDataset, req)
-			for _, snapshot := range resp.Entries {
-				response.Entries = append(response.Entries, snapshot)
-			}
-			if len(resp.NextToken) > 0 {
-				response.NextToken = resp.NextToken
-				return &response, nil
-			}
+		aclRuleSet := ns.ACLReadWrite
+		if readOnly {
+			params.ReadOnlyList = []ns.NfsRuleList{rule}
+			aclRuleSet = ns.ACLReadOnly
+		} else {
+			params.ReadWriteList = []ns.NfsRuleList{rule}
 		}
-		return &response, nil
+		err = nsProvider.CreateNfsShare(params)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot share filesystem '%s' over NFS: %s", filesystem.Path, err)
+		}
+		err = nsProvider.SetFilesystemACL(filesystem.Path, aclRuleSet)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot set filesystem ACL for '%s': %s", filesystem.Path, err)
+		}
+		l.Infof("filesystem '%s' is shared over NFS to node '%s' (%s)", volumePath, nodeInfo.Name, nodeInfo.Address)
+		return nil
 	}
-}
 
-func (s *ControllerServer) getSnapshotListWithSingleSnapshot(snapshotId string, req *csi.ListSnapshotsRequest) (
-	*csi.ListSnapshotsResponse,
-	error,
-) {
-	l := s.log.WithField("func", "getSnapshotListWithSingleSnapshot()")
-	l.Infof("Snapshot path: %s", snapshotId)
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	share, err := nefClient.GetNfsShare(filesystem.Path)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get NFS share of '%s': %s", filesystem.Path, err)
+	}
 
-	response := csi.ListSnapshotsResponse{
-		Entries: []*csi.ListSnapshotsResponse_Entry{},
+	changed := false
+	for i := range share.SecurityContexts {
+		sc := &share.SecurityContexts[i]
+		if readOnly {
+			if containsNfsRule(sc.ReadWriteList, rule.Entity) {
+				sc.ReadWriteList = removeNfsRule(sc.ReadWriteList, rule.Entity)
+				changed = true
+			}
+			if !containsNfsRule(sc.ReadOnlyList, rule.Entity) {
+				sc.ReadOnlyList = addNfsRule(sc.ReadOnlyList, rule)
+				changed = true
+			}
+		} else {
+			if containsNfsRule(sc.ReadOnlyList, rule.Entity) {
+				sc.ReadOnlyList = removeNfsRule(sc.ReadOnlyList, rule.Entity)
+				changed = true
+			}
+			if !containsNfsRule(sc.ReadWriteList, rule.Entity) {
+				sc.ReadWriteList = addNfsRule(sc.ReadWriteList, rule)
+				changed = true
+			}
+		}
 	}
 
-	splittedSnapshotPath := strings.Split(snapshotId, "@")
-	if len(splittedSnapshotPath) != 2 {
-		// bad snapshotID format, but it's ok, driver should return empty response
-		l.Infof("Bad snapshot format: %s", splittedSnapshotPath)
-		return &response, nil
+	if changed {
+		err = nefClient.UpdateNfsShare(filesystem.Path, nef.UpdateNfsShareParams{
+			SecurityContexts: share.SecurityContexts,
+		})
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot update NFS share of '%s': %s", filesystem.Path, err)
+		}
+		l.Infof("node '%s' (%s) is added to NFS share of '%s'", nodeInfo.Name, nodeInfo.Address, volumePath)
 	}
 
-	volInfo, err := ParseVolumeID(splittedSnapshotPath[0])
+	return nil
+}
+
+// publishSmbShare - share filesystem over SMB if it's not shared yet, SMB shares are not restricted by node
+func (s *ControllerServer) publishSmbShare(nsProvider ns.ProviderInterface, volumePath string, readOnly bool) error {
+	l := s.log.WithField("func", "publishSmbShare()")
+
+	filesystem, err := nsProvider.GetFilesystem(volumePath)
 	if err != nil {
-		l.Infof("VolumeInfo error: %s", err)
-		return nil, err
+		if ns.IsNotExistNefError(err) {
+			return status.Errorf(codes.NotFound, "Filesystem '%s' not found: %s", volumePath, err)
+		}
+		return status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", volumePath, err)
 	}
-
-	params := ResolveNSParams{
-		datasetPath:     volInfo.Path,
-		configName:      volInfo.ConfigName,
-		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+	if filesystem.SharedOverSmb {
+		return nil
 	}
 
-	resolveResp, err := s.resolveNS(params)
+	err = nsProvider.CreateSmbShare(ns.CreateSmbShareParams{
+		Filesystem: filesystem.Path,
+		ShareName:  filesystem.GetDefaultSmbShareName(),
+	})
 	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			l.Infof("filesystem '%s' not found, that's OK for list request", volInfo.Path)
-			return &response, nil
-		}
-		return nil, err
+		return status.Errorf(codes.Internal, "Cannot share filesystem '%s' over SMB: %s", filesystem.Path, err)
 	}
-	nsProvider := resolveResp.nsProvider
-	snapshotPath := fmt.Sprintf("%s@%s", volInfo.Path, splittedSnapshotPath[1])
-	snapshot, err := nsProvider.GetSnapshot(snapshotPath)
+	aclRuleSet := ns.ACLReadWrite
+	if readOnly {
+		aclRuleSet = ns.ACLReadOnly
+	}
+	err = nsProvider.SetFilesystemACL(filesystem.Path, aclRuleSet)
 	if err != nil {
-		if ns.IsNotExistNefError(err) {
-			return &response, nil
-		}
-		return nil, status.Errorf(codes.Internal, "Cannot get snapshot '%s' for snapshot list: %s", snapshotPath, err)
+		return status.Errorf(codes.Internal, "Cannot set filesystem ACL for '%s': %s", filesystem.Path, err)
 	}
-	response.Entries = append(response.Entries, convertNSSnapshotToCSISnapshot(snapshot, resolveResp.configName))
-	l.Infof("snapshot '%s' found for '%s' filesystem", snapshot.Path, volInfo.Path)
-	return &response, nil
+
+	l.Infof("filesystem '%s' is shared over SMB", filesystem.Path)
+	return nil
 }
 
-func (s *ControllerServer) getFilesystemSnapshotList(volumeId string, req *csi.ListSnapshotsRequest) (
-	*csi.ListSnapshotsResponse,
-	error,
-) {
-	l := s.log.WithField("func", "getFilesystemSnapshotList()")
-	l.Infof("filesystem path: %s", volumeId)
+// updatePublishedNodes - add/remove node ID to/from published nodes user property of volume filesystem
+// or zvol, empty node ID on removal means the volume is unpublished from all nodes
+func (s *ControllerServer) updatePublishedNodes(
+	nsProvider ns.ProviderInterface,
+	volumePath string,
+	nodeID string,
+	published bool,
+	zvol bool,
+) error {
+	s.publishedNodesMutex.Lock()
+	defer s.publishedNodesMutex.Unlock()
 
-	startingToken := req.GetStartingToken()
-	maxEntries := req.GetMaxEntries()
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	var properties map[string]string
+	if zvol {
+		properties, err = nefClient.GetVolumeUserProperties(volumePath)
+	} else {
+		properties, err = nefClient.GetFilesystemUserProperties(volumePath)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get user properties of '%s': %s", volumePath, err)
+	}
 
-	response := csi.ListSnapshotsResponse{
-		Entries: []*csi.ListSnapshotsResponse_Entry{},
+	nodes := parsePublishedNodes(properties[userPropertyPublishedNodes])
+	updated := []string{}
+	for _, node := range nodes {
+		if node != nodeID && (published || nodeID != "") {
+			updated = append(updated, node)
+		}
 	}
-	splittedVol := strings.Split(volumeId, ":")
-	volumePath := ""
-	configName := ""
-	params := ResolveNSParams{}
-	if len(splittedVol) == 2 {
-		configName, volumePath = splittedVol[0], splittedVol[1]
-		params.datasetPath = volumePath
-		params.configName = configName
+	if published {
+		updated = append(updated, nodeID)
+	}
+	if strings.Join(updated, ",") == strings.Join(nodes, ",") {
+		return nil
+	}
+
+	updatedProperties := map[string]string{
+		userPropertyPublishedNodes: strings.Join(updated, ","),
+	}
+	if zvol {
+		err = nefClient.SetVolumeUserProperties(volumePath, updatedProperties)
 	} else {
-		volumePath = volumeId
-		params.datasetPath = volumePath
+		err = nefClient.SetFilesystemUserProperties(volumePath, updatedProperties)
 	}
-	resolveResp, err := s.resolveNS(params)
 	if err != nil {
-		l.Infof("volume '%s' not found, that's OK for list request", volumePath)
-		return &response, nil
+		return status.Errorf(codes.Internal, "Cannot set published nodes of '%s': %s", volumePath, err)
+	}
+	return nil
+}
+
+// getMetadataUserProperties - Kubernetes metadata from request parameters with driver name, version
+// and creation time as ZFS user properties
+func getMetadataUserProperties(
+	reqParams map[string]string,
+	metadataParameters map[string]string,
+	createdAt time.Time,
+) map[string]string {
+	userProperties := map[string]string{
+		userPropertyDriverName: Name,
+		userPropertyCreatedAt:  createdAt.UTC().Format(time.RFC3339),
+	}
+	if Version != "" {
+		userProperties[userPropertyDriverVersion] = Version
+	}
+	for parameter, property := range metadataParameters {
+		if value := reqParams[parameter]; value != "" {
+			userProperties[property] = value
+		}
 	}
+	return userProperties
+}
 
-	nsProvider := resolveResp.nsProvider
-	snapshots, err := nsProvider.GetSnapshots(volumePath, true)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Cannot get snapshot list for '%s': %s", volumePath, err)
+func parsePublishedNodes(value string) []string {
+	nodes := []string{}
+	for _, node := range strings.Split(value, ",") {
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// shareVolume - share filesystem if it's not shared yet, returns mount source for the node
+func (s *ControllerServer) shareVolume(
+	nsProvider ns.ProviderInterface,
+	volumePath string,
+	fsType string,
+	dataIP string,
+	readOnly bool,
+) (string, error) {
+	l := s.log.WithField("func", "shareVolume()")
+
+	if dataIP == "" {
+		return "", status.Errorf(
+			codes.FailedPrecondition,
+			"Data IP must be set by 'dataIp' parameter or 'defaultDataIp' config option to share '%s'",
+			volumePath,
+		)
 	}
 
-	for i, snapshot := range snapshots {
-		// skip all snapshots before startring token
-		if snapshot.Path == startingToken {
-			startingToken = ""
-		}
-		if startingToken != "" {
-			continue
+	filesystem, err := nsProvider.GetFilesystem(volumePath)
+	if err != nil {
+		if ns.IsNotExistNefError(err) {
+			return "", status.Errorf(codes.NotFound, "Filesystem '%s' not found: %s", volumePath, err)
 		}
+		return "", status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", volumePath, err)
+	}
 
-		response.Entries = append(response.Entries, convertNSSnapshotToCSISnapshot(snapshot, resolveResp.configName))
+	aclRuleSet := ns.ACLReadWrite
+	if readOnly {
+		aclRuleSet = ns.ACLReadOnly
+	}
 
-		// if the requested maximum is reached (and specified) than set next token
-		if maxEntries != 0 && int32(len(response.Entries)) == maxEntries {
-			if i+1 < len(snapshots) { // next snapshots index exists
-				l.Infof(
-					"max entries count (%d) has been reached while getting snapshots for '%s' filesystem, "+
-						"send response with next_token for pagination",
-					maxEntries,
-					volumePath,
-				)
-				response.NextToken = snapshots[i+1].Path
-				return &response, nil
+	switch fsType {
+	case config.FsTypeNFS:
+		if !filesystem.SharedOverNfs {
+			// share isn't open to anyone, ControllerPublishVolume adds publishing nodes to its access list
+			err = nsProvider.CreateNfsShare(ns.CreateNfsShareParams{
+				Filesystem:    filesystem.Path,
+				ReadWriteList: []ns.NfsRuleList{{Etype: "fqdn", Entity: nfsRuleEntityNone}},
+			})
+			if err != nil {
+				return "", status.Errorf(codes.Internal, "Cannot share filesystem '%s' over NFS: %s", filesystem.Path, err)
+			}
+			err = nsProvider.SetFilesystemACL(filesystem.Path, aclRuleSet)
+			if err != nil {
+				return "", status.Errorf(codes.Internal, "Cannot set filesystem ACL for '%s': %s", filesystem.Path, err)
+			}
+			l.Infof("filesystem '%s' is shared over NFS", filesystem.Path)
+		}
+		return fmt.Sprintf("%s:%s", dataIP, filesystem.MountPoint), nil
+	case config.FsTypeCIFS:
+		if !filesystem.SharedOverSmb {
+			err = nsProvider.CreateSmbShare(ns.CreateSmbShareParams{
+				Filesystem: filesystem.Path,
+				ShareName:  filesystem.GetDefaultSmbShareName(),
+			})
+			if err != nil {
+				return "", status.Errorf(codes.Internal, "Cannot share filesystem '%s' over SMB: %s", filesystem.Path, err)
+			}
+			err = nsProvider.SetFilesystemACL(filesystem.Path, aclRuleSet)
+			if err != nil {
+				return "", status.Errorf(codes.Internal, "Cannot set filesystem ACL for '%s': %s", filesystem.Path, err)
 			}
+			l.Infof("filesystem '%s' is shared over SMB", filesystem.Path)
+		}
+		shareName, err := nsProvider.GetSmbShareName(filesystem.Path)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "Cannot get SMB share name of '%s': %s", filesystem.Path, err)
 		}
+		return fmt.Sprintf("//%s/%s", dataIP, shareName), nil
 	}
 
-	l.Infof("found %d snapshot(s) for %s filesystem", len(response.Entries), volumePath)
+	return "", status.Errorf(codes.InvalidArgument, "Unsupported mount filesystem type: '%s'", fsType)
+}
 
-	return &response, nil
+// getVolumeMountFsType - volume mount filesystem type from volume context or config, NFS by default
+func getVolumeMountFsType(volumeContext map[string]string, cfg config.NsData) string {
+	if v := volumeContext["mountFsType"]; v != "" {
+		return v
+	} else if cfg.DefaultMountFsType != "" {
+		return cfg.DefaultMountFsType
+	}
+	return config.FsTypeNFS
 }
 
-func convertNSSnapshotToCSISnapshot(snapshot ns.Snapshot, configName string) *csi.ListSnapshotsResponse_Entry {
-	return &csi.ListSnapshotsResponse_Entry{
-		Snapshot: &csi.Snapshot{
-			SnapshotId:     fmt.Sprintf("%s:%s", configName, snapshot.Path),
-			SourceVolumeId: fmt.Sprintf("%s:%s", configName, snapshot.Parent),
-			CreationTime: &timestamp.Timestamp{
-				Seconds: snapshot.CreationTime.Unix(),
-			},
-			ReadyToUse: true, //TODO use actual state
-			//SizeByte: 0 //TODO size of zero means it is unspecified
-		},
+// getVolumeDataIP - volume data IP from volume context or config
+func getVolumeDataIP(volumeContext map[string]string, cfg config.NsData) string {
+	if v := volumeContext["dataIp"]; v != "" {
+		return v
 	}
+	return cfg.DefaultDataIP
 }
 
-// ValidateVolumeCapabilities validates volume capabilities
-// Shall return confirmed only if all the volume
-// capabilities specified in the request are supported.
-func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (
-	*csi.ValidateVolumeCapabilitiesResponse,
+// ControllerUnpublishVolume - remove node address from NFS share access list of the volume
+func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (
+	*csi.ControllerUnpublishVolumeResponse,
 	error,
 ) {
-	l := s.log.WithField("func", "ValidateVolumeCapabilities()")
+	l := s.log.WithField("func", "ControllerUnpublishVolume()")
 	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-	volumeId := req.GetVolumeId()
-	if len(volumeId) == 0 {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
 	}
 
-	// not clear why we need to check VolumeID format only, without checking pathes
-	volInfo, err := ParseVolumeID(volumeId)
-	if err != nil {
-		l.Errorf("Got wrong volumeId, VolumeInfo error: %s", err)
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("VolumeId is in wrong format: %s", volumeId))
-	}
-
-	volumeCapabilities := req.GetVolumeCapabilities()
-	if volumeCapabilities == nil {
-		return nil, status.Error(codes.InvalidArgument, "req.VolumeCapabilities must be provided")
-	}
-
-	// volume attributes are passed from ControllerServer.CreateVolume()
-	volumeContext := req.GetVolumeContext()
-
 	var secret string
 	secrets := req.GetSecrets()
 	for _, v := range secrets {
 		secret = v
 	}
-	err = s.refreshConfig(secret)
+	err := s.refreshConfig(secret)
 	if err != nil {
 		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
 	}
 
-	params := ResolveNSParams{
+	volInfo, err := ParseVolumeID(volumeID)
+	if err != nil {
+		l.Warnf("VolumeId is in wrong format: %s, nothing to unpublish", volumeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	resolveResp, err := s.resolveNS(ResolveNSParams{
 		datasetPath:     volInfo.Path,
 		configName:      volInfo.ConfigName,
 		IsV13Compatible: volInfo.IsV13VolumeIDVersion,
-	}
-
-	nsProvider, err := s.resolveNS(params)
+	})
 	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			// volume may be a zvol exported over iSCSI or NVMe/TCP
+			err = s.unpublishZvol(volInfo, req.GetNodeId())
+			if err != nil {
+				return nil, err
+			}
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
 		return nil, err
 	}
+	nsProvider := resolveResp.nsProvider
 
-	l.Infof("resolved NS: %s, %+v", nsProvider, params)
+	s.nfsShareMutex.Lock()
+	defer s.nfsShareMutex.Unlock()
 
-	for _, reqC := range volumeCapabilities {
-		supported := validateVolumeCapability(reqC)
-		l.Infof("requested capability: '%s', supported: %t", reqC.GetAccessMode().GetMode(), supported)
-		if !supported {
-			message := fmt.Sprintf("Driver does not support volume capability mode: %s", reqC.GetAccessMode().GetMode())
-			l.Warn(message)
-			return &csi.ValidateVolumeCapabilitiesResponse{
-				Message: message,
-			}, nil
+	filesystem, err := nsProvider.GetFilesystem(volInfo.Path)
+	if err != nil {
+		if ns.IsNotExistNefError(err) {
+			l.Infof("filesystem '%s' not found, that's OK for unpublish request", volInfo.Path)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
+		return nil, status.Errorf(codes.Internal, "Cannot get filesystem '%s': %s", volInfo.Path, err)
 	}
 
-	return &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: supportedVolumeCapabilities,
-			VolumeContext:      volumeContext,
-		},
-	}, nil
-}
+	nodeID := req.GetNodeId()
+	err = s.updatePublishedNodes(nsProvider, volInfo.Path, nodeID, false, false)
+	if err != nil {
+		return nil, err
+	}
 
-// ControllerGetCapabilities - controller capabilities
-func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (
-	*csi.ControllerGetCapabilitiesResponse,
-	error,
-) {
-	s.log.WithField("func", "ControllerGetCapabilities()").Infof("request: '%+v'", req)
+	if !filesystem.SharedOverNfs {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
 
-	var capabilities []*csi.ControllerServiceCapability
-	for _, c := range supportedControllerCapabilities {
-		capabilities = append(capabilities, newControllerServiceCapability(c))
+	// empty node ID means the volume should be unpublished from all nodes, keep the share as is then
+	if len(nodeID) == 0 {
+		l.Infof("node ID is not provided, keep NFS share of volume '%s' as is", volumeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	nodeInfo, err := s.getNodeInfo(nodeID)
+	if err != nil {
+		return nil, err
 	}
-	return &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: capabilities,
-	}, nil
-}
 
-func newControllerServiceCapability(cap csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
-	return &csi.ControllerServiceCapability{
-		Type: &csi.ControllerServiceCapability_Rpc{
-			Rpc: &csi.ControllerServiceCapability_RPC{
-				Type: cap,
-			},
-		},
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	share, err := nefClient.GetNfsShare(filesystem.Path)
+	if err != nil {
+		if ns.IsNotExistNefError(err) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "Cannot get NFS share of '%s': %s", filesystem.Path, err)
 	}
-}
 
-func validateVolumeCapability(requestedVolumeCapability *csi.VolumeCapability) bool {
-	// block is not supported
-	if requestedVolumeCapability.GetBlock() != nil {
-		return false
+	changed := false
+	for i := range share.SecurityContexts {
+		sc := &share.SecurityContexts[i]
+		if containsNfsRule(sc.ReadWriteList, nodeInfo.Address) {
+			sc.ReadWriteList = removeNfsRule(sc.ReadWriteList, nodeInfo.Address)
+			changed = true
+		}
+		if containsNfsRule(sc.ReadOnlyList, nodeInfo.Address) {
+			sc.ReadOnlyList = removeNfsRule(sc.ReadOnlyList, nodeInfo.Address)
+			changed = true
+		}
 	}
 
-	requestedMode := requestedVolumeCapability.GetAccessMode().GetMode()
-	for _, volumeCapability := range supportedVolumeCapabilities {
-		if volumeCapability.GetAccessMode().GetMode() == requestedMode {
-			return true
+	if changed {
+		err = nefClient.UpdateNfsShare(filesystem.Path, nef.UpdateNfsShareParams{
+			SecurityContexts: share.SecurityContexts,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot update NFS share of '%s': %s", filesystem.Path, err)
 		}
+		l.Infof("node '%s' (%s) is removed from NFS share of volume '%s'", nodeInfo.Name, nodeInfo.Address, volumeID)
 	}
-	return false
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (s *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
-	*csi.GetCapacityResponse,
-	error,
-) {
-	l := s.log.WithField("func", "GetCapacity()")
-	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+// unpublishZvol - remove zvol LUN mapping to the node host group or node host NQN from NVMe subsystem
+// host list, not existing zvol is not an error
+func (s *ControllerServer) unpublishZvol(volInfo VolumeInfo, nodeID string) error {
+	l := s.log.WithField("func", "unpublishZvol()")
 
-	reqParams := req.GetParameters()
-	if reqParams == nil {
-		reqParams = make(map[string]string)
+	zvolResp, _, err := s.resolveZvol(volInfo)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			l.Infof("volume '%s' not found, that's OK for unpublish request", volInfo.Path)
+			return nil
+		}
+		return err
+	}
+	err = s.updatePublishedNodes(zvolResp.nsProvider, volInfo.Path, nodeID, false, true)
+	if err != nil {
+		return err
+	}
+	cfg := s.config.NsMap[zvolResp.configName]
+	protocol, err := s.getZvolProtocol(zvolResp.nsProvider, cfg, volInfo.Path)
+	if err != nil {
+		return err
+	} else if !isZvolProtocol(protocol) {
+		return nil
 	}
 
-	// get dataset path from runtime params, set default if not specified
-	datasetPath := ""
-	if v, ok := reqParams["dataset"]; ok {
-		datasetPath = v
+	// empty node ID means the volume should be unpublished from all nodes, keep LUN mappings and
+	// the host list as is then
+	if len(nodeID) == 0 {
+		l.Infof("node ID is not provided, keep %s access of volume '%s' as is", protocol, volInfo.Path)
+		return nil
 	}
 
-	params := ResolveNSParams{
-		datasetPath: datasetPath,
+	if protocol == ProtocolISCSI {
+		hostGroupName := getISCSIHostGroupName(nodeID)
+		lunMappings, err := zvolResp.nsProvider.GetLunMappings(ns.GetLunMappingsParams{
+			Volume:    volInfo.Path,
+			HostGroup: hostGroupName,
+		})
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot get LUN mappings of '%s': %s", volInfo.Path, err)
+		}
+		for _, lunMapping := range lunMappings {
+			err = zvolResp.nsProvider.DestroyLunMapping(lunMapping.Id)
+			if err != nil && !ns.IsNotExistNefError(err) {
+				return status.Errorf(codes.Internal, "Cannot delete LUN mapping '%s': %s", lunMapping.Id, err)
+			}
+		}
+		l.Infof("volume '%s' is unmapped from node '%s' host group '%s'", volInfo.Path, nodeID, hostGroupName)
+		return nil
 	}
-	resolveResp, err := s.resolveNS(params)
+
+	nefClient, err := nef.New(zvolResp.nsProvider)
 	if err != nil {
-		return nil, err
+		return status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	subsystemName := getNVMeSubsystemName(cfg, filepath.Base(volInfo.Path))
+	hostNQN := nvme.HostNQN(nodeID)
+	err = nefClient.RemoveNvmeofSubsystemHost(subsystemName, hostNQN)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			"Cannot remove host '%s' from NVMe subsystem '%s': %s",
+			hostNQN,
+			subsystemName,
+			err,
+		)
 	}
 
-	nsProvider := resolveResp.nsProvider
-	filesystem, err := nsProvider.GetFilesystem(resolveResp.datasetPath)
+	l.Infof("node '%s' is removed from NVMe subsystem '%s'", nodeID, subsystemName)
+	return nil
+}
+
+// nfsRuleEntityNone - NS access list placeholder for the list without entities
+const nfsRuleEntityNone = "none"
+
+// newNfsRule - NS access list rule: IP address is a network (host network if mask is not set),
+// anything else is an FQDN
+func newNfsRule(address string, mask int) ns.NfsRuleList {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ns.NfsRuleList{Etype: "fqdn", Entity: address}
+	}
+	if mask == 0 {
+		mask = 32
+		if ip.To4() == nil {
+			mask = 128
+		}
+	}
+	return ns.NfsRuleList{Etype: "network", Entity: address, Mask: mask}
+}
+
+// getNodeInfo - node address to add to NFS share access lists: node IP set by node driver as node annotation,
+// node name is used as FQDN if IP isn't published or node doesn't exist
+func (s *ControllerServer) getNodeInfo(nodeID string) (NodeInfo, error) {
+	l := s.log.WithField("func", "getNodeInfo()")
+
+	nodeInfo := NodeInfo{Name: nodeID, Address: nodeID}
+	if s.k8sClient == nil {
+		return nodeInfo, nil
+	}
+
+	annotations, err := s.k8sClient.GetNodeAnnotations(nodeID)
 	if err != nil {
-		return nil, err
+		if k8s.IsNotFoundError(err) {
+			l.Warnf("node '%s' not found, use node name as NFS share access list entity", nodeID)
+			return nodeInfo, nil
+		}
+		return nodeInfo, status.Errorf(codes.Unavailable, "Cannot get IP of node '%s': %s", nodeID, err)
+	}
+	if value, ok := annotations[AnnotationNodeIP]; ok {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nodeInfo, status.Errorf(
+				codes.Internal,
+				"Cannot get IP of node '%s': annotation '%s' value '%s' is not an IP address",
+				nodeID,
+				AnnotationNodeIP,
+				value,
+			)
+		}
+		nodeInfo.Address = ip.String()
 	}
 
-	availableCapacity := filesystem.GetReferencedQuotaSize()
-	l.Infof("Available capacity: '%+v' bytes", availableCapacity)
-	return &csi.GetCapacityResponse{
-		AvailableCapacity: availableCapacity,
-	}, nil
+	return nodeInfo, nil
 }
 
-// ControllerPublishVolume - not supported
-func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (
-	*csi.ControllerPublishVolumeResponse,
-	error,
-) {
-	s.log.WithField("func", "ControllerPublishVolume()").Warnf("request: '%+v' - not implemented", req)
-	return nil, status.Error(codes.Unimplemented, "")
+func containsNfsRule(list []ns.NfsRuleList, entity string) bool {
+	for _, rule := range list {
+		if rule.Entity == entity {
+			return true
+		}
+	}
+	return false
 }
 
-// ControllerUnpublishVolume - not supported
-func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (
-	*csi.ControllerUnpublishVolumeResponse,
+// addNfsRule - add rule to NS access list, replaces "none" placeholder
+func addNfsRule(list []ns.NfsRuleList, rule ns.NfsRuleList) []ns.NfsRuleList {
+	newList := []ns.NfsRuleList{}
+	for _, r := range list {
+		if r.Entity != nfsRuleEntityNone {
+			newList = append(newList, r)
+		}
+	}
+	return append(newList, rule)
+}
+
+// removeNfsRule - remove entity from NS access list, puts "none" placeholder if the list becomes empty
+func removeNfsRule(list []ns.NfsRuleList, entity string) []ns.NfsRuleList {
+	newList := []ns.NfsRuleList{}
+	for _, r := range list {
+		if r.Entity != entity {
+			newList = append(newList, r)
+		}
+	}
+	if len(newList) == 0 {
+		newList = append(newList, ns.NfsRuleList{Etype: "fqdn", Entity: nfsRuleEntityNone})
+	}
+	return newList
+}
+
+// ControllerModifyVolume - mutable volume parameters are not supported
+func (s *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (
+	*csi.ControllerModifyVolumeResponse,
 	error,
 ) {
-	s.log.WithField("func", "ControllerUnpublishVolume()").Warnf("request: '%+v' - not implemented", req)
-	return nil, status.Error(codes.Unimplemented, "")
+	s.log.WithField("func", "ControllerModifyVolume()").Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+	return nil, status.Error(codes.Unimplemented, "ControllerModifyVolume is not supported")
 }
 
 func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (
@@ -1377,19 +4750,64 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 
 	resolveResp, err := s.resolveNS(params)
 	if err != nil {
-		return nil, err
+		if status.Code(err) != codes.NotFound {
+			return nil, err
+		}
+		// volume may be a zvol of iSCSI or NVMe/TCP volume
+		zvolResp, _, zvolErr := s.resolveZvol(volInfo)
+		if zvolErr != nil {
+			return nil, zvolErr
+		}
+		capacityBytes = getZvolSize(capacityBytes)
+		l.Infof("expanding zvol %+v to %+v bytes", volInfo.Path, capacityBytes)
+		err = zvolResp.nsProvider.UpdateVolume(volInfo.Path, ns.UpdateVolumeParams{
+			VolumeSize: capacityBytes,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to expand volume %s: %s", volInfo.Path, err)
+		}
+		// node rescans the device and grows its filesystem in NodeExpandVolume()
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         capacityBytes,
+			NodeExpansionRequired: true,
+		}, nil
 	}
 	nsProvider := resolveResp.nsProvider
 
+	nefClient, err := nef.New(nsProvider)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+	}
+	userProperties, err := nefClient.GetFilesystemUserProperties(volInfo.Path)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get user properties of '%s': %s", volInfo.Path, err)
+	}
+
+	fields := map[string]interface{}{
+		"referencedQuotaSize": capacityBytes,
+	}
+	// thick volume keeps the whole size reserved, explicit reservation of thin volume is kept as is
+	if userProperties[userPropertyProvisioningType] == ProvisioningTypeThick {
+		fields["referencedReservationSize"] = capacityBytes
+	}
+
 	l.Infof("expanding volume %+v to %+v bytes", volInfo.Path, capacityBytes)
-	err = nsProvider.UpdateFilesystem(volInfo.Path, ns.UpdateFilesystemParams{
-		ReferencedQuotaSize: capacityBytes,
-	})
+	err = nefClient.SetFilesystemProperties(volInfo.Path, fields)
 	if err != nil {
+		if nef.IsNoSpaceNefError(err) {
+			return nil, status.Errorf(
+				codes.ResourceExhausted,
+				"Not enough space to expand thick volume %s: %s",
+				volInfo.Path,
+				err,
+			)
+		}
 		return nil, fmt.Errorf("Failed to expand volume volume %s: %s", volInfo.Path, err)
 	}
+	// NFS/SMB clients see the new quota right away
 	return &csi.ControllerExpandVolumeResponse{
-		CapacityBytes: capacityBytes,
+		CapacityBytes:         capacityBytes,
+		NodeExpansionRequired: false,
 	}, nil
 }
 
@@ -1434,10 +4852,19 @@ func NewControllerServer(driver *Driver) (*ControllerServer, error) {
 		resolverMap[name] = *nsResolver
 	}
 
+	k8sClient, err := k8s.NewInClusterClient()
+	if err != nil {
+		l.Warnf("Cannot create Kubernetes client, node names are used as NFS share access list entities: %s", err)
+	}
+
 	l.Infof("Resolver map: %+v", resolverMap)
 	return &ControllerServer{
-		nsResolverMap: resolverMap,
-		config:        driver.config,
-		log:           l,
+		nsResolverMap:       resolverMap,
+		config:              driver.config,
+		log:                 l,
+		applianceTopology:   driver.applianceTopology,
+		placer:              placement.New(),
+		k8sClient:           k8sClient,
+		datasetVolumesCache: map[string]datasetVolumesCacheEntry{},
 	}, nil
 }
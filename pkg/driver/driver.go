@@ -36,10 +36,15 @@ var DateTime string
 type Driver struct {
 	role     Role
 	nodeID   string
+	nodeIP   string
+	zone     string
 	endpoint string
 	config   *config.Config
 	server   *grpc.Server
 	log      *logrus.Entry
+
+	// report NexentaStor reachability as topology segments
+	applianceTopology bool
 }
 
 // Run - run the driver
@@ -83,6 +88,8 @@ func (d *Driver) Run() error {
 			return fmt.Errorf("Failed to create ControllerServer: %s", err)
 		}
 		csi.RegisterControllerServer(d.server, controllerServer)
+		csi.RegisterGroupControllerServer(d.server, NewGroupControllerServer(controllerServer))
+		go controllerServer.runTrashReaper()
 	}
 
 	if d.role.IsNode() {
@@ -102,6 +109,10 @@ func (d *Driver) Run() error {
 // - in case of cluster, check if provided addresses belong to the same cluster
 func (d *Driver) Validate() error {
 	for _, cfg := range d.config.NsMap {
+		if !cfg.HasCredentials() {
+			// node driver of controller sharing mode has no access to NexentaStor
+			continue
+		}
 		nsResolver, err := ns.NewResolver(ns.ResolverArgs{
 			Address:            cfg.Address,
 			Username:           cfg.Username,
@@ -161,9 +172,13 @@ func (d *Driver) grpcErrorHandler(
 type Args struct {
 	Role     Role
 	NodeID   string
+	NodeIP   string
+	Zone     string
 	Endpoint string
 	Config   *config.Config
 	Log      *logrus.Entry
+
+	ApplianceTopology bool
 }
 
 // NewDriver - new driver instance
@@ -180,9 +195,13 @@ func NewDriver(args Args) (*Driver, error) {
 	d := &Driver{
 		role:     args.Role,
 		nodeID:   args.NodeID,
+		nodeIP:   args.NodeIP,
+		zone:     args.Zone,
 		endpoint: args.Endpoint,
 		config:   args.Config,
 		log:      l,
+
+		applianceTopology: args.ApplianceTopology,
 	}
 
 	return d, nil
@@ -0,0 +1,456 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	timestamp "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/nef"
+)
+
+// supportedGroupControllerCapabilities - driver group controller capabilities
+var supportedGroupControllerCapabilities = []csi.GroupControllerServiceCapability_RPC_Type{
+	csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+}
+
+// GroupControllerServer - k8s csi driver group controller server.
+// Group snapshot is a recursive ZFS snapshot of the parent dataset of member volumes, so all member
+// snapshots are taken at the same transaction, the group must contain all datasets of the parent.
+// Group snapshot ID is "configName:parentPath@name", member snapshot IDs are regular snapshot IDs
+// "configName:volumePath@name".
+type GroupControllerServer struct {
+	controller *ControllerServer
+	log        *logrus.Entry
+}
+
+// GroupControllerGetCapabilities - group controller capabilities
+func (s *GroupControllerServer) GroupControllerGetCapabilities(
+	ctx context.Context,
+	req *csi.GroupControllerGetCapabilitiesRequest,
+) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	s.log.WithField("func", "GroupControllerGetCapabilities()").Infof("request: '%+v'", req)
+
+	var capabilities []*csi.GroupControllerServiceCapability
+	for _, c := range supportedGroupControllerCapabilities {
+		capabilities = append(capabilities, &csi.GroupControllerServiceCapability{
+			Type: &csi.GroupControllerServiceCapability_Rpc{
+				Rpc: &csi.GroupControllerServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+	return &csi.GroupControllerGetCapabilitiesResponse{
+		Capabilities: capabilities,
+	}, nil
+}
+
+// CreateVolumeGroupSnapshot - takes recursive snapshot of member volumes parent dataset,
+// snapshots of the parent itself and of other volumes are destroyed, so only member snapshots are left
+func (s *GroupControllerServer) CreateVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.CreateVolumeGroupSnapshotRequest,
+) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	l := s.log.WithField("func", "CreateVolumeGroupSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	err := s.controller.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	name := req.GetName()
+	if len(name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot name must be provided")
+	}
+	sourceVolumeIDs := req.GetSourceVolumeIds()
+	if len(sourceVolumeIDs) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot source volume IDs must be provided")
+	}
+
+	// all volumes must be children of one dataset on one NexentaStor to be snapshotted atomically
+	var resolveResp ResolveNSResponse
+	parentPath := ""
+	members := map[string]string{}
+	for _, sourceVolumeID := range sourceVolumeIDs {
+		volInfo, err := ParseVolumeID(sourceVolumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Source volume ID '%s' is invalid: %s", sourceVolumeID, err)
+		}
+		volumeResolveResp, err := s.controller.resolveNS(ResolveNSParams{
+			datasetPath:     volInfo.Path,
+			configName:      volInfo.ConfigName,
+			IsV13Compatible: volInfo.IsV13VolumeIDVersion,
+		})
+		if err != nil {
+			return nil, err
+		}
+		volumeParentPath := filepath.Dir(volInfo.Path)
+		if parentPath == "" {
+			resolveResp = volumeResolveResp
+			parentPath = volumeParentPath
+		} else if volumeResolveResp.configName != resolveResp.configName || volumeParentPath != parentPath {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"Volumes of a group snapshot must share a parent dataset on one NexentaStor, "+
+					"volume '%s' is in [%s]:%s, but volume '%s' is in [%s]:%s",
+				sourceVolumeIDs[0],
+				resolveResp.configName,
+				parentPath,
+				sourceVolumeID,
+				volumeResolveResp.configName,
+				volumeParentPath,
+			)
+		}
+		members[volInfo.Path] = sourceVolumeID
+	}
+	nsProvider := resolveResp.nsProvider
+
+	// volumes of all namespaces share the default dataset with flat layout, so a group snapshot of it
+	// would have to include every volume of the NexentaStor
+	cfg := s.controller.config.NsMap[resolveResp.configName]
+	if parentPath == cfg.DefaultDataset || !strings.Contains(parentPath, "/") {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"Group snapshot volumes must be in a dedicated parent dataset, volumes are in '%s' on [%s]: "+
+				"set 'namespaceDatasets' config option or 'dataset' StorageClass parameter",
+			parentPath,
+			resolveResp.configName,
+		)
+	}
+
+	groupSnapshotPath := fmt.Sprintf("%s@%s", parentPath, name)
+	groupSnapshotID := fmt.Sprintf("%s:%s", resolveResp.configName, groupSnapshotPath)
+
+	snapshots, err := s.getGroupSnapshots(nsProvider, parentPath, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		if err := s.checkGroupMembers(nsProvider, parentPath, members); err != nil {
+			return nil, err
+		}
+		nefClient, err := nef.New(nsProvider)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot create NEF client: %s", err)
+		}
+		err = nefClient.CreateSnapshot(nef.CreateSnapshotParams{
+			Path:      groupSnapshotPath,
+			Recursive: true,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot create snapshot '%s': %s", groupSnapshotPath, err)
+		}
+		snapshots, err = s.getGroupSnapshots(nsProvider, parentPath, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// parent snapshot is destroyed the last, so it exists until the group snapshot is completely created
+	pruned := true
+	for _, snapshot := range snapshots {
+		if snapshot.Path == groupSnapshotPath {
+			pruned = false
+		}
+	}
+
+	memberSnapshots := []ns.Snapshot{}
+	notMemberSnapshots := []ns.Snapshot{}
+	for _, snapshot := range snapshots {
+		if _, ok := members[snapshot.Parent]; ok {
+			memberSnapshots = append(memberSnapshots, snapshot)
+		} else if snapshot.Path != groupSnapshotPath {
+			notMemberSnapshots = append(notMemberSnapshots, snapshot)
+		}
+	}
+
+	if pruned && (len(notMemberSnapshots) != 0 || len(memberSnapshots) != len(members)) {
+		return nil, status.Errorf(
+			codes.AlreadyExists,
+			"Group snapshot '%s' already exists with different volumes",
+			groupSnapshotID,
+		)
+	} else if !pruned {
+		for _, snapshot := range notMemberSnapshots {
+			if err := s.destroyGroupSnapshotMember(nsProvider, snapshot.Path); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.destroyGroupSnapshotMember(nsProvider, groupSnapshotPath); err != nil {
+			return nil, err
+		}
+	}
+
+	groupSnapshot, err := s.getCSIGroupSnapshot(nsProvider, resolveResp.configName, groupSnapshotID, memberSnapshots)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range groupSnapshot.Snapshots {
+		// keep volume IDs as they were requested
+		volInfo, err := ParseVolumeID(snapshot.SourceVolumeId)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"Cannot parse source volume ID '%s' of snapshot '%s': %s",
+				snapshot.SourceVolumeId,
+				snapshot.SnapshotId,
+				err,
+			)
+		}
+		snapshot.SourceVolumeId = members[volInfo.Path]
+	}
+
+	l.Infof("group snapshot '%s' of %d volume(s) has been created", groupSnapshotID, len(memberSnapshots))
+	return &csi.CreateVolumeGroupSnapshotResponse{
+		GroupSnapshot: groupSnapshot,
+	}, nil
+}
+
+// GetVolumeGroupSnapshot - returns group snapshot with its member snapshots
+func (s *GroupControllerServer) GetVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.GetVolumeGroupSnapshotRequest,
+) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	l := s.log.WithField("func", "GetVolumeGroupSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	err := s.controller.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if len(groupSnapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot ID must be provided")
+	}
+	configName, parentPath, name, err := parseGroupSnapshotID(groupSnapshotID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Group snapshot '%s' not found: %s", groupSnapshotID, err)
+	}
+
+	resolveResp, err := s.controller.resolveNS(ResolveNSParams{
+		datasetPath: parentPath,
+		configName:  configName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nsProvider := resolveResp.nsProvider
+
+	snapshots, err := s.getGroupSnapshots(nsProvider, parentPath, name)
+	if err != nil {
+		return nil, err
+	}
+	memberSnapshots := []ns.Snapshot{}
+	memberSnapshotIDs := map[string]bool{}
+	for _, snapshot := range snapshots {
+		if snapshot.Parent != parentPath {
+			memberSnapshots = append(memberSnapshots, snapshot)
+			memberSnapshotIDs[fmt.Sprintf("%s:%s", configName, snapshot.Path)] = true
+		}
+	}
+	if len(memberSnapshots) == 0 {
+		return nil, status.Errorf(codes.NotFound, "Group snapshot '%s' not found", groupSnapshotID)
+	}
+	for _, snapshotID := range req.GetSnapshotIds() {
+		if !memberSnapshotIDs[snapshotID] {
+			return nil, status.Errorf(
+				codes.NotFound,
+				"Snapshot '%s' is not found in group snapshot '%s'",
+				snapshotID,
+				groupSnapshotID,
+			)
+		}
+	}
+
+	groupSnapshot, err := s.getCSIGroupSnapshot(nsProvider, configName, groupSnapshotID, memberSnapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.GetVolumeGroupSnapshotResponse{
+		GroupSnapshot: groupSnapshot,
+	}, nil
+}
+
+// DeleteVolumeGroupSnapshot - destroys all snapshots of the group
+func (s *GroupControllerServer) DeleteVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.DeleteVolumeGroupSnapshotRequest,
+) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	l := s.log.WithField("func", "DeleteVolumeGroupSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	err := s.controller.refreshConfig("")
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if len(groupSnapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot ID must be provided")
+	}
+	configName, parentPath, name, err := parseGroupSnapshotID(groupSnapshotID)
+	if err != nil {
+		l.Infof("group snapshot '%s' not found, that's OK for deletion request: %s", groupSnapshotID, err)
+		return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+	}
+
+	resolveResp, err := s.controller.resolveNS(ResolveNSParams{
+		datasetPath: parentPath,
+		configName:  configName,
+	})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			l.Infof("group snapshot '%s' not found, that's OK for deletion request", groupSnapshotID)
+			return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+		}
+		return nil, err
+	}
+	nsProvider := resolveResp.nsProvider
+
+	snapshots, err := s.getGroupSnapshots(nsProvider, parentPath, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if err := s.destroyGroupSnapshotMember(nsProvider, snapshot.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	l.Infof("group snapshot '%s' has been deleted", groupSnapshotID)
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// checkGroupMembers - recursive snapshot of the parent is taken of all its datasets, NexentaStor can't
+// snapshot a part of them atomically, so filesystems and zvols of the parent must all be group members
+func (s *GroupControllerServer) checkGroupMembers(
+	nsProvider ns.ProviderInterface,
+	parentPath string,
+	members map[string]string,
+) error {
+	filesystems, err := nsProvider.GetFilesystems(parentPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get filesystems of '%s': %s", parentPath, err)
+	}
+	volumes, err := nsProvider.GetVolumes(parentPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get volumes of '%s': %s", parentPath, err)
+	}
+
+	paths := []string{}
+	for _, filesystem := range filesystems {
+		paths = append(paths, filesystem.Path)
+	}
+	for _, volume := range volumes {
+		paths = append(paths, volume.Path)
+	}
+	for _, path := range paths {
+		if _, ok := members[path]; !ok {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"Group snapshot must contain all volumes of parent dataset '%s', but '%s' is not in the group",
+				parentPath,
+				path,
+			)
+		}
+	}
+	return nil
+}
+
+// getGroupSnapshots - snapshots of the parent dataset and its descendants with the group snapshot name
+func (s *GroupControllerServer) getGroupSnapshots(nsProvider ns.ProviderInterface, parentPath, name string) (
+	[]ns.Snapshot,
+	error,
+) {
+	snapshots, err := nsProvider.GetSnapshots(parentPath, true)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get snapshot list for '%s': %s", parentPath, err)
+	}
+	groupSnapshots := []ns.Snapshot{}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			groupSnapshots = append(groupSnapshots, snapshot)
+		}
+	}
+	return groupSnapshots, nil
+}
+
+func (s *GroupControllerServer) destroyGroupSnapshotMember(nsProvider ns.ProviderInterface, snapshotPath string) error {
+	err := nsProvider.DestroySnapshot(snapshotPath)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		message := fmt.Sprintf("Failed to delete snapshot '%s'", snapshotPath)
+		if ns.IsBusyNefError(err) {
+			message += ", it has dependent filesystem"
+		}
+		return status.Errorf(codes.Internal, "%s: %s", message, err)
+	}
+	return nil
+}
+
+// getCSIGroupSnapshot - group snapshot is ready when all its member snapshots are ready
+func (s *GroupControllerServer) getCSIGroupSnapshot(
+	nsProvider ns.ProviderInterface,
+	configName string,
+	groupSnapshotID string,
+	memberSnapshots []ns.Snapshot,
+) (*csi.VolumeGroupSnapshot, error) {
+	groupSnapshot := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: groupSnapshotID,
+		Snapshots:       []*csi.Snapshot{},
+		ReadyToUse:      true,
+	}
+	for _, snapshot := range memberSnapshots {
+		// snapshot list doesn't return snapshot size, it's requested per member snapshot
+		properties, err := s.controller.getSnapshotProperties(nsProvider, snapshot.Path)
+		if err != nil {
+			return nil, err
+		}
+		csiSnapshot := convertNSSnapshotToCSISnapshot(snapshot, properties, configName).Snapshot
+		csiSnapshot.GroupSnapshotId = groupSnapshotID
+		groupSnapshot.Snapshots = append(groupSnapshot.Snapshots, csiSnapshot)
+		groupSnapshot.ReadyToUse = groupSnapshot.ReadyToUse && csiSnapshot.ReadyToUse
+		if groupSnapshot.CreationTime == nil {
+			groupSnapshot.CreationTime = &timestamp.Timestamp{
+				Seconds: snapshot.CreationTime.Unix(),
+			}
+		}
+	}
+	return groupSnapshot, nil
+}
+
+// parseGroupSnapshotID - parse "configName:parentPath@name" group snapshot ID
+func parseGroupSnapshotID(groupSnapshotID string) (configName, parentPath, name string, err error) {
+	splittedID := strings.Split(groupSnapshotID, "@")
+	if len(splittedID) != 2 || splittedID[1] == "" {
+		return "", "", "", fmt.Errorf("Unknown group snapshot ID format: %s", groupSnapshotID)
+	}
+	volInfo, err := ParseVolumeID(splittedID[0])
+	if err != nil || volInfo.IsV13VolumeIDVersion {
+		return "", "", "", fmt.Errorf("Unknown group snapshot ID format: %s", groupSnapshotID)
+	}
+	return volInfo.ConfigName, volInfo.Path, splittedID[1], nil
+}
+
+// NewGroupControllerServer - create an instance of group controller server,
+// it uses NexentaStor resolvers of the controller server
+func NewGroupControllerServer(controllerServer *ControllerServer) *GroupControllerServer {
+	l := controllerServer.log.WithField("cmp", "GroupControllerServer")
+	l.Info("create new GroupControllerServer...")
+
+	return &GroupControllerServer{
+		controller: controllerServer,
+		log:        l,
+	}
+}
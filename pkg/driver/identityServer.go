@@ -68,7 +68,15 @@ func (ids *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.G
 						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
 					},
 				},
+			}, {
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE,
+					},
+				},
 			},
+			// NFS/SMB quotas and zvols are expanded by the controller, zvol filesystems are grown
+			// by the node in NodeExpandVolume(), ext4 and xfs can be grown while mounted
 			{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
@@ -1,29 +1,35 @@
-//TODO Consider to add NodeStageVolume() method:
-// - called by k8s to temporarily mount the volume to a staging path
-// - staging path is a global directory on the node
-// - k8s allows user to use a single volume by multiple pods (for NFS)
-// - if all pods run on the same node the single mount point will be used by all of them.
-
 package driver
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
 
 	"github.com/Nexenta/go-nexentastor/pkg/ns"
 	"github.com/Nexenta/nexentastor-csi-driver/pkg/arrays"
 	"github.com/Nexenta/nexentastor-csi-driver/pkg/config"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/connection"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/iscsi"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/k8s"
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/nvme"
 )
 
 // mount options regexps
@@ -36,12 +42,44 @@ var regexpMountOptionNolock = regexp.MustCompile("^nolock.+$")
 
 const DefaultMountPointPermissions = 0777
 
+// statfsTimeout - max time to wait for volume stats, a hung NFS mount doesn't respond at all
+const statfsTimeout = 10 * time.Second
+
+// blockDeviceTimeout - max time to wait for iSCSI LUN or NVMe namespace device after connection
+const blockDeviceTimeout = 30 * time.Second
+
+// filesystems for block volumes with mount access type, ext4 is used if not set in volume capability
+const defaultBlockFsType = "ext4"
+
+var supportedBlockFsTypes = []string{"ext4", "xfs"}
+
+// applianceReachabilityTimeout - timeout to connect to NexentaStor to report it in node topology
+const applianceReachabilityTimeout = 5 * time.Second
+
+var errStatfsTimeout = errors.New("statfs timeout exceeded")
+var errStatfsPending = errors.New("previous statfs call is still pending")
+
 // NodeServer - k8s csi driver node server
 type NodeServer struct {
 	nodeID        string
+	nodeIP        string
+	zone          string
 	nsResolverMap map[string]*ns.Resolver
 	config        *config.Config
 	log           *logrus.Entry
+
+	// report NexentaStor reachability in node topology
+	applianceTopology bool
+
+	iscsiConnector *iscsi.Connector
+	nvmeConnector  *nvme.Connector
+
+	// sets node IP annotation, nil if the driver doesn't run in Kubernetes
+	k8sClient *k8s.Client
+
+	// volume paths with statfs() call still blocked after timeout
+	statfsPending      map[string]bool
+	statfsPendingMutex sync.Mutex
 }
 
 func (s *NodeServer) refreshConfig(secret string) error {
@@ -52,6 +90,11 @@ func (s *NodeServer) refreshConfig(secret string) error {
 	if changed {
 		s.log.Info("config has been changed, updating...")
 		for name, cfg := range s.config.NsMap {
+			if !cfg.HasCredentials() {
+				// volumes of this NexentaStor are shared by controller, no REST API access from the node
+				delete(s.nsResolverMap, name)
+				continue
+			}
 			s.nsResolverMap[name], err = ns.NewResolver(ns.ResolverArgs{
 				Address:            cfg.Address,
 				Username:           cfg.Username,
@@ -70,7 +113,15 @@ func (s *NodeServer) refreshConfig(secret string) error {
 func (s *NodeServer) resolveNS(configName, datasetPath string) (nsProvider ns.ProviderInterface, err error, name string) {
 	l := s.log.WithField("func", "resolveNS()")
 	l.Infof("configName: %+v, datasetPath: %+v", configName, datasetPath)
-	resolver := s.nsResolverMap[configName]
+	resolver, ok := s.nsResolverMap[configName]
+	if !ok {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"No NexentaStor credentials for config '%s' on the node, volume '%s' must be shared by controller",
+			configName,
+			datasetPath,
+		), ""
+	}
 	nsProvider, err = resolver.Resolve(datasetPath)
 	if err != nil {
 		code := codes.Internal
@@ -106,16 +157,87 @@ func (s *NodeServer) GetMountPointPermissions(volumeContext map[string]string) (
 
 // NodeGetInfo - get node info
 func (s *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	s.log.WithField("func", "NodeGetInfo()").Infof("request: '%+v'", req)
+	l := s.log.WithField("func", "NodeGetInfo()")
+	l.Infof("request: '%+v'", req)
+
+	segments := map[string]string{}
+	if len(s.zone) > 0 {
+		segments[TopologyKeyZone] = s.zone
+	}
+	// reachability is checked once on node driver registration, kubelet keeps the segments as node labels
+	// until the node driver is registered again (pod restart), they don't follow network changes
+	if s.applianceTopology {
+		for name, reachable := range getAppliancesReachability(s.config.NsMap) {
+			l.Infof("NexentaStor '%s' is reachable: %t", name, reachable)
+			segments[getApplianceTopologyKey(name)] = strconv.FormatBool(reachable)
+		}
+	}
+
+	// node IP is set as node annotation, so controller knows what to add to NFS share ACL on publish,
+	// it's not a topology segment: every node would become a separate topology domain
+	if len(s.nodeIP) > 0 && s.k8sClient != nil {
+		if err := s.k8sClient.SetNodeAnnotation(s.nodeID, AnnotationNodeIP, s.nodeIP); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "Cannot publish node IP '%s': %s", s.nodeIP, err)
+		}
+		l.Infof("node IP '%s' is set as '%s' node annotation", s.nodeIP, AnnotationNodeIP)
+	}
 
 	return &csi.NodeGetInfoResponse{
 		NodeId: s.nodeID,
 		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{},
+			Segments: segments,
 		},
 	}, nil
 }
 
+// getAppliancesReachability - check all NexentaStors in parallel, so registration takes one connection timeout
+// at most, returns config name to reachability map
+func getAppliancesReachability(nsMap map[string]config.NsData) map[string]bool {
+	result := make(map[string]bool, len(nsMap))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, cfg := range nsMap {
+		wg.Add(1)
+		go func(name string, cfg config.NsData) {
+			defer wg.Done()
+			reachable := isApplianceReachable(cfg)
+			mutex.Lock()
+			result[name] = reachable
+			mutex.Unlock()
+		}(name, cfg)
+	}
+	wg.Wait()
+	return result
+}
+
+// isApplianceReachable - check TCP connection to NexentaStor data IP (NFS or SMB port),
+// REST API address is checked if data IP is not set
+func isApplianceReachable(cfg config.NsData) bool {
+	var address string
+	if cfg.DefaultDataIP != "" {
+		port := "2049"
+		if cfg.DefaultMountFsType == config.FsTypeCIFS {
+			port = "445"
+		}
+		address = net.JoinHostPort(cfg.DefaultDataIP, port)
+	} else if cfg.Address != "" {
+		restURL, err := url.Parse(strings.Split(cfg.Address, ",")[0])
+		if err != nil {
+			return false
+		}
+		address = restURL.Host
+	} else {
+		return false
+	}
+
+	conn, err := net.DialTimeout("tcp", address, applianceReachabilityTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
 // NodeGetCapabilities - get node capabilities
 func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (
 	*csi.NodeGetCapabilitiesResponse,
@@ -125,24 +247,45 @@ func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
-			//TODO re-enable the capability when NodeGetVolumeStats() validates volume path.
-			// {
-			//  Type: &csi.NodeServiceCapability_Rpc{
-			//      Rpc: &csi.NodeServiceCapability_RPC{
-			//          Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
-			//      },
-			//  },
-			// },
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
-// NodePublishVolume - mounts NS fs to the node
-func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (
-	*csi.NodePublishVolumeResponse,
+// NodeStageVolume - mounts NS fs to the global staging path on the node,
+// the staging mount is shared by all pods on this node (see NodePublishVolume)
+func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (
+	*csi.NodeStageVolumeResponse,
 	error,
 ) {
-	l := s.log.WithField("func", "NodePublishVolume()")
+	l := s.log.WithField("func", "NodeStageVolume()")
 	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
 	volumeID := req.GetVolumeId()
@@ -150,9 +293,9 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		return nil, status.Error(codes.InvalidArgument, "req.VolumeId must be provided")
 	}
 
-	targetPath := req.GetTargetPath()
-	if len(targetPath) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "req.TargetPath must be provided")
+	stagingTargetPath := req.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "req.StagingTargetPath must be provided")
 	}
 
 	//TODO validate VolumeCapability
@@ -188,25 +331,59 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		l.Warningf("v13 volumeID `%s` resolved to `%s` config", volumeID, configName)
 	}
 
-	nsProvider, err, configName := s.resolveNS(configName, volumePath)
-	if err != nil {
-		return nil, err
-	}
-	cfg := s.config.NsMap[configName]
-	l.Infof("resolved NS: %s, %s", nsProvider, volumePath)
-
-	// get NexentaStor filesystem information
-	filesystem, err := nsProvider.GetFilesystem(volumePath)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "Cannot find filesystem '%s': %s", volumePath, err)
-	}
-
 	// volume attributes are passed from ControllerServer.CreateVolume()
 	volumeContext := req.GetVolumeContext()
 	if volumeContext == nil {
 		volumeContext = make(map[string]string)
 	}
 
+	// publish context is passed from ControllerServer.ControllerPublishVolume()
+	for k, v := range req.GetPublishContext() {
+		volumeContext[k] = v
+	}
+
+	// zvol exported over iSCSI or NVMe/TCP by controller, the node connects to the target itself
+	if protocol := volumeContext["protocol"]; isZvolProtocol(protocol) {
+		var device string
+		if protocol == ProtocolNVMeTCP {
+			device, err = s.connectNVMeVolume(volumeID, stagingTargetPath, volumeContext)
+		} else {
+			device, err = s.connectISCSIVolume(volumeID, stagingTargetPath, volumeContext)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// raw block device is bind mounted to the target path in NodePublishVolume()
+		if volumeCapability.GetBlock() == nil {
+			err = s.formatAndMountDevice(device, stagingTargetPath, volumeCapability)
+			if err != nil {
+				return nil, err
+			}
+		}
+		l.Infof("%s volume '%s' has been staged to '%s'", protocol, volumeID, stagingTargetPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// mount source is set by controller if it shares volumes itself (`controllerSharing` config option),
+	// in this case the node doesn't call NexentaStor REST API at all
+	mountSource := volumeContext["mountSource"]
+	var nsProvider ns.ProviderInterface
+	var filesystem ns.Filesystem
+	if mountSource == "" {
+		nsProvider, err, configName = s.resolveNS(configName, volumePath)
+		if err != nil {
+			return nil, err
+		}
+		l.Infof("resolved NS: %s, %s", nsProvider, volumePath)
+
+		// get NexentaStor filesystem information
+		filesystem, err = nsProvider.GetFilesystem(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "Cannot find filesystem '%s': %s", volumePath, err)
+		}
+	}
+	cfg := s.config.NsMap[configName]
+
 	// get mount options by this priority (takes first one that found):
 	//  - k8s runtime volume mount options:
 	//      - `k8s.PersistentVolume.spec.mountOptions` definition
@@ -233,9 +410,10 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		}
 	}
 
-	// add "ro" mount option if k8s requests it
-	if req.GetReadonly() {
-		//TODO use https://github.com/kubernetes/kubernetes/blob/master/pkg/volume/util/util.go#L759 ?
+	// staging mount is read-only if k8s requests read-only access mode,
+	// per-pod "ro" flag is applied to bind mounts in NodePublishVolume()
+	readOnly := isReadOnlyAccessMode(volumeCapability)
+	if readOnly {
 		mountOptions = arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionRo, "ro")
 	}
 
@@ -262,17 +440,24 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		fsType = config.FsTypeNFS
 	}
 
+	// volume is shared by ControllerPublishVolume() if `attachRequired: true` is set in CSIDriver object,
+	// node only creates shares if controller doesn't publish volumes
+	controllerPublished := volumeContext["controllerPublished"] == "true"
+
 	// share and mount filesystem with selected type
-	if fsType == config.FsTypeNFS {
-		err = s.mountNFS(req, nsProvider, filesystem, dataIP, mountOptions)
+	if mountSource != "" {
+		l.Infof("volume '%s' is shared by controller, mount source: '%s'", volumeID, mountSource)
+		err = s.mountSharedSource(mountSource, stagingTargetPath, fsType, mountOptions)
+	} else if fsType == config.FsTypeNFS {
+		err = s.mountNFS(stagingTargetPath, readOnly, controllerPublished, nsProvider, filesystem, dataIP, mountOptions)
 	} else if fsType == config.FsTypeCIFS {
-		err = s.mountCIFS(req, nsProvider, filesystem, dataIP, mountOptions)
+		err = s.mountCIFS(stagingTargetPath, readOnly, controllerPublished, nsProvider, filesystem, dataIP, mountOptions)
 	} else {
 		err = status.Errorf(codes.FailedPrecondition, "Unsupported mount filesystem type: '%s'", fsType)
 	}
 	if err != nil {
 		if strings.Contains(err.Error(), "already a mount point") {
-			l.Warnf("Target path '%s' is already a mount point", targetPath)
+			l.Warnf("Staging target path '%s' is already a mount point", stagingTargetPath)
 		} else {
 			return nil, err
 		}
@@ -286,7 +471,7 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	// Set write permissions if not read-only
 	if !arrays.ContainsString(mountOptions, "ro") {
 		l.Infof("Setting mount point permissions to %+v", permissions)
-		err = os.Chmod(targetPath, permissions)
+		err = os.Chmod(stagingTargetPath, permissions)
 		if err != nil {
 			if !strings.Contains(err.Error(), "read-only") {
 				return nil, err
@@ -294,19 +479,129 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		}
 	}
 
+	l.Infof("volume '%s' has been staged to '%s'", volumeID, stagingTargetPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume - umount NS fs from the staging path and delete directory if successful
+func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (
+	*csi.NodeUnstageVolumeResponse,
+	error,
+) {
+	l := s.log.WithField("func", "NodeUnstageVolume()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+	}
+
+	stagingTargetPath := req.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path must be provided")
+	}
+
+	if err := s.doUnmount(stagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	if err := s.disconnectISCSIVolume(volumeID, stagingTargetPath); err != nil {
+		return nil, err
+	}
+	if err := s.disconnectNVMeVolume(volumeID, stagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	l.Infof("volume '%s' has been unstaged from '%s'", volumeID, stagingTargetPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume - bind mounts staged NS fs to the pod's target path
+func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (
+	*csi.NodePublishVolumeResponse,
+	error,
+) {
+	l := s.log.WithField("func", "NodePublishVolume()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "req.VolumeId must be provided")
+	}
+
+	stagingTargetPath := req.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "req.StagingTargetPath must be provided")
+	}
+
+	targetPath := req.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "req.TargetPath must be provided")
+	}
+
+	volumeCapability := req.GetVolumeCapability()
+	if volumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "req.VolumeCapability must be provided")
+	}
+
+	if volumeCapability.GetBlock() != nil {
+		readOnly := req.GetReadonly() || isReadOnlyAccessMode(volumeCapability)
+		err := s.publishBlockVolume(volumeID, stagingTargetPath, targetPath, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		l.Infof("block volume '%s' has been published to '%s'", volumeID, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	mountOptions := []string{"bind"}
+
+	// add "ro" mount option if k8s requests it
+	if req.GetReadonly() || isReadOnlyAccessMode(volumeCapability) {
+		//TODO use https://github.com/kubernetes/kubernetes/blob/master/pkg/volume/util/util.go#L759 ?
+		mountOptions = arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionRo, "ro")
+	}
+
+	err := s.doMount(stagingTargetPath, targetPath, "", mountOptions)
+	if err != nil {
+		if strings.Contains(err.Error(), "already a mount point") {
+			l.Warnf("Target path '%s' is already a mount point", targetPath)
+		} else {
+			return nil, err
+		}
+	}
+
 	l.Infof("volume '%s' has been published to '%s'", volumeID, targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// isReadOnlyAccessMode - returns true if volume capability allows read-only access only
+func isReadOnlyAccessMode(volumeCapability *csi.VolumeCapability) bool {
+	switch volumeCapability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
 func (s *NodeServer) mountNFS(
-	req *csi.NodePublishVolumeRequest,
+	targetPath string,
+	readOnly bool,
+	controllerPublished bool,
 	nsProvider ns.ProviderInterface,
 	filesystem ns.Filesystem,
 	dataIP string,
 	mountOptions []string,
 ) error {
-	// create NFS share if not exists
-	if !filesystem.SharedOverNfs {
+	// create NFS share if not exists, shares of volumes published by controller are created by controller
+	if !filesystem.SharedOverNfs && controllerPublished {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"Filesystem '%s' is not shared over NFS, it must be shared by ControllerPublishVolume",
+			filesystem.Path,
+		)
+	} else if !filesystem.SharedOverNfs {
 		err := nsProvider.CreateNfsShare(ns.CreateNfsShareParams{
 			Filesystem: filesystem.Path,
 		})
@@ -316,7 +611,7 @@ func (s *NodeServer) mountNFS(
 
 		// select read-only or read-write mount options set
 		var aclRuleSet ns.ACLRuleSet
-		if req.GetReadonly() {
+		if readOnly {
 			aclRuleSet = ns.ACLReadOnly
 		} else {
 			aclRuleSet = ns.ACLReadWrite
@@ -332,6 +627,11 @@ func (s *NodeServer) mountNFS(
 	// NFS style mount source
 	mountSource := fmt.Sprintf("%s:%s", dataIP, filesystem.MountPoint)
 
+	return s.doMount(mountSource, targetPath, config.FsTypeNFS, getNFSMountOptions(mountOptions))
+}
+
+// getNFSMountOptions - add default NFS mount options if not specified by user
+func getNFSMountOptions(mountOptions []string) []string {
 	// NFS v3 is used by default if no version specified by user
 	mountOptions = arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionVers, "vers=3")
 
@@ -341,33 +641,32 @@ func (s *NodeServer) mountNFS(
 	}
 
 	// NFS option `timeo=100` is used by default if not specified by user
-	mountOptions = arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionTimeo, "timeo=100")
-
-	return s.doMount(mountSource, req.GetTargetPath(), config.FsTypeNFS, mountOptions)
+	return arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionTimeo, "timeo=100")
 }
 
 func (s *NodeServer) mountCIFS(
-	req *csi.NodePublishVolumeRequest,
+	targetPath string,
+	readOnly bool,
+	controllerPublished bool,
 	nsProvider ns.ProviderInterface,
 	filesystem ns.Filesystem,
 	dataIP string,
 	mountOptions []string,
 ) error {
-	// validate CIFS mount options
-	for _, optionRE := range []*regexp.Regexp{regexpMountOptionUsername, regexpMountOptionPassword} {
-		if len(arrays.FindRegexpIndexesString(mountOptions, optionRE)) == 0 {
-			return status.Errorf(
-				codes.FailedPrecondition,
-				"Options '%s' must be specified for CIFS mount (got options: %v)",
-				optionRE,
-				mountOptions,
-			)
-		}
+	err := validateCIFSMountOptions(mountOptions)
+	if err != nil {
+		return err
 	}
 
-	// create SMB share if not exists
-	if !filesystem.SharedOverSmb {
-		err := nsProvider.CreateSmbShare(ns.CreateSmbShareParams{
+	// create SMB share if not exists, shares of volumes published by controller are created by controller
+	if !filesystem.SharedOverSmb && controllerPublished {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"Filesystem '%s' is not shared over SMB, it must be shared by ControllerPublishVolume",
+			filesystem.Path,
+		)
+	} else if !filesystem.SharedOverSmb {
+		err = nsProvider.CreateSmbShare(ns.CreateSmbShareParams{
 			Filesystem: filesystem.Path,
 			ShareName:  filesystem.GetDefaultSmbShareName(),
 		})
@@ -380,7 +679,7 @@ func (s *NodeServer) mountCIFS(
 
 		// select read-only or read-write mount options set
 		var aclRuleSet ns.ACLRuleSet
-		if req.GetReadonly() {
+		if readOnly {
 			aclRuleSet = ns.ACLReadOnly
 		} else {
 			aclRuleSet = ns.ACLReadWrite
@@ -402,10 +701,329 @@ func (s *NodeServer) mountCIFS(
 	// CIFS style mount source
 	mountSource := fmt.Sprintf("//%s/%s", dataIP, shareName)
 
-	return s.doMount(mountSource, req.GetTargetPath(), config.FsTypeCIFS, mountOptions)
+	return s.doMount(mountSource, targetPath, config.FsTypeCIFS, mountOptions)
+}
+
+// validateCIFSMountOptions - username and password options are required for CIFS mount
+func validateCIFSMountOptions(mountOptions []string) error {
+	for _, optionRE := range []*regexp.Regexp{regexpMountOptionUsername, regexpMountOptionPassword} {
+		if len(arrays.FindRegexpIndexesString(mountOptions, optionRE)) == 0 {
+			return status.Errorf(
+				codes.FailedPrecondition,
+				"Options '%s' must be specified for CIFS mount (got options: %v)",
+				optionRE,
+				mountOptions,
+			)
+		}
+	}
+	return nil
+}
+
+// mountSharedSource - mount volume shared by controller, mount source is taken from volume context
+func (s *NodeServer) mountSharedSource(mountSource, targetPath, fsType string, mountOptions []string) error {
+	switch fsType {
+	case config.FsTypeNFS:
+		return s.doMount(mountSource, targetPath, config.FsTypeNFS, getNFSMountOptions(mountOptions))
+	case config.FsTypeCIFS:
+		err := validateCIFSMountOptions(mountOptions)
+		if err != nil {
+			return err
+		}
+		return s.doMount(mountSource, targetPath, config.FsTypeCIFS, mountOptions)
+	}
+	return status.Errorf(codes.FailedPrecondition, "Unsupported mount filesystem type: '%s'", fsType)
+}
+
+// connectISCSIVolume - log in to iSCSI target of the volume, returns LUN device path
+func (s *NodeServer) connectISCSIVolume(
+	volumeID string,
+	stagingTargetPath string,
+	volumeContext map[string]string,
+) (string, error) {
+	lun, err := strconv.Atoi(volumeContext["lun"])
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid 'lun' in volume context: '%s'", volumeContext["lun"])
+	}
+	// initiator name and LUN are set by ControllerPublishVolume(), LUN is mapped to the node host group
+	conn := iscsi.Connection{
+		Portal:        volumeContext["targetPortal"],
+		Target:        volumeContext["iqn"],
+		Lun:           lun,
+		InitiatorName: volumeContext["initiatorName"],
+	}
+	if conn.Portal == "" || conn.Target == "" {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			"Volume context must contain 'targetPortal' and 'iqn' for iSCSI volume '%s'",
+			volumeID,
+		)
+	}
+
+	device, err := s.iscsiConnector.Connect(conn, blockDeviceTimeout)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Cannot connect iSCSI volume '%s': %s", volumeID, err)
+	}
+	err = connection.Save(getConnectionFile(volumeID, stagingTargetPath, ProtocolISCSI), conn)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Cannot save iSCSI connection of volume '%s': %s", volumeID, err)
+	}
+	return device, nil
+}
+
+// connectNVMeVolume - connect to NVMe/TCP subsystem of the volume, returns namespace device path
+func (s *NodeServer) connectNVMeVolume(
+	volumeID string,
+	stagingTargetPath string,
+	volumeContext map[string]string,
+) (string, error) {
+	conn := nvme.Connection{
+		Portal:       volumeContext["targetPortal"],
+		SubsystemNQN: volumeContext["nqn"],
+		HostNQN:      volumeContext["hostNqn"],
+		NGUID:        volumeContext["nguid"],
+	}
+	if conn.Portal == "" || conn.SubsystemNQN == "" || conn.NGUID == "" {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			"Volume context must contain 'targetPortal', 'nqn' and 'nguid' for NVMe/TCP volume '%s'",
+			volumeID,
+		)
+	}
+	// host NQN is set by ControllerPublishVolume(), it's the same for all volumes of the node
+	if conn.HostNQN == "" {
+		conn.HostNQN = nvme.HostNQN(s.nodeID)
+	}
+
+	device, err := s.nvmeConnector.Connect(conn, blockDeviceTimeout)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Cannot connect NVMe/TCP volume '%s': %s", volumeID, err)
+	}
+	err = connection.Save(getConnectionFile(volumeID, stagingTargetPath, ProtocolNVMeTCP), conn)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Cannot save NVMe connection of volume '%s': %s", volumeID, err)
+	}
+	return device, nil
+}
+
+// formatAndMountDevice - format block device if it has no filesystem yet and mount it to the staging path
+func (s *NodeServer) formatAndMountDevice(
+	device string,
+	stagingTargetPath string,
+	volumeCapability *csi.VolumeCapability,
+) error {
+	l := s.log.WithField("func", "formatAndMountDevice()")
+
+	fsType := volumeCapability.GetMount().GetFsType()
+	if fsType == "" {
+		fsType = defaultBlockFsType
+	} else if !arrays.ContainsString(supportedBlockFsTypes, fsType) {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"Unsupported filesystem type '%s' for block volume, supported: %v",
+			fsType,
+			supportedBlockFsTypes,
+		)
+	}
+	mountOptions := volumeCapability.GetMount().GetMountFlags()
+	if isReadOnlyAccessMode(volumeCapability) {
+		mountOptions = arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionRo, "ro")
+	}
+
+	mounter := &mount.SafeFormatAndMount{
+		Interface: mount.New(""),
+		Exec:      exec.New(),
+	}
+	notMountPoint, err := mounter.IsLikelyNotMountPoint(stagingTargetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return status.Errorf(codes.Internal, "Cannot check staging path '%s': %s", stagingTargetPath, err)
+		}
+		if err := os.MkdirAll(stagingTargetPath, 0750); err != nil {
+			return status.Errorf(codes.Internal, "Failed to mkdir staging path '%s': %s", stagingTargetPath, err)
+		}
+		notMountPoint = true
+	}
+	if !notMountPoint {
+		l.Warnf("Staging target path '%s' is already a mount point", stagingTargetPath)
+		return nil
+	}
+
+	l.Infof(
+		"mount params: type: '%s', device: '%s', targetPath: '%s', options: %v",
+		fsType,
+		device,
+		stagingTargetPath,
+		mountOptions,
+	)
+	err = mounter.FormatAndMount(device, stagingTargetPath, fsType, mountOptions)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to format and mount '%s' to '%s': %s", device, stagingTargetPath, err)
+	}
+
+	return nil
+}
+
+// disconnectISCSIVolume - log out from iSCSI target if volume was connected by connectISCSIVolume()
+func (s *NodeServer) disconnectISCSIVolume(volumeID, stagingTargetPath string) error {
+	connectionFile := getConnectionFile(volumeID, stagingTargetPath, ProtocolISCSI)
+	conn := iscsi.Connection{}
+	err := connection.Load(connectionFile, &conn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// not an iSCSI volume or already disconnected
+			return nil
+		}
+		return status.Errorf(codes.Internal, "Cannot read iSCSI connection of volume '%s': %s", volumeID, err)
+	}
+
+	err = s.iscsiConnector.Disconnect(conn)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot disconnect iSCSI volume '%s': %s", volumeID, err)
+	}
+
+	if err := os.Remove(connectionFile); err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "Cannot remove iSCSI connection file '%s': %s", connectionFile, err)
+	}
+	return nil
+}
+
+// disconnectNVMeVolume - disconnect from NVMe subsystem if volume was connected by connectNVMeVolume()
+func (s *NodeServer) disconnectNVMeVolume(volumeID, stagingTargetPath string) error {
+	connectionFile := getConnectionFile(volumeID, stagingTargetPath, ProtocolNVMeTCP)
+	conn := nvme.Connection{}
+	err := connection.Load(connectionFile, &conn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// not an NVMe volume or already disconnected
+			return nil
+		}
+		return status.Errorf(codes.Internal, "Cannot read NVMe connection of volume '%s': %s", volumeID, err)
+	}
+
+	err = s.nvmeConnector.Disconnect(conn)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot disconnect NVMe/TCP volume '%s': %s", volumeID, err)
+	}
+
+	if err := os.Remove(connectionFile); err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "Cannot remove NVMe connection file '%s': %s", connectionFile, err)
+	}
+	return nil
+}
+
+// getStagedDevice - device of the volume connected in NodeStageVolume()
+func getStagedDevice(volumeID, stagingTargetPath string) (string, error) {
+	iscsiConn := iscsi.Connection{}
+	err := connection.Load(getConnectionFile(volumeID, stagingTargetPath, ProtocolISCSI), &iscsiConn)
+	if err == nil {
+		return filepath.EvalSymlinks(iscsiConn.DevicePath())
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	nvmeConn := nvme.Connection{}
+	err = connection.Load(getConnectionFile(volumeID, stagingTargetPath, ProtocolNVMeTCP), &nvmeConn)
+	if err != nil {
+		return "", err
+	}
+	device, err := nvme.FindDevice(nvmeConn.NGUID)
+	if err != nil {
+		return "", err
+	} else if device == "" {
+		return "", fmt.Errorf("Device of NVMe namespace '%s' not found", nvmeConn.NGUID)
+	}
+	return device, nil
+}
+
+// publishBlockVolume - bind mount connected iSCSI LUN or NVMe namespace device to the target path file
+func (s *NodeServer) publishBlockVolume(volumeID, stagingTargetPath, targetPath string, readOnly bool) error {
+	l := s.log.WithField("func", "publishBlockVolume()")
+
+	device, err := getStagedDevice(volumeID, stagingTargetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status.Errorf(codes.FailedPrecondition, "Volume '%s' is not staged as block volume", volumeID)
+		}
+		return status.Errorf(codes.Internal, "Cannot find device of volume '%s': %s", volumeID, err)
+	}
+
+	mounter := mount.New("")
+	notMountPoint, err := mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return status.Errorf(codes.Internal, "Cannot check target path '%s': %s", targetPath, err)
+		}
+		// block device target path must be a file
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+			return status.Errorf(codes.Internal, "Failed to mkdir '%s': %s", filepath.Dir(targetPath), err)
+		}
+		file, err := os.OpenFile(targetPath, os.O_CREATE, 0660)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed to create target path file '%s': %s", targetPath, err)
+		}
+		file.Close()
+		notMountPoint = true
+	}
+	if !notMountPoint {
+		l.Warnf("Target path '%s' is already a mount point", targetPath)
+		return nil
+	}
+
+	l.Infof("bind mount device '%s' to '%s', read-only: %t", device, targetPath, readOnly)
+	err = mounter.Mount(device, targetPath, "", []string{"bind"})
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to mount '%s' to '%s': %s", device, targetPath, err)
+	}
+
+	// "ro" option is ignored by kernel on bind mount creation, it only applies on remount
+	if readOnly {
+		output, err := exec.New().Command("mount", "-o", "remount,bind,ro", targetPath).CombinedOutput()
+		if err != nil {
+			if unmountErr := mounter.Unmount(targetPath); unmountErr != nil {
+				l.Warnf("Cannot unmount '%s' after failed remount: %s", targetPath, unmountErr)
+			}
+			return status.Errorf(
+				codes.Internal,
+				"Failed to remount '%s' as read-only: %s: %s",
+				targetPath,
+				err,
+				strings.TrimSpace(string(output)),
+			)
+		}
+	}
+	return nil
+}
+
+// getConnectionFile - block volume connection is saved next to the staging path, so it's available on unstage
+func getConnectionFile(volumeID, stagingTargetPath, protocol string) string {
+	fileName := fmt.Sprintf("%s.%s.json", strings.NewReplacer("/", "_", ":", "_").Replace(volumeID), protocol)
+	return filepath.Join(filepath.Dir(stagingTargetPath), fileName)
+}
+
+// isBlockDevice - true if path is a block device (published raw block volume)
+func isBlockDevice(path string) bool {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return fileInfo.Mode()&os.ModeDevice != 0 && fileInfo.Mode()&os.ModeCharDevice == 0
 }
 
-// only "nfs" is supported for now
+// getBlockDeviceSize - size of block device in bytes
+func getBlockDeviceSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size, err := unix.IoctlGetInt(int(file.Fd()), unix.BLKGETSIZE64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// doMount - mounts source to target path, "nfs", "cifs" and bind mounts are supported
 func (s *NodeServer) doMount(
 	mountSource, targetPath, fsType string, mountOptions []string) error {
 	l := s.log.WithField("func", "doMount()")
@@ -478,7 +1096,7 @@ func (s *NodeServer) doMount(
 	return nil
 }
 
-// NodeUnpublishVolume - umount NS fs from the node and delete directory if successful
+// NodeUnpublishVolume - umount bind mount from the pod's target path and delete directory if successful
 func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (
 	*csi.NodeUnpublishVolumeResponse,
 	error,
@@ -496,15 +1114,26 @@ func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		return nil, status.Error(codes.InvalidArgument, "Target path must be provided")
 	}
 
+	if err := s.doUnmount(targetPath); err != nil {
+		return nil, err
+	}
+
+	l.Infof("volume '%s' has been unpublished from '%s'", volumeID, targetPath)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// doUnmount - umount target path (if mounted) and delete its directory
+func (s *NodeServer) doUnmount(targetPath string) error {
+	l := s.log.WithField("func", "doUnmount()")
 	mounter := mount.New("")
 
 	notMountPoint, err := mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			l.Warnf("mount point '%s' already doesn't exist: '%s', return OK", targetPath, err)
-			return &csi.NodeUnpublishVolumeResponse{}, nil
+			return nil
 		}
-		return nil, status.Errorf(
+		return status.Errorf(
 			codes.Internal,
 			"Cannot ensure that target path '%s' is a mount point: '%s'",
 			targetPath,
@@ -516,19 +1145,18 @@ func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		if err := os.Remove(targetPath); err != nil {
 			l.Infof("Remove target path error: %s", err.Error())
 		}
-		return &csi.NodeUnpublishVolumeResponse{}, nil
+		return nil
 	}
 
 	if err := mounter.Unmount(targetPath); err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to unmount target path '%s': %s", targetPath, err)
+		return status.Errorf(codes.Internal, "Failed to unmount target path '%s': %s", targetPath, err)
 	}
 
 	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
-		return nil, status.Errorf(codes.Internal, "Cannot remove unmounted target path '%s': %s", targetPath, err)
+		return status.Errorf(codes.Internal, "Cannot remove unmounted target path '%s': %s", targetPath, err)
 	}
 
-	l.Infof("volume '%s' has been unpublished from '%s'", volumeID, targetPath)
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return nil
 }
 
 func (s *NodeServer) GetV13CompatibleConfigName() (string, error) {
@@ -540,8 +1168,7 @@ func (s *NodeServer) GetV13CompatibleConfigName() (string, error) {
 	return "", status.Error(codes.InvalidArgument, "V13Compatible configuration not found")
 }
 
-// NodeGetVolumeStats - volume stats (available capacity)
-// TODO https://github.com/container-storage-interface/spec/blob/master/spec.md#nodegetvolumestats
+// NodeGetVolumeStats - volume stats (total/used/available bytes and inodes)
 func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (
 	*csi.NodeGetVolumeStatsResponse,
 	error,
@@ -551,7 +1178,6 @@ func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 
 	// volumePath can be any valid path where volume was previously staged or published.
 	// It MUST be an absolute path in the root filesystem of the process serving this request.
-	//TODO validate volumePath then re-enable GET_VOLUME_STATS node capability.
 	volumePath := req.GetVolumePath()
 	if len(volumePath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "req.VolumePath must be provided")
@@ -574,7 +1200,7 @@ func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 	}
 
 	configName := volInfo.ConfigName
-	volumePath = volInfo.Path
+	datasetPath := volInfo.Path
 	if volInfo.IsV13VolumeIDVersion {
 		configName, err = s.GetV13CompatibleConfigName()
 		if err != nil {
@@ -582,57 +1208,316 @@ func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 		}
 	}
 
-	nsProvider, err, _ := s.resolveNS(configName, volumePath)
+	// raw block volume is published as a bind mounted device file
+	if isBlockDevice(volumePath) {
+		size, err := getBlockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot get size of block device '%s': %s", volumePath, err)
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:  csi.VolumeUsage_BYTES,
+					Total: size,
+				},
+			},
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: false,
+				Message:  "Block device is attached",
+			},
+		}, nil
+	}
+
+	// make sure volume path is a mount of this volume, not an arbitrary directory
+	mountPoint, mounted, err := s.getMountPoint(volumePath)
 	if err != nil {
 		return nil, err
+	} else if !mounted {
+		return newAbnormalVolumeStatsResponse(fmt.Sprintf("Volume path '%s' is not mounted", volumePath)), nil
 	}
 
-	l.Infof("resolved NS: %s, %s", nsProvider, volumePath)
+	// mount source can be checked only if the node has access to NexentaStor,
+	// volumes of `controllerSharing` NexentaStors are mounted from volume context,
+	// iSCSI volumes are mounted from local LUN devices
+	_, hasResolver := s.nsResolverMap[configName]
+	if hasResolver && arrays.ContainsString([]string{"nfs", "nfs4", "cifs"}, mountPoint.Type) {
+		nsProvider, err, _ := s.resolveNS(configName, datasetPath)
+		if err != nil {
+			return nil, err
+		}
+
+		l.Infof("resolved NS: %s, %s", nsProvider, datasetPath)
+
+		// get NexentaStor filesystem information
+		filesystem, err := nsProvider.GetFilesystem(datasetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "Cannot find filesystem '%s': %s", volumeID, err)
+		}
+
+		if !s.isFilesystemMountSource(nsProvider, filesystem, mountPoint) {
+			return nil, status.Errorf(
+				codes.NotFound,
+				"Volume path '%s' is not a mount of volume '%s' (mounted: '%s')",
+				volumePath,
+				volumeID,
+				mountPoint.Device,
+			)
+		}
+	}
 
-	// get NexentaStor filesystem information
-	available, err := nsProvider.GetFilesystemAvailableCapacity(volumePath)
+	statfs, err := s.statfsWithTimeout(volumePath, statfsTimeout)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "Cannot find filesystem '%s': %s", volumeID, err)
+		if err == errStatfsTimeout {
+			message := fmt.Sprintf("Volume path '%s' is not responding for %s, mount may be hung", volumePath, statfsTimeout)
+			l.Warn(message)
+			return newAbnormalVolumeStatsResponse(message), nil
+		} else if err == errStatfsPending {
+			message := fmt.Sprintf("Volume path '%s' is still not responding to previous stats call, mount is hung", volumePath)
+			l.Warn(message)
+			return newAbnormalVolumeStatsResponse(message), nil
+		} else if mount.IsCorruptedMnt(err) {
+			message := fmt.Sprintf("Volume path '%s' has a stale mount: %s", volumePath, err)
+			l.Warn(message)
+			return newAbnormalVolumeStatsResponse(message), nil
+		}
+		return nil, status.Errorf(codes.Internal, "Cannot get stats for volume path '%s': %s", volumePath, err)
 	}
 
+	blockSize := int64(statfs.Bsize)
+	totalBytes := int64(statfs.Blocks) * blockSize
+	availableBytes := int64(statfs.Bavail) * blockSize
+	usedBytes := (int64(statfs.Blocks) - int64(statfs.Bfree)) * blockSize
+	totalInodes := int64(statfs.Files)
+	freeInodes := int64(statfs.Ffree)
+
+	l.Infof(
+		"volume '%s' stats: bytes total/used/available: %d/%d/%d, inodes total/used/free: %d/%d/%d",
+		volumeID,
+		totalBytes,
+		usedBytes,
+		availableBytes,
+		totalInodes,
+		totalInodes-freeInodes,
+		freeInodes,
+	)
+
 	return &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
 				Unit:      csi.VolumeUsage_BYTES,
-				Available: available,
-				//TODO add used, total
+				Total:     totalBytes,
+				Used:      usedBytes,
+				Available: availableBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     totalInodes,
+				Used:      totalInodes - freeInodes,
+				Available: freeInodes,
 			},
 		},
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  "Volume is mounted and responding",
+		},
 	}, nil
 }
 
-// NodeStageVolume - stage volume
-// TODO use this to mount NFS, then do bind mount?
-func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (
-	*csi.NodeStageVolumeResponse,
-	error,
-) {
-	s.log.WithField("func", "NodeStageVolume()").Warnf("request: '%+v' - not implemented", req)
-	return nil, status.Error(codes.Unimplemented, "")
+// newAbnormalVolumeStatsResponse - stats response w/o usage, reports volume condition only
+func newAbnormalVolumeStatsResponse(message string) *csi.NodeGetVolumeStatsResponse {
+	return &csi.NodeGetVolumeStatsResponse{
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  message,
+		},
+	}
 }
 
-// NodeUnstageVolume - unstage volume
-// TODO use this to umount NFS?
-func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (
-	*csi.NodeUnstageVolumeResponse,
-	error,
-) {
-	s.log.WithField("func", "NodeUnstageVolume()").Warnf("request: '%+v' - not implemented", req)
-	return nil, status.Error(codes.Unimplemented, "")
+// statfsWithTimeout - statfs() call on hung NFS mount blocks forever, so give up after timeout.
+// Blocked goroutine stays until the mount responds or gets unmounted, no new call is made for the path
+// until then, so repeated stats requests don't pile up goroutines.
+func (s *NodeServer) statfsWithTimeout(path string, timeout time.Duration) (unix.Statfs_t, error) {
+	type statfsResult struct {
+		statfs unix.Statfs_t
+		err    error
+	}
+
+	s.statfsPendingMutex.Lock()
+	if s.statfsPending[path] {
+		s.statfsPendingMutex.Unlock()
+		return unix.Statfs_t{}, errStatfsPending
+	}
+	s.statfsPending[path] = true
+	s.statfsPendingMutex.Unlock()
+
+	done := make(chan statfsResult, 1)
+	go func() {
+		var result statfsResult
+		result.err = unix.Statfs(path, &result.statfs)
+
+		s.statfsPendingMutex.Lock()
+		delete(s.statfsPending, path)
+		s.statfsPendingMutex.Unlock()
+
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		return result.statfs, result.err
+	case <-time.After(timeout):
+		return unix.Statfs_t{}, errStatfsTimeout
+	}
+}
+
+// getMountPoint - find mount table entry for a path, returns "false" if existing path is not a mount point,
+// NotFound error if path doesn't exist
+func (s *NodeServer) getMountPoint(path string) (mount.MountPoint, bool, error) {
+	mounter := mount.New("")
+
+	// mount table is read first, stat() call on hung mount point would block
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return mount.MountPoint{}, false, status.Errorf(codes.Internal, "Cannot get mount points list: %s", err)
+	}
+
+	// the last entry wins if there are several mounts on top of each other
+	var found *mount.MountPoint
+	for i := range mountPoints {
+		if mountPoints[i].Path == path {
+			found = &mountPoints[i]
+		}
+	}
+	if found != nil {
+		return *found, true, nil
+	}
+
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return mount.MountPoint{}, false, status.Errorf(codes.NotFound, "Volume path '%s' doesn't exist", path)
+		}
+		return mount.MountPoint{}, false, status.Errorf(
+			codes.Internal,
+			"Cannot access volume path '%s': %s",
+			path,
+			err,
+		)
+	}
+
+	return mount.MountPoint{}, false, nil
+}
+
+// isFilesystemMountSource - check if mount point source is a NFS export or SMB share of NS filesystem
+func (s *NodeServer) isFilesystemMountSource(
+	nsProvider ns.ProviderInterface,
+	filesystem ns.Filesystem,
+	mountPoint mount.MountPoint,
+) bool {
+	l := s.log.WithField("func", "isFilesystemMountSource()")
+
+	switch mountPoint.Type {
+	case config.FsTypeNFS, "nfs4":
+		// NFS style mount source: "dataIP:/pool/dataset/fs"
+		return strings.HasSuffix(mountPoint.Device, fmt.Sprintf(":%s", filesystem.MountPoint))
+	case config.FsTypeCIFS:
+		// CIFS style mount source: "//dataIP/shareName"
+		shareName, err := nsProvider.GetSmbShareName(filesystem.Path)
+		if err != nil {
+			l.Warnf("cannot get SMB share name of '%s': %s", filesystem.Path, err)
+			return false
+		}
+		return strings.HasSuffix(mountPoint.Device, fmt.Sprintf("/%s", shareName))
+	}
+
+	l.Warnf("unsupported mount type '%s' of '%s'", mountPoint.Type, mountPoint.Path)
+	return false
 }
 
-// NodeExpandVolume - not supported
+// NodeExpandVolume - rescan expanded zvol device and grow its filesystem,
+// NFS/SMB volumes are expanded by ControllerExpandVolume() only
 func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (
 	*csi.NodeExpandVolumeResponse,
 	error,
 ) {
-	s.log.WithField("func", "NodeExpandVolume()").Warnf("request: '%+v' - not implemented", req)
-	return nil, status.Error(codes.Unimplemented, "")
+	l := s.log.WithField("func", "NodeExpandVolume()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "req.VolumeId must be provided")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "req.VolumePath must be provided")
+	}
+	if _, err := os.Stat(volumePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume path '%s' not found", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "Cannot check volume path '%s': %s", volumePath, err)
+	}
+
+	device, err := s.rescanBlockVolume(volumeID, req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
+	} else if device == "" {
+		l.Infof("volume '%s' is not a block volume, nothing to expand on the node", volumeID)
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
+	if req.GetVolumeCapability().GetBlock() == nil && !isBlockDevice(volumePath) {
+		resizer := mount.NewResizeFs(exec.New())
+		if _, err := resizer.Resize(device, volumePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot resize filesystem on '%s': %s", device, err)
+		}
+	}
+
+	size, err := getBlockDeviceSize(device)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get size of block device '%s': %s", device, err)
+	}
+
+	l.Infof("volume '%s' has been expanded to %d bytes", volumeID, size)
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: size,
+	}, nil
+}
+
+// rescanBlockVolume - rescan device of the volume connected in NodeStageVolume(),
+// returns empty device path if volume is not connected as a block device
+func (s *NodeServer) rescanBlockVolume(volumeID, stagingTargetPath string) (string, error) {
+	if stagingTargetPath == "" {
+		return "", nil
+	}
+
+	iscsiConn := iscsi.Connection{}
+	err := connection.Load(getConnectionFile(volumeID, stagingTargetPath, ProtocolISCSI), &iscsiConn)
+	if err == nil {
+		if err := s.iscsiConnector.Rescan(iscsiConn); err != nil {
+			return "", status.Errorf(codes.Internal, "Cannot rescan iSCSI volume '%s': %s", volumeID, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", status.Errorf(codes.Internal, "Cannot read iSCSI connection of volume '%s': %s", volumeID, err)
+	}
+
+	nvmeConn := nvme.Connection{}
+	err = connection.Load(getConnectionFile(volumeID, stagingTargetPath, ProtocolNVMeTCP), &nvmeConn)
+	if err == nil {
+		if err := s.nvmeConnector.Rescan(nvmeConn); err != nil {
+			return "", status.Errorf(codes.Internal, "Cannot rescan NVMe/TCP volume '%s': %s", volumeID, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", status.Errorf(codes.Internal, "Cannot read NVMe connection of volume '%s': %s", volumeID, err)
+	}
+
+	device, err := getStagedDevice(volumeID, stagingTargetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", status.Errorf(codes.Internal, "Cannot find device of volume '%s': %s", volumeID, err)
+	}
+	return device, nil
 }
 
 // NewNodeServer - create an instance of node service
@@ -642,6 +1527,10 @@ func NewNodeServer(driver *Driver) (*NodeServer, error) {
 	resolverMap := make(map[string]*ns.Resolver)
 
 	for name, cfg := range driver.config.NsMap {
+		if !cfg.HasCredentials() {
+			l.Infof("no NexentaStor credentials for config '%s', volumes must be shared by controller", name)
+			continue
+		}
 		nsResolver, err := ns.NewResolver(ns.ResolverArgs{
 			Address:            cfg.Address,
 			Username:           cfg.Username,
@@ -655,10 +1544,23 @@ func NewNodeServer(driver *Driver) (*NodeServer, error) {
 		resolverMap[name] = nsResolver
 	}
 
+	k8sClient, err := k8s.NewInClusterClient()
+	if err != nil {
+		l.Warnf("Cannot create Kubernetes client, node IP won't be published to controller: %s", err)
+	}
+
 	return &NodeServer{
 		nodeID:        driver.nodeID,
+		nodeIP:        driver.nodeIP,
+		zone:          driver.zone,
 		nsResolverMap: resolverMap,
 		config:        driver.config,
 		log:           l,
+
+		applianceTopology: driver.applianceTopology,
+		iscsiConnector:    iscsi.New(l),
+		nvmeConnector:     nvme.New(l),
+		k8sClient:         k8sClient,
+		statfsPending:     map[string]bool{},
 	}, nil
 }
@@ -25,3 +25,9 @@ func ParseVolumeID(volumeID string) (VolumeInfo, error) {
 	}
 	return VolumeInfo{}, status.Error(codes.InvalidArgument, fmt.Sprintf("Unknown VolumeId format: %s", volumeID))
 }
+
+// NodeInfo - node name and address the node is reachable from NexentaStor with
+type NodeInfo struct {
+	Name    string
+	Address string
+}
@@ -0,0 +1,182 @@
+// Package iscsi - open-iscsi initiator calls to attach NexentaStor LUNs to the node.
+// `iscsiadm` talks to the host's iscsid, so the node driver container must run in the host network
+// and have host's /dev and /etc/iscsi mounted.
+package iscsi
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPort - default iSCSI target portal port
+const DefaultPort = "3260"
+
+// initiatorNamePrefix - IQN prefix of per-node initiator names, NexentaStor maps LUNs to host groups of these IQNs
+const initiatorNamePrefix = "iqn.2005-07.com.nexenta:csi:host"
+
+// ifaceName - iscsiadm interface the node logs in with its per-node initiator name,
+// host's default interface and /etc/iscsi/initiatorname.iscsi are kept as is
+const ifaceName = "nexentastor-csi"
+
+// iscsiadm exit codes that are not errors for idempotent login/logout
+const (
+	exitCodeSessionExists = 15
+	exitCodeNoSession     = 21
+)
+
+const checkDeviceInterval = 500 * time.Millisecond
+
+// Connection - iSCSI LUN connection parameters
+type Connection struct {
+	// Portal - target portal "host:port"
+	Portal string `json:"portal"`
+	// Target - target IQN
+	Target string `json:"target"`
+	// Lun - logical unit number
+	Lun int `json:"lun"`
+	// InitiatorName - initiator IQN to log in with, host's default initiator name is used if it's empty
+	InitiatorName string `json:"initiatorName,omitempty"`
+}
+
+func (c Connection) String() string {
+	return fmt.Sprintf("%s,%s,lun-%d", c.Portal, c.Target, c.Lun)
+}
+
+// DevicePath - udev path of connected LUN device
+func (c Connection) DevicePath() string {
+	return fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%d", c.Portal, c.Target, c.Lun)
+}
+
+// InitiatorName - initiator IQN used by the node with given name
+func InitiatorName(nodeName string) string {
+	return fmt.Sprintf("%s:%s", initiatorNamePrefix, strings.ToLower(nodeName))
+}
+
+// ifaceArgs - iscsiadm arguments to use the interface of connection initiator name
+func (conn Connection) ifaceArgs() []string {
+	if conn.InitiatorName == "" {
+		return nil
+	}
+	return []string{"-I", ifaceName}
+}
+
+// Connector - attaches/detaches iSCSI LUNs using iscsiadm
+type Connector struct {
+	log *logrus.Entry
+}
+
+// Connect - discover target, log in and wait for LUN device, returns real device path (e.g. /dev/sdc)
+func (c *Connector) Connect(conn Connection, timeout time.Duration) (string, error) {
+	l := c.log.WithField("func", "Connect()")
+	l.Infof("connecting to %s", conn)
+
+	if conn.InitiatorName != "" {
+		if err := c.setInitiatorName(conn.InitiatorName); err != nil {
+			return "", err
+		}
+	}
+
+	_, err := c.iscsiadm(append([]string{"-m", "discovery", "-t", "sendtargets", "-p", conn.Portal},
+		conn.ifaceArgs()...)...)
+	if err != nil {
+		return "", fmt.Errorf("Cannot discover iSCSI targets on '%s': %s", conn.Portal, err)
+	}
+
+	exitCode, err := c.iscsiadm(append([]string{"-m", "node", "-T", conn.Target, "-p", conn.Portal, "--login"},
+		conn.ifaceArgs()...)...)
+	if err != nil && exitCode != exitCodeSessionExists {
+		return "", fmt.Errorf("Cannot log in to iSCSI target '%s' on '%s': %s", conn.Target, conn.Portal, err)
+	}
+
+	devicePath := conn.DevicePath()
+	for start := time.Now(); ; {
+		if _, err := os.Stat(devicePath); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("Cannot check device '%s': %s", devicePath, err)
+		}
+		if time.Since(start) > timeout {
+			return "", fmt.Errorf("Device '%s' didn't appear in %s", devicePath, timeout)
+		}
+		time.Sleep(checkDeviceInterval)
+	}
+
+	device, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return "", fmt.Errorf("Cannot resolve device path '%s': %s", devicePath, err)
+	}
+
+	l.Infof("%s is connected as '%s'", conn, device)
+	return device, nil
+}
+
+// Disconnect - log out from the target and delete its node record, not connected target is not an error
+func (c *Connector) Disconnect(conn Connection) error {
+	l := c.log.WithField("func", "Disconnect()")
+	l.Infof("disconnecting from %s", conn)
+
+	exitCode, err := c.iscsiadm(append([]string{"-m", "node", "-T", conn.Target, "-p", conn.Portal, "--logout"},
+		conn.ifaceArgs()...)...)
+	if err != nil && exitCode != exitCodeNoSession {
+		return fmt.Errorf("Cannot log out from iSCSI target '%s' on '%s': %s", conn.Target, conn.Portal, err)
+	}
+
+	// stale node records make iscsid to re-login on restart
+	_, err = c.iscsiadm(append([]string{"-m", "node", "-o", "delete", "-T", conn.Target, "-p", conn.Portal},
+		conn.ifaceArgs()...)...)
+	if err != nil {
+		l.Warnf("Cannot delete iSCSI node record of '%s': %s", conn.Target, err)
+	}
+
+	return nil
+}
+
+// Rescan - rescan target session to update LUN device size after the zvol is expanded
+func (c *Connector) Rescan(conn Connection) error {
+	c.log.WithField("func", "Rescan()").Infof("rescanning %s", conn)
+
+	if _, err := c.iscsiadm("-m", "node", "-T", conn.Target, "-p", conn.Portal, "--rescan"); err != nil {
+		return fmt.Errorf("Cannot rescan iSCSI target '%s' on '%s': %s", conn.Target, conn.Portal, err)
+	}
+	return nil
+}
+
+// setInitiatorName - create the driver's iscsiadm interface if it doesn't exist and set its initiator name
+func (c *Connector) setInitiatorName(initiatorName string) error {
+	if _, err := c.iscsiadm("-m", "iface", "-I", ifaceName); err != nil {
+		if _, err := c.iscsiadm("-m", "iface", "-I", ifaceName, "-o", "new"); err != nil {
+			return fmt.Errorf("Cannot create iSCSI interface '%s': %s", ifaceName, err)
+		}
+	}
+
+	_, err := c.iscsiadm("-m", "iface", "-I", ifaceName, "-o", "update", "-n", "iface.initiatorname", "-v", initiatorName)
+	if err != nil {
+		return fmt.Errorf("Cannot set initiator name of iSCSI interface '%s' to '%s': %s", ifaceName, initiatorName, err)
+	}
+	return nil
+}
+
+func (c *Connector) iscsiadm(args ...string) (exitCode int, err error) {
+	c.log.WithField("func", "iscsiadm()").Debugf("iscsiadm %s", strings.Join(args, " "))
+	out, err := exec.Command("iscsiadm", args...).CombinedOutput()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
+		return exitCode, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return 0, nil
+}
+
+// New - create iSCSI connector
+func New(log *logrus.Entry) *Connector {
+	return &Connector{
+		log: log.WithField("cmp", "ISCSIConnector"),
+	}
+}
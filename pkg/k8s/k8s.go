@@ -0,0 +1,170 @@
+// Package k8s - minimal in-cluster Kubernetes API client, the driver only reads and sets annotations of nodes:
+// node driver publishes the node IP, controller reads it
+package k8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// service account files mounted to every pod
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+const requestTimeout = 10 * time.Second
+
+// ErrNotInCluster - driver doesn't run in Kubernetes pod
+var ErrNotInCluster = fmt.Errorf("Kubernetes service environment variables are not set")
+
+// NotFoundError - requested object doesn't exist
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s '%s' not found", e.Kind, e.Name)
+}
+
+// IsNotFoundError - check if error is NotFoundError
+func IsNotFoundError(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// Client - Kubernetes API client
+type Client struct {
+	address    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient - create client of Kubernetes API at the address ("https://host:port") with the bearer token
+func NewClient(address, token string, httpClient *http.Client) *Client {
+	return &Client{
+		address:    strings.TrimSuffix(address, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// NewInClusterClient - create client using pod service account, returns ErrNotInCluster outside of Kubernetes
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read service account token: %s", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read service account CA certificate: %s", err)
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("Cannot parse service account CA certificate '%s'", serviceAccountCAFile)
+	}
+
+	httpClient := &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: certPool},
+		},
+	}
+
+	return NewClient("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), httpClient), nil
+}
+
+// GetNodeAnnotations - get annotations of the node
+func (c *Client) GetNodeAnnotations(name string) (map[string]string, error) {
+	body, err := c.doNodeRequest(http.MethodGet, name, nil)
+	if IsNotFoundError(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Cannot get node '%s': %s", name, err)
+	}
+
+	node := struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(body, &node); err != nil {
+		return nil, fmt.Errorf("Cannot parse node '%s': %s", name, err)
+	}
+
+	return node.Metadata.Annotations, nil
+}
+
+// SetNodeAnnotation - set annotation of the node, other annotations are kept as is
+func (c *Client) SetNodeAnnotation(name, key, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.doNodeRequest(http.MethodPatch, name, patch); IsNotFoundError(err) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Cannot set annotation '%s' of node '%s': %s", key, name, err)
+	}
+
+	return nil
+}
+
+// doNodeRequest - send request to node API object, PATCH body is a JSON merge patch
+func (c *Client) doNodeRequest(method, name string, body []byte) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/api/v1/nodes/%s", c.address, url.PathEscape(name)), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read response: %s", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &NotFoundError{Kind: "Node", Name: name}
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(resBody)))
+	}
+
+	return resBody, nil
+}
@@ -0,0 +1,146 @@
+// Package naming - NexentaStor dataset names of volumes rendered from `volumeNameTemplate` StorageClass
+// parameter, e.g. "{{.PVCNamespace}}/{{.PVCName}}-{{.ShortUID}}". Rendered name is relative to the parent
+// dataset and may contain intermediate filesystems separated by "/".
+package naming
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// MaxDatasetPathLength - ZFS limit of the full dataset name length
+const MaxDatasetPathLength = 255
+
+// CSI parameters passed by external-provisioner started with `--extra-create-metadata` option
+const (
+	ParameterPVCName      = "csi.storage.k8s.io/pvc/name"
+	ParameterPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	ParameterPVName       = "csi.storage.k8s.io/pv/name"
+)
+
+// shortUIDLength - length of ShortUID template value
+const shortUIDLength = 8
+
+var uidRegexp = regexp.MustCompile("[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}")
+
+// ZFS allows ":" in names too, but it's a separator of driver's volume and snapshot IDs
+var nameComponentRegexp = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// TemplateData - values available in volume name template
+type TemplateData struct {
+	// Name - CSI volume name, e.g. "pvc-ns-5ac0b7f6-..."
+	Name string
+	// PVCName - name of the PVC
+	PVCName string
+	// PVCNamespace - namespace of the PVC
+	PVCNamespace string
+	// PVName - name of the PV
+	PVName string
+	// UID - PVC UID from CSI volume name generated by external-provisioner,
+	// if the name has no UID, it's a hash of the name
+	UID string
+	// ShortUID - first 8 characters of UID
+	ShortUID string
+}
+
+// NewTemplateData - template values of the CSI volume name and CreateVolume parameters
+func NewTemplateData(name string, parameters map[string]string) TemplateData {
+	uid := uidRegexp.FindString(name)
+	if uid == "" {
+		hash := sha256.Sum256([]byte(name))
+		uid = hex.EncodeToString(hash[:16])
+	}
+
+	return TemplateData{
+		Name:         name,
+		PVCName:      parameters[ParameterPVCName],
+		PVCNamespace: parameters[ParameterPVCNamespace],
+		PVName:       parameters[ParameterPVName],
+		UID:          uid,
+		ShortUID:     uid[:shortUIDLength],
+	}
+}
+
+// Template - parsed volume name template
+type Template struct {
+	template *template.Template
+}
+
+// ParseTemplate - parse volume name template, unknown fields are errors
+func ParseTemplate(text string) (*Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("Volume name template is empty")
+	}
+
+	t, err := template.New("volumeName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse volume name template '%s': %s", text, err)
+	}
+
+	// check field names, so template errors are reported regardless of the data
+	if err := t.Execute(&bytes.Buffer{}, TemplateData{}); err != nil {
+		return nil, fmt.Errorf("Invalid volume name template '%s': %s", text, err)
+	}
+
+	return &Template{template: t}, nil
+}
+
+// Render - render volume name relative to the parent dataset and validate it
+func (t *Template) Render(data TemplateData) (string, error) {
+	buffer := bytes.Buffer{}
+	if err := t.template.Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("Cannot render volume name template: %s", err)
+	}
+
+	name := buffer.String()
+	if err := ValidateName(name); err != nil {
+		return "", fmt.Errorf(
+			"Volume name '%s' rendered from the template is invalid (PVC metadata requires "+
+				"--extra-create-metadata option of csi-provisioner): %s",
+			name,
+			err,
+		)
+	}
+
+	return name, nil
+}
+
+// ValidateName - check ZFS name rules of volume name relative to the parent dataset
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Name is empty")
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if component == "" {
+			return fmt.Errorf("Name has empty component")
+		} else if component == "." || component == ".." {
+			return fmt.Errorf("Name component can't be '%s'", component)
+		} else if !nameComponentRegexp.MatchString(component) {
+			return fmt.Errorf(
+				"Name component '%s' has characters other than letters, digits, '_', '-' and '.'",
+				component,
+			)
+		}
+	}
+
+	return nil
+}
+
+// ValidateDatasetPath - check ZFS length limit of the full dataset path
+func ValidateDatasetPath(path string) error {
+	if len(path) > MaxDatasetPathLength {
+		return fmt.Errorf(
+			"Dataset path '%s' is %d characters long, ZFS limit is %d",
+			path,
+			len(path),
+			MaxDatasetPathLength,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,547 @@
+package nef
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// GetPool returns NexentaStor pool by its name
+func (c *Client) GetPool(name string) (pool Pool, err error) {
+	if name == "" {
+		return pool, fmt.Errorf("Pool name is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI(fmt.Sprintf("/storage/pools/%s", url.PathEscape(name)), map[string]string{
+		"fields": "poolName,health,status",
+	})
+
+	err = c.sendRequestWithStruct(http.MethodGet, uri, nil, &pool)
+	return pool, err
+}
+
+// GetNfsShare returns NFS share of filesystem by filesystem path
+func (c *Client) GetNfsShare(path string) (share NfsShare, err error) {
+	if path == "" {
+		return share, fmt.Errorf("Filesystem path is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI(fmt.Sprintf("/nas/nfs/%s", url.PathEscape(path)), map[string]string{
+		"fields": "filesystem,securityContexts",
+	})
+
+	err = c.sendRequestWithStruct(http.MethodGet, uri, nil, &share)
+	return share, err
+}
+
+// UpdateNfsShareParams - params to update NFS share access lists
+type UpdateNfsShareParams struct {
+	SecurityContexts []NfsSecurityContext `json:"securityContexts"`
+}
+
+// UpdateNfsShare updates NFS share of filesystem by filesystem path
+func (c *Client) UpdateNfsShare(path string, params UpdateNfsShareParams) error {
+	if path == "" {
+		return fmt.Errorf("Filesystem path is empty")
+	}
+
+	uri := fmt.Sprintf("/nas/nfs/%s", url.PathEscape(path))
+	return c.sendRequest(http.MethodPut, uri, params)
+}
+
+// GetVolume returns NexentaStor volume (zvol) by its path
+func (c *Client) GetVolume(path string) (volume ns.Volume, err error) {
+	if path == "" {
+		return volume, fmt.Errorf("Volume path is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI("/storage/volumes", map[string]string{
+		"path":   path,
+		"fields": "path,bytesAvailable,bytesUsed,volumeSize",
+	})
+
+	response := volumesResponse{}
+	err = c.sendRequestWithStruct(http.MethodGet, uri, nil, &response)
+	if err != nil {
+		return volume, err
+	}
+	if len(response.Data) == 0 {
+		return volume, &ns.NefError{Code: "ENOENT", Err: fmt.Errorf("Volume '%s' not found", path)}
+	}
+
+	return response.Data[0], nil
+}
+
+// DeleteISCSITarget deletes iSCSI target by its name, not existing target is not an error
+func (c *Client) DeleteISCSITarget(name string) error {
+	if name == "" {
+		return fmt.Errorf("iSCSI target name is empty")
+	}
+
+	uri := fmt.Sprintf("/san/iscsi/targets/%s", url.PathEscape(name))
+	err := c.sendRequest(http.MethodDelete, uri, nil)
+	if ns.IsNotExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteTargetGroup deletes target group by its name, not existing target group is not an error
+func (c *Client) DeleteTargetGroup(name string) error {
+	if name == "" {
+		return fmt.Errorf("Target group name is empty")
+	}
+
+	uri := fmt.Sprintf("/san/targetgroups/%s", url.PathEscape(name))
+	err := c.sendRequest(http.MethodDelete, uri, nil)
+	if ns.IsNotExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// CreateNvmeofSubsystemParams - params to create NVMe over Fabrics subsystem
+type CreateNvmeofSubsystemParams struct {
+	// Nqn - subsystem NQN
+	Nqn string `json:"subsystemNqn"`
+	// Listeners - transport addresses the subsystem is available on
+	Listeners []NvmeofListener `json:"listeners"`
+	// AllowAnyHost - if false, only hosts from the subsystem host list can connect
+	AllowAnyHost bool `json:"allowAnyHost"`
+}
+
+// CreateNvmeofSubsystem creates NVMe over Fabrics subsystem, existing subsystem is not an error
+func (c *Client) CreateNvmeofSubsystem(params CreateNvmeofSubsystemParams) error {
+	if params.Nqn == "" {
+		return fmt.Errorf("Parameters 'Nqn' is required")
+	}
+
+	err := c.sendRequest(http.MethodPost, "/san/nvmeof/subsystems", params)
+	if ns.IsAlreadyExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteNvmeofSubsystem deletes NVMe over Fabrics subsystem with its namespaces,
+// not existing subsystem is not an error
+func (c *Client) DeleteNvmeofSubsystem(nqn string) error {
+	if nqn == "" {
+		return fmt.Errorf("Subsystem NQN is empty")
+	}
+
+	uri := fmt.Sprintf("/san/nvmeof/subsystems/%s", url.PathEscape(nqn))
+	err := c.sendRequest(http.MethodDelete, uri, nil)
+	if ns.IsNotExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// CreateNvmeofNamespace adds zvol to NVMe over Fabrics subsystem as a namespace,
+// already added zvol is not an error
+func (c *Client) CreateNvmeofNamespace(nqn, volumePath string) error {
+	if nqn == "" {
+		return fmt.Errorf("Subsystem NQN is empty")
+	} else if volumePath == "" {
+		return fmt.Errorf("Volume path is empty")
+	}
+
+	uri := fmt.Sprintf("/san/nvmeof/subsystems/%s/namespaces", url.PathEscape(nqn))
+	err := c.sendRequest(http.MethodPost, uri, map[string]string{"volume": volumePath})
+	if ns.IsAlreadyExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// GetNvmeofNamespace returns namespace of the zvol in NVMe over Fabrics subsystem
+func (c *Client) GetNvmeofNamespace(nqn, volumePath string) (namespace NvmeofNamespace, err error) {
+	if nqn == "" {
+		return namespace, fmt.Errorf("Subsystem NQN is empty")
+	} else if volumePath == "" {
+		return namespace, fmt.Errorf("Volume path is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI(
+		fmt.Sprintf("/san/nvmeof/subsystems/%s/namespaces", url.PathEscape(nqn)),
+		map[string]string{
+			"volume": volumePath,
+			"fields": "nsid,volume,nguid",
+		},
+	)
+
+	response := nvmeofNamespacesResponse{}
+	err = c.sendRequestWithStruct(http.MethodGet, uri, nil, &response)
+	if err != nil {
+		return namespace, err
+	}
+	if len(response.Data) == 0 {
+		return namespace, &ns.NefError{
+			Code: "ENOENT",
+			Err:  fmt.Errorf("Namespace of '%s' not found in subsystem '%s'", volumePath, nqn),
+		}
+	}
+
+	return response.Data[0], nil
+}
+
+// AddNvmeofSubsystemHost allows host to connect to NVMe over Fabrics subsystem, added host is not an error
+func (c *Client) AddNvmeofSubsystemHost(nqn, hostNqn string) error {
+	if nqn == "" {
+		return fmt.Errorf("Subsystem NQN is empty")
+	} else if hostNqn == "" {
+		return fmt.Errorf("Host NQN is empty")
+	}
+
+	uri := fmt.Sprintf("/san/nvmeof/subsystems/%s/hosts", url.PathEscape(nqn))
+	err := c.sendRequest(http.MethodPost, uri, map[string]string{"hostNqn": hostNqn})
+	if ns.IsAlreadyExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// RemoveNvmeofSubsystemHost removes host from NVMe over Fabrics subsystem host list,
+// not existing subsystem or host is not an error
+func (c *Client) RemoveNvmeofSubsystemHost(nqn, hostNqn string) error {
+	if nqn == "" {
+		return fmt.Errorf("Subsystem NQN is empty")
+	} else if hostNqn == "" {
+		return fmt.Errorf("Host NQN is empty")
+	}
+
+	uri := fmt.Sprintf("/san/nvmeof/subsystems/%s/hosts/%s", url.PathEscape(nqn), url.PathEscape(hostNqn))
+	err := c.sendRequest(http.MethodDelete, uri, nil)
+	if ns.IsNotExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// filesystemsListLimit - page size of filesystem and volume list requests
+const filesystemsListLimit = 100
+
+// snapshotsListLimit - page size of snapshot list requests
+const snapshotsListLimit = 100
+
+// GetFilesystemUserProperties returns ZFS user properties of filesystem
+func (c *Client) GetFilesystemUserProperties(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Filesystem path is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI("/storage/filesystems", map[string]string{
+		"path":   path,
+		"fields": "path,userProperties",
+	})
+
+	response := filesystemPropertiesResponse{}
+	err := c.sendRequestWithStruct(http.MethodGet, uri, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) == 0 {
+		return nil, &ns.NefError{Code: "ENOENT", Err: fmt.Errorf("Filesystem '%s' not found", path)}
+	}
+
+	return response.Data[0].UserProperties, nil
+}
+
+// GetFilesystemsUserProperties returns ZFS user properties of all child filesystems of parent by their paths
+func (c *Client) GetFilesystemsUserProperties(parent string) (map[string]map[string]string, error) {
+	if parent == "" {
+		return nil, fmt.Errorf("Parent filesystem path is empty")
+	}
+
+	result := map[string]map[string]string{}
+	for offset := 0; ; offset += filesystemsListLimit {
+		uri := c.provider.RestClient.BuildURI("/storage/filesystems", map[string]string{
+			"parent": parent,
+			"limit":  fmt.Sprint(filesystemsListLimit),
+			"offset": fmt.Sprint(offset),
+			"fields": "path,userProperties",
+		})
+
+		response := filesystemPropertiesResponse{}
+		err := c.sendRequestWithStruct(http.MethodGet, uri, nil, &response)
+		if err != nil {
+			return nil, err
+		}
+		for _, fs := range response.Data {
+			if fs.Path != parent {
+				result[fs.Path] = fs.UserProperties
+			}
+		}
+		if len(response.Data) < filesystemsListLimit {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// SetFilesystemUserProperties sets ZFS user properties of filesystem, other user properties are kept as is
+func (c *Client) SetFilesystemUserProperties(path string, properties map[string]string) error {
+	if path == "" {
+		return fmt.Errorf("Filesystem path is empty")
+	}
+
+	uri := fmt.Sprintf("/storage/filesystems/%s", url.PathEscape(path))
+	return c.sendRequest(http.MethodPut, uri, map[string]interface{}{
+		"userProperties": properties,
+	})
+}
+
+// GetVolumeUserProperties returns ZFS user properties of volume (zvol)
+func (c *Client) GetVolumeUserProperties(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Volume path is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI("/storage/volumes", map[string]string{
+		"path":   path,
+		"fields": "path,volumeSize,userProperties",
+	})
+
+	response := volumePropertiesResponse{}
+	err := c.sendRequestWithStruct(http.MethodGet, uri, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) == 0 {
+		return nil, &ns.NefError{Code: "ENOENT", Err: fmt.Errorf("Volume '%s' not found", path)}
+	}
+
+	return response.Data[0].UserProperties, nil
+}
+
+// GetVolumesProperties returns size and ZFS user properties of all volumes (zvols) of parent filesystem
+func (c *Client) GetVolumesProperties(parent string) ([]VolumeProperties, error) {
+	if parent == "" {
+		return nil, fmt.Errorf("Parent filesystem path is empty")
+	}
+
+	result := []VolumeProperties{}
+	for offset := 0; ; offset += filesystemsListLimit {
+		uri := c.provider.RestClient.BuildURI("/storage/volumes", map[string]string{
+			"parent": parent,
+			"limit":  fmt.Sprint(filesystemsListLimit),
+			"offset": fmt.Sprint(offset),
+			"fields": "path,volumeSize,userProperties",
+		})
+
+		response := volumePropertiesResponse{}
+		err := c.sendRequestWithStruct(http.MethodGet, uri, nil, &response)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, response.Data...)
+		if len(response.Data) < filesystemsListLimit {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// SetVolumeUserProperties sets ZFS user properties of volume (zvol), other user properties are kept as is
+func (c *Client) SetVolumeUserProperties(path string, properties map[string]string) error {
+	if path == "" {
+		return fmt.Errorf("Volume path is empty")
+	}
+
+	uri := fmt.Sprintf("/storage/volumes/%s", url.PathEscape(path))
+	return c.sendRequest(http.MethodPut, uri, map[string]interface{}{
+		"userProperties": properties,
+	})
+}
+
+// SetSnapshotUserProperties sets ZFS user properties of snapshot, other user properties are kept as is
+func (c *Client) SetSnapshotUserProperties(path string, properties map[string]string) error {
+	if path == "" {
+		return fmt.Errorf("Snapshot path is empty")
+	}
+
+	uri := fmt.Sprintf("/storage/snapshots/%s", url.PathEscape(path))
+	return c.sendRequest(http.MethodPut, uri, map[string]interface{}{
+		"userProperties": properties,
+	})
+}
+
+// GetSnapshotProperties returns space usage and clones of snapshot by its path
+func (c *Client) GetSnapshotProperties(path string) (properties SnapshotProperties, err error) {
+	if path == "" {
+		return properties, fmt.Errorf("Snapshot path is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI(fmt.Sprintf("/storage/snapshots/%s", url.PathEscape(path)), map[string]string{
+		"fields": "path,bytesReferenced,clones",
+	})
+
+	err = c.sendRequestWithStruct(http.MethodGet, uri, nil, &properties)
+	return properties, err
+}
+
+// GetSnapshotsProperties returns space usage and clones of parent snapshots by snapshot paths
+func (c *Client) GetSnapshotsProperties(parent string, recursive bool) (map[string]SnapshotProperties, error) {
+	if parent == "" {
+		return nil, fmt.Errorf("Snapshots parent path is empty")
+	}
+
+	result := map[string]SnapshotProperties{}
+	for offset := 0; ; offset += snapshotsListLimit {
+		uri := c.provider.RestClient.BuildURI("/storage/snapshots", map[string]string{
+			"parent":    parent,
+			"recursive": fmt.Sprint(recursive),
+			"limit":     fmt.Sprint(snapshotsListLimit),
+			"offset":    fmt.Sprint(offset),
+			"fields":    "path,bytesReferenced,clones",
+		})
+
+		response := snapshotPropertiesResponse{}
+		err := c.sendRequestWithStruct(http.MethodGet, uri, nil, &response)
+		if err != nil {
+			return nil, err
+		}
+		for _, properties := range response.Data {
+			result[properties.Path] = properties
+		}
+		if len(response.Data) < snapshotsListLimit {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// CreateSnapshotParams - params to create snapshot
+type CreateSnapshotParams struct {
+	// Path - snapshot path w/o leading slash (e.g. "p/d/fs@s")
+	Path string `json:"path"`
+	// Recursive - atomically take snapshots with the same name of all descendant datasets
+	Recursive bool `json:"recursive"`
+}
+
+// CreateSnapshot creates snapshot, existing snapshot is not an error
+func (c *Client) CreateSnapshot(params CreateSnapshotParams) error {
+	if params.Path == "" {
+		return fmt.Errorf("Parameter 'Path' is required")
+	}
+
+	err := c.sendRequest(http.MethodPost, "/storage/snapshots", params)
+	if ns.IsAlreadyExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// replicationServiceTypeOneshot - HPR service sends the snapshot once and completes
+const replicationServiceTypeOneshot = "oneshot"
+
+// CreateReplicationServiceParams - params to create local replication service
+type CreateReplicationServiceParams struct {
+	// Name - service name
+	Name string `json:"name"`
+	// SourceSnapshot - snapshot path to send
+	SourceSnapshot string `json:"sourceSnapshot"`
+	// DestinationDataset - not existing filesystem path to receive the snapshot to
+	DestinationDataset string `json:"destinationDataset"`
+}
+
+// CreateReplicationService creates and starts one-time replication service, which sends snapshot
+// to a new filesystem on the same NexentaStor, existing service is not an error
+func (c *Client) CreateReplicationService(params CreateReplicationServiceParams) error {
+	if params.Name == "" {
+		return fmt.Errorf("Parameters 'Name' is required")
+	}
+
+	err := c.sendRequest(http.MethodPost, "/hpr/services", struct {
+		CreateReplicationServiceParams
+		Type string `json:"type"`
+	}{params, replicationServiceTypeOneshot})
+	if ns.IsAlreadyExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// GetReplicationService returns replication service by its name
+func (c *Client) GetReplicationService(name string) (service ReplicationService, err error) {
+	if name == "" {
+		return service, fmt.Errorf("Replication service name is empty")
+	}
+
+	uri := c.provider.RestClient.BuildURI(fmt.Sprintf("/hpr/services/%s", url.PathEscape(name)), map[string]string{
+		"fields": "name,state,lastError",
+	})
+
+	err = c.sendRequestWithStruct(http.MethodGet, uri, nil, &service)
+	return service, err
+}
+
+// DeleteReplicationService deletes replication service, not existing service is not an error
+func (c *Client) DeleteReplicationService(name string) error {
+	if name == "" {
+		return fmt.Errorf("Replication service name is empty")
+	}
+
+	uri := fmt.Sprintf("/hpr/services/%s", url.PathEscape(name))
+	err := c.sendRequest(http.MethodDelete, uri, nil)
+	if ns.IsNotExistNefError(err) {
+		return nil
+	}
+	return err
+}
+
+// CreateFilesystemParams - params to create filesystem with ZFS properties
+type CreateFilesystemParams struct {
+	// Path - filesystem path w/o leading slash
+	Path string
+	// ReferencedQuotaSize - referenced quota size in bytes, zero means no quota
+	ReferencedQuotaSize int64
+	// Properties - ZFS properties as NexentaStor filesystem fields (e.g. "compressionMode")
+	Properties map[string]interface{}
+}
+
+// CreateFilesystem creates filesystem with ZFS properties set at creation
+func (c *Client) CreateFilesystem(params CreateFilesystemParams) error {
+	if params.Path == "" {
+		return fmt.Errorf("Parameters 'Path' is required")
+	}
+
+	data := map[string]interface{}{}
+	for field, value := range params.Properties {
+		data[field] = value
+	}
+	data["path"] = params.Path
+	if params.ReferencedQuotaSize != 0 {
+		data["referencedQuotaSize"] = params.ReferencedQuotaSize
+	}
+
+	return c.sendRequest(http.MethodPost, "/storage/filesystems", data)
+}
+
+// RenameFilesystem moves filesystem to a new path in the same pool
+func (c *Client) RenameFilesystem(path, newPath string) error {
+	if path == "" || newPath == "" {
+		return fmt.Errorf("Filesystem path is empty")
+	}
+
+	uri := fmt.Sprintf("/storage/filesystems/%s/rename", url.PathEscape(path))
+	return c.sendRequest(http.MethodPost, uri, map[string]interface{}{
+		"newPath": newPath,
+	})
+}
+
+// SetFilesystemProperties sets filesystem fields, e.g. ZFS properties or referenced quota size
+func (c *Client) SetFilesystemProperties(path string, properties map[string]interface{}) error {
+	if path == "" {
+		return fmt.Errorf("Filesystem path is empty")
+	}
+
+	uri := fmt.Sprintf("/storage/filesystems/%s", url.PathEscape(path))
+	return c.sendRequest(http.MethodPut, uri, properties)
+}
@@ -0,0 +1,201 @@
+// Package nef - NexentaStor REST API (NEF) calls that are not covered by go-nexentastor ns.Provider.
+// Requests are sent through the resolved provider's REST client, so the same address,
+// auth token and TLS settings are used as for the rest of the driver's NexentaStor calls.
+package nef
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+const (
+	checkJobStatusInterval = 3 * time.Second
+	checkJobStatusTimeout  = 60 * time.Second
+)
+
+// Client - NEF client bound to one NexentaStor provider
+type Client struct {
+	provider *ns.Provider
+	log      *logrus.Entry
+}
+
+func (c *Client) String() string {
+	return c.provider.String()
+}
+
+func (c *Client) parseNefError(bodyBytes []byte, prefix string) error {
+	response := struct {
+		Name    string `json:"name"`
+		Message string `json:"message"`
+		Errors  string `json:"errors"`
+		Code    string `json:"code"`
+	}{}
+
+	if err := json.Unmarshal(bodyBytes, &response); err != nil {
+		return nil
+	}
+
+	var restErrorMessage string
+	if response.Name != "" {
+		restErrorMessage = response.Name
+	}
+	if response.Message != "" {
+		restErrorMessage = fmt.Sprintf("%s: %s", restErrorMessage, response.Message)
+	}
+	if response.Errors != "" {
+		restErrorMessage = fmt.Sprintf("%s, errors: [%s]", restErrorMessage, response.Errors)
+	}
+
+	if restErrorMessage != "" {
+		return &ns.NefError{
+			Err:  fmt.Errorf("%s: %s", prefix, restErrorMessage),
+			Code: response.Code,
+		}
+	}
+
+	return nil
+}
+
+// IsNoSpaceNefError - NexentaStor has not enough space for the request, e.g. to set a reservation
+func IsNoSpaceNefError(err error) bool {
+	return ns.GetNefErrorCode(err) == "ENOSPC"
+}
+
+func (c *Client) sendRequestWithStruct(method, path string, data, response interface{}) error {
+	bodyBytes, err := c.doAuthRequest(method, path, data)
+	if err != nil {
+		return err
+	}
+
+	if len(bodyBytes) == 0 {
+		return fmt.Errorf("Request '%s %s' responded with empty body", method, path)
+	} else if !json.Valid(bodyBytes) {
+		return fmt.Errorf("Request '%s %s' responded with invalid JSON: '%s'", method, path, bodyBytes)
+	}
+
+	if response != nil {
+		if err := json.Unmarshal(bodyBytes, response); err != nil {
+			return fmt.Errorf(
+				"Request '%s %s': cannot unmarshal JSON from: '%s' to '%+v': %s",
+				method,
+				path,
+				bodyBytes,
+				response,
+				err,
+			)
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) sendRequest(method, path string, data interface{}) error {
+	_, err := c.doAuthRequest(method, path, data)
+	return err
+}
+
+// doAuthRequest - same flow as ns.Provider uses: log in again on EAUTH, wait for async jobs
+func (c *Client) doAuthRequest(method, path string, data interface{}) ([]byte, error) {
+	l := c.log.WithField("func", "doAuthRequest()")
+
+	restClient := c.provider.RestClient
+	statusCode, bodyBytes, err := restClient.Send(method, path, data)
+	if err != nil {
+		return bodyBytes, err
+	}
+
+	// log in again if user is not logged in
+	nefError := c.parseNefError(bodyBytes, "checking login status")
+	if statusCode == http.StatusUnauthorized && ns.IsAuthNefError(nefError) {
+		l.Debugf("log in as '%s'...", c.provider.Username)
+		if err := c.provider.LogIn(); err != nil {
+			return nil, err
+		}
+
+		// send original request again
+		statusCode, bodyBytes, err = restClient.Send(method, path, data)
+		if err != nil {
+			return bodyBytes, err
+		}
+	}
+
+	if statusCode == http.StatusAccepted {
+		// this is an async job
+		var href string
+		href, err = c.parseAsyncJobHref(bodyBytes)
+		if err != nil {
+			return bodyBytes, err
+		}
+		err = c.waitForAsyncJob(strings.TrimPrefix(href, "/jobStatus/"))
+	} else if statusCode >= 300 {
+		if nefError := c.parseNefError(bodyBytes, "request error"); nefError != nil {
+			err = nefError
+		} else {
+			err = fmt.Errorf(
+				"Request returned %d code, but response body doesn't contain explanation: %v",
+				statusCode,
+				bodyBytes,
+			)
+		}
+	}
+
+	return bodyBytes, err
+}
+
+func (c *Client) parseAsyncJobHref(bodyBytes []byte) (string, error) {
+	response := struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}{}
+	if err := json.Unmarshal(bodyBytes, &response); err != nil {
+		return "", fmt.Errorf("Cannot parse NS response '%s' to '%+v': %s", bodyBytes, response, err)
+	}
+
+	for _, link := range response.Links {
+		if link.Rel == "monitor" && link.Href != "" {
+			return link.Href, nil
+		}
+	}
+
+	return "", fmt.Errorf("Request return an async job, but response doesn't contain any links: %v", bodyBytes)
+}
+
+// waitForAsyncJob - keep asking for job status while it's not completed, return an error if timeout exceeded
+func (c *Client) waitForAsyncJob(jobID string) error {
+	timeout := time.After(checkJobStatusTimeout)
+	for {
+		jobDone, err := c.provider.IsJobDone(jobID)
+		if err != nil {
+			return err
+		} else if jobDone {
+			return nil
+		}
+		select {
+		case <-time.After(checkJobStatusInterval):
+		case <-timeout:
+			return fmt.Errorf("Checking job status timeout exceeded (%s)", checkJobStatusTimeout)
+		}
+	}
+}
+
+// New - create NEF client for NexentaStor provider returned by ns.Resolver
+func New(nsProvider ns.ProviderInterface) (*Client, error) {
+	provider, ok := nsProvider.(*ns.Provider)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported NexentaStor provider type: %T", nsProvider)
+	}
+
+	return &Client{
+		provider: provider,
+		log:      provider.Log.WithField("cmp", "NefClient"),
+	}, nil
+}
@@ -0,0 +1,108 @@
+package nef
+
+import (
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// pool health states reported by NexentaStor
+const (
+	PoolHealthOnline   = "ONLINE"
+	PoolHealthDegraded = "DEGRADED"
+)
+
+// Pool - NexentaStor pool with its health state
+type Pool struct {
+	Name   string `json:"poolName"`
+	Health string `json:"health"`
+	Status string `json:"status"`
+}
+
+// IsHealthy - pool is online and has no faulted devices
+func (p *Pool) IsHealthy() bool {
+	return p.Health == PoolHealthOnline
+}
+
+// NfsShare - NexentaStor NFS share of a filesystem
+type NfsShare struct {
+	Filesystem       string               `json:"filesystem"`
+	SecurityContexts []NfsSecurityContext `json:"securityContexts"`
+}
+
+// NfsSecurityContext - NFS share access lists for security modes
+type NfsSecurityContext struct {
+	SecurityModes []string         `json:"securityModes"`
+	ReadWriteList []ns.NfsRuleList `json:"readWriteList"`
+	ReadOnlyList  []ns.NfsRuleList `json:"readOnlyList"`
+}
+
+type volumesResponse struct {
+	Data []ns.Volume `json:"data"`
+}
+
+// NVMe over Fabrics transport types
+const (
+	NvmeofTransportTCP = "tcp"
+)
+
+// NvmeofListener - NVMe over Fabrics subsystem transport address
+type NvmeofListener struct {
+	Transport string `json:"transport"`
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+}
+
+// NvmeofNamespace - zvol exported as a namespace of NVMe over Fabrics subsystem
+type NvmeofNamespace struct {
+	Nsid   int    `json:"nsid"`
+	Volume string `json:"volume"`
+	Nguid  string `json:"nguid"`
+}
+
+type nvmeofNamespacesResponse struct {
+	Data []NvmeofNamespace `json:"data"`
+}
+
+// FilesystemProperties - ZFS user properties of filesystem
+type FilesystemProperties struct {
+	Path           string            `json:"path"`
+	UserProperties map[string]string `json:"userProperties"`
+}
+
+type filesystemPropertiesResponse struct {
+	Data []FilesystemProperties `json:"data"`
+}
+
+// VolumeProperties - size and ZFS user properties of volume (zvol)
+type VolumeProperties struct {
+	Path           string            `json:"path"`
+	VolumeSize     int64             `json:"volumeSize"`
+	UserProperties map[string]string `json:"userProperties"`
+}
+
+type volumePropertiesResponse struct {
+	Data []VolumeProperties `json:"data"`
+}
+
+// SnapshotProperties - NexentaStor snapshot space usage and clones
+type SnapshotProperties struct {
+	Path            string   `json:"path"`
+	BytesReferenced int64    `json:"bytesReferenced"`
+	Clones          []string `json:"clones"`
+}
+
+type snapshotPropertiesResponse struct {
+	Data []SnapshotProperties `json:"data"`
+}
+
+// replication service states reported by NexentaStor
+const (
+	ReplicationServiceStateCompleted = "completed"
+	ReplicationServiceStateFaulted   = "faulted"
+)
+
+// ReplicationService - NexentaStor HPR service sending snapshots from one dataset to another
+type ReplicationService struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	LastError string `json:"lastError"`
+}
@@ -0,0 +1,189 @@
+// Package nvme - nvme-cli calls to attach NexentaStor NVMe/TCP namespaces to the node.
+// The node driver container must have host's /dev and /sys mounted and `nvme-tcp` kernel module
+// must be loaded on the host.
+package nvme
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPort - default NVMe/TCP port
+const DefaultPort = "4420"
+
+// hostNQNPrefix - host NQN of the node is "<prefix>:<nodeName>", the controller adds it to subsystem host list
+const hostNQNPrefix = "nqn.2005-07.com.nexenta:csi:host"
+
+const (
+	sysBlockPath        = "/sys/block"
+	sysClassNVMePath    = "/sys/class/nvme"
+	checkDeviceInterval = 500 * time.Millisecond
+)
+
+// Connection - NVMe/TCP namespace connection parameters
+type Connection struct {
+	// Portal - subsystem transport address "host:port"
+	Portal string `json:"portal"`
+	// SubsystemNQN - subsystem NQN
+	SubsystemNQN string `json:"subsystemNqn"`
+	// HostNQN - NQN the node connects with
+	HostNQN string `json:"hostNqn"`
+	// NGUID - namespace globally unique identifier
+	NGUID string `json:"nguid"`
+}
+
+func (c Connection) String() string {
+	return fmt.Sprintf("%s,%s,nguid-%s", c.Portal, c.SubsystemNQN, c.NGUID)
+}
+
+// HostNQN - host NQN used by the node with given name
+func HostNQN(nodeName string) string {
+	return fmt.Sprintf("%s:%s", hostNQNPrefix, strings.ToLower(nodeName))
+}
+
+// NormalizeNGUID - NGUID in sysfs format: lowercase hex w/o dashes
+func NormalizeNGUID(nguid string) string {
+	return strings.ToLower(strings.Replace(nguid, "-", "", -1))
+}
+
+// Connector - attaches/detaches NVMe/TCP namespaces using nvme-cli
+type Connector struct {
+	log *logrus.Entry
+}
+
+// Connect - connect to the subsystem and wait for namespace device, returns device path (e.g. /dev/nvme1n1)
+func (c *Connector) Connect(conn Connection, timeout time.Duration) (string, error) {
+	l := c.log.WithField("func", "Connect()")
+	l.Infof("connecting to %s", conn)
+
+	// namespace is already attached if its device exists
+	device, err := FindDevice(conn.NGUID)
+	if err != nil {
+		return "", err
+	} else if device != "" {
+		l.Infof("%s is already connected as '%s'", conn, device)
+		return device, nil
+	}
+
+	host, port, err := net.SplitHostPort(conn.Portal)
+	if err != nil {
+		return "", fmt.Errorf("Invalid NVMe/TCP portal '%s': %s", conn.Portal, err)
+	}
+	args := []string{"connect", "-t", "tcp", "-a", host, "-s", port, "-n", conn.SubsystemNQN}
+	if conn.HostNQN != "" {
+		args = append(args, "--hostnqn", conn.HostNQN)
+	}
+	if err := c.nvme(args...); err != nil && !strings.Contains(err.Error(), "already connected") {
+		return "", fmt.Errorf("Cannot connect to NVMe subsystem '%s' on '%s': %s", conn.SubsystemNQN, conn.Portal, err)
+	}
+
+	for start := time.Now(); ; {
+		device, err = FindDevice(conn.NGUID)
+		if err != nil {
+			return "", err
+		} else if device != "" {
+			break
+		}
+		if time.Since(start) > timeout {
+			return "", fmt.Errorf("Device of namespace '%s' didn't appear in %s", conn.NGUID, timeout)
+		}
+		time.Sleep(checkDeviceInterval)
+	}
+
+	l.Infof("%s is connected as '%s'", conn, device)
+	return device, nil
+}
+
+// Disconnect - disconnect all controllers of the subsystem, not connected subsystem is not an error
+func (c *Connector) Disconnect(conn Connection) error {
+	l := c.log.WithField("func", "Disconnect()")
+	l.Infof("disconnecting from %s", conn)
+
+	if err := c.nvme("disconnect", "-n", conn.SubsystemNQN); err != nil {
+		return fmt.Errorf("Cannot disconnect from NVMe subsystem '%s': %s", conn.SubsystemNQN, err)
+	}
+	return nil
+}
+
+// Rescan - rescan namespaces of all subsystem controllers to update device size after the zvol is expanded
+func (c *Connector) Rescan(conn Connection) error {
+	c.log.WithField("func", "Rescan()").Infof("rescanning %s", conn)
+
+	paths, err := filepath.Glob(filepath.Join(sysClassNVMePath, "nvme*", "subsysnqn"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("Cannot read '%s': %s", path, err)
+		}
+		if strings.TrimSpace(string(content)) != conn.SubsystemNQN {
+			continue
+		}
+		controller := filepath.Join("/dev", filepath.Base(filepath.Dir(path)))
+		if err := c.nvme("ns-rescan", controller); err != nil {
+			return fmt.Errorf("Cannot rescan NVMe controller '%s': %s", controller, err)
+		}
+	}
+	return nil
+}
+
+func (c *Connector) nvme(args ...string) error {
+	c.log.WithField("func", "nvme()").Debugf("nvme %s", strings.Join(args, " "))
+	out, err := exec.Command("nvme", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// FindDevice - find namespace block device by its NGUID, returns empty string if it's not attached
+func FindDevice(nguid string) (string, error) {
+	return FindDeviceIn(sysBlockPath, nguid)
+}
+
+// FindDeviceIn - find namespace block device by its NGUID in sysfs block directory (/sys/block)
+func FindDeviceIn(sysBlockDir, nguid string) (string, error) {
+	nguid = NormalizeNGUID(nguid)
+	if nguid == "" {
+		return "", fmt.Errorf("Namespace NGUID is empty")
+	}
+
+	// with native NVMe multipath only namespace head devices (nvmeXnY) are listed in /sys/block
+	paths, err := filepath.Glob(filepath.Join(sysBlockDir, "nvme*n*", "nguid"))
+	if err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", fmt.Errorf("Cannot read '%s': %s", path, err)
+		}
+		if NormalizeNGUID(strings.TrimSpace(string(content))) == nguid {
+			return filepath.Join("/dev", filepath.Base(filepath.Dir(path))), nil
+		}
+	}
+	return "", nil
+}
+
+// New - create NVMe connector
+func New(log *logrus.Entry) *Connector {
+	return &Connector{
+		log: log.WithField("cmp", "NVMeConnector"),
+	}
+}
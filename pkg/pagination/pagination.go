@@ -0,0 +1,74 @@
+// Package pagination - opaque continuation tokens for list requests spanning several NexentaStors.
+package pagination
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Token - position in a list across NexentaStors: config name and cursor on that NexentaStor,
+// the listing continues after the cursor, from the beginning if cursor is empty. Listing ID is the same
+// for all pages of one listing, so data collected for the first page may be reused by the next ones.
+type Token struct {
+	ConfigName string `json:"c"`
+	Cursor     string `json:"p,omitempty"`
+	ListingID  string `json:"l,omitempty"`
+}
+
+// NewListingID - random ID of a new listing
+func NewListingID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Encode - encode token to an opaque string
+func (t Token) Encode() string {
+	content, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// Decode - decode token string created by Token.Encode(), empty string is a token of the list beginning
+func Decode(token string) (t Token, err error) {
+	if token == "" {
+		return t, nil
+	}
+	content, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return t, fmt.Errorf("invalid token '%s': %s", token, err)
+	}
+	if err := json.Unmarshal(content, &t); err != nil {
+		return t, fmt.Errorf("invalid token '%s': %s", token, err)
+	}
+	if t.ConfigName == "" {
+		return t, fmt.Errorf("invalid token '%s': config name is empty", token)
+	}
+	return t, nil
+}
+
+// SortedConfigNames - config names in deterministic order, token config name must be one of them
+func SortedConfigNames(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// StartIndex - index of the token config name in sorted config names to continue listing from
+func StartIndex(sortedNames []string, t Token) (int, error) {
+	if t.ConfigName == "" {
+		return 0, nil
+	}
+	for i, name := range sortedNames {
+		if name == t.ConfigName {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("config name '%s' from token is not found", t.ConfigName)
+}
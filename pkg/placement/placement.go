@@ -0,0 +1,182 @@
+// Package placement - policies to pick a NexentaStor appliance for a new volume
+// when StorageClass doesn't set `configName`.
+package placement
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// placement policies, `placementPolicy` StorageClass parameter values
+const (
+	// PolicyMostFree - appliance with the most free space in the parent dataset
+	PolicyMostFree = "mostFree"
+	// PolicyFewestVolumes - appliance with the fewest volumes in the parent dataset
+	PolicyFewestVolumes = "fewestVolumes"
+	// PolicyRoundRobin - appliances in turn
+	PolicyRoundRobin = "roundRobin"
+	// PolicyWeighted - appliances in turn, proportionally to their `placementWeight`
+	PolicyWeighted = "weighted"
+)
+
+// DefaultPolicy - policy used if `placementPolicy` StorageClass parameter is not set
+const DefaultPolicy = PolicyMostFree
+
+// Policies - list of supported placement policies
+var Policies = []string{PolicyMostFree, PolicyFewestVolumes, PolicyRoundRobin, PolicyWeighted}
+
+// Candidate - appliance able to host a volume with its live capacity data
+type Candidate struct {
+	// Name - config name of the appliance
+	Name string
+	// FreeBytes - free space in the parent dataset
+	FreeBytes int64
+	// PoolFreeBytes, PoolSizeBytes - free and total space of the parent dataset's pool
+	PoolFreeBytes int64
+	PoolSizeBytes int64
+	// VolumeCount - number of volumes in the parent dataset
+	VolumeCount int
+	// Weight - share of volumes for weighted policy, 1 if not set
+	Weight int
+	// MinPoolFreePercent - volumes are not placed on the appliance if its pool has less free space
+	MinPoolFreePercent int
+}
+
+// PoolFreePercent - free space of the pool in percents, 100 if pool size is unknown
+func (c Candidate) PoolFreePercent() float64 {
+	if c.PoolSizeBytes <= 0 {
+		return 100
+	}
+	return float64(c.PoolFreeBytes) * 100 / float64(c.PoolSizeBytes)
+}
+
+func (c Candidate) weight() int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// IsValidPolicy - true if policy is supported
+func IsValidPolicy(policy string) bool {
+	for _, p := range Policies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// NoCandidatesError - none of the appliances can host the volume
+type NoCandidatesError struct {
+	Reasons []string
+}
+
+func (e *NoCandidatesError) Error() string {
+	return fmt.Sprintf("no appliance can host the volume: %v", e.Reasons)
+}
+
+// Placer - picks an appliance by placement policy, keeps round-robin and weighted policies state
+type Placer struct {
+	mutex          sync.Mutex
+	roundRobinNext int
+	currentWeights map[string]int
+}
+
+// Select - filter out appliances below the pool free space floor or without enough free space for the volume
+// reservation and pick one of the rest by the policy, thin volumes (reservedBytes is 0) may overcommit free space
+func (p *Placer) Select(policy string, candidates []Candidate, reservedBytes int64) (Candidate, error) {
+	if policy == "" {
+		policy = DefaultPolicy
+	} else if !IsValidPolicy(policy) {
+		return Candidate{}, fmt.Errorf("unsupported placement policy '%s', supported: %v", policy, Policies)
+	}
+
+	filtered := []Candidate{}
+	reasons := []string{}
+	for _, c := range candidates {
+		if c.PoolFreePercent() < float64(c.MinPoolFreePercent) {
+			reasons = append(reasons, fmt.Sprintf(
+				"%s: pool free space %.1f%% is below %d%%",
+				c.Name,
+				c.PoolFreePercent(),
+				c.MinPoolFreePercent,
+			))
+		} else if reservedBytes > 0 && c.FreeBytes < reservedBytes {
+			reasons = append(reasons, fmt.Sprintf(
+				"%s: free space %d is less than reserved %d bytes",
+				c.Name,
+				c.FreeBytes,
+				reservedBytes,
+			))
+		} else {
+			filtered = append(filtered, c)
+		}
+	}
+	if len(filtered) == 0 {
+		return Candidate{}, &NoCandidatesError{Reasons: reasons}
+	}
+
+	// stable order, so ties are resolved the same way every time
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Name < filtered[j].Name
+	})
+
+	switch policy {
+	case PolicyFewestVolumes:
+		best := filtered[0]
+		for _, c := range filtered[1:] {
+			if c.VolumeCount < best.VolumeCount ||
+				(c.VolumeCount == best.VolumeCount && c.FreeBytes > best.FreeBytes) {
+				best = c
+			}
+		}
+		return best, nil
+	case PolicyRoundRobin:
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		c := filtered[p.roundRobinNext%len(filtered)]
+		p.roundRobinNext++
+		return c, nil
+	case PolicyWeighted:
+		return p.selectWeighted(filtered), nil
+	default:
+		best := filtered[0]
+		for _, c := range filtered[1:] {
+			if c.FreeBytes > best.FreeBytes {
+				best = c
+			}
+		}
+		return best, nil
+	}
+}
+
+// selectWeighted - smooth weighted round-robin: every candidate gains its weight,
+// the one with the highest current weight is picked and loses the total weight
+func (p *Placer) selectWeighted(candidates []Candidate) Candidate {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	total := 0
+	var best Candidate
+	bestWeight := 0
+	for i, c := range candidates {
+		total += c.weight()
+		p.currentWeights[c.Name] += c.weight()
+		if i == 0 || p.currentWeights[c.Name] > bestWeight {
+			best = c
+			bestWeight = p.currentWeights[c.Name]
+		}
+	}
+	p.currentWeights[best.Name] -= total
+
+	return best
+}
+
+// New - create placer
+func New() *Placer {
+	return &Placer{
+		currentWeights: map[string]int{},
+	}
+}
@@ -0,0 +1,138 @@
+// Package zfs - ZFS filesystem properties set from StorageClass parameters.
+// Only an allowlist of tuning properties is accepted, properties managed by the driver
+// (quotas, reservations, mountpoint, shares) or changing dataset semantics are rejected.
+package zfs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParameterPrefix - StorageClass parameter prefix of ZFS properties, e.g. "zfs.compression: lz4"
+const ParameterPrefix = "zfs."
+
+// record size limits, it must be a power of 2
+const (
+	minRecordSize = 512
+	maxRecordSize = 1024 * 1024
+)
+
+// Properties - validated ZFS properties as NexentaStor filesystem fields
+type Properties map[string]interface{}
+
+type property struct {
+	// nefField - NexentaStor filesystem field name of ZFS property
+	nefField string
+	parse    func(value string) (interface{}, error)
+}
+
+var allowedProperties = map[string]property{
+	"compression": {"compressionMode", oneOf("on", "off", "lz4", "lzjb", "zle", "gzip",
+		"gzip-1", "gzip-2", "gzip-3", "gzip-4", "gzip-5", "gzip-6", "gzip-7", "gzip-8", "gzip-9")},
+	"recordsize": {"recordSize", parseRecordSize},
+	"atime":      {"atime", parseOnOff},
+	"sync":       {"syncMode", oneOf("standard", "always", "disabled")},
+	"logbias":    {"logBias", oneOf("latency", "throughput")},
+	"dedup":      {"dedupMode", oneOf("on", "off", "verify", "sha256", "sha256,verify")},
+	"copies":     {"copies", parseCopies},
+}
+
+// unsafeProperties - properties managed by the driver or changing dataset visibility and semantics,
+// they are rejected with a dedicated message
+var unsafeProperties = map[string]bool{
+	"mountpoint":      true,
+	"canmount":        true,
+	"quota":           true,
+	"refquota":        true,
+	"reservation":     true,
+	"refreservation":  true,
+	"sharenfs":        true,
+	"sharesmb":        true,
+	"readonly":        true,
+	"volsize":         true,
+	"zoned":           true,
+	"encryption":      true,
+	"keyformat":       true,
+	"keylocation":     true,
+	"casesensitivity": true,
+	"normalization":   true,
+	"utf8only":        true,
+}
+
+// AllowedNames - sorted names of ZFS properties which can be set from StorageClass parameters
+func AllowedNames() []string {
+	names := []string{}
+	for name := range allowedProperties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FromParameters - validate and convert "zfs."-prefixed StorageClass parameters,
+// other parameters are ignored, empty result means nothing to set
+func FromParameters(parameters map[string]string) (Properties, error) {
+	properties := Properties{}
+	for key, value := range parameters {
+		if !strings.HasPrefix(key, ParameterPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(key, ParameterPrefix))
+		if unsafeProperties[name] {
+			return nil, fmt.Errorf("ZFS property '%s' is managed by the driver or unsafe and cannot be set", name)
+		}
+		p, ok := allowedProperties[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown ZFS property '%s', supported: %v", name, AllowedNames())
+		}
+		parsed, err := p.parse(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of ZFS property '%s': %s", name, err)
+		}
+		properties[p.nefField] = parsed
+	}
+	return properties, nil
+}
+
+func oneOf(values ...string) func(string) (interface{}, error) {
+	return func(value string) (interface{}, error) {
+		for _, v := range values {
+			if strings.ToLower(value) == v {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("'%s' is not one of %v", value, values)
+	}
+}
+
+func parseOnOff(value string) (interface{}, error) {
+	switch strings.ToLower(value) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return nil, fmt.Errorf("'%s' is not one of [on off]", value)
+}
+
+func parseCopies(value string) (interface{}, error) {
+	copies, err := strconv.Atoi(value)
+	if err != nil || copies < 1 || copies > 3 {
+		return nil, fmt.Errorf("'%s' is not one of [1 2 3]", value)
+	}
+	return copies, nil
+}
+
+// parseRecordSize - record size in bytes or with K/M suffix, e.g. "16K", power of 2 from 512 to 1M
+func parseRecordSize(value string) (interface{}, error) {
+	size, err := ParseSize(value)
+	if err != nil {
+		return nil, err
+	}
+	if size < minRecordSize || size > maxRecordSize || size&(size-1) != 0 {
+		return nil, fmt.Errorf("'%s' is not a power of 2 from 512 to 1M", value)
+	}
+	return size, nil
+}
@@ -0,0 +1,36 @@
+package zfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// size suffix multipliers, ZFS sizes are binary: "K" and "Ki" are both 1024
+var sizeMultipliers = map[string]int64{
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseSize - size in bytes or with K, M, G, T suffix (or Ki, Mi, Gi, Ti), e.g. "16K", "10Gi"
+func ParseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "I")
+	multiplier := int64(1)
+	if len(number) != 0 {
+		if m, ok := sizeMultipliers[number[len(number)-1:]]; ok {
+			multiplier = m
+			number = number[:len(number)-1]
+		} else if number != strings.ToUpper(strings.TrimSpace(value)) {
+			// "i" without a suffix letter
+			return 0, fmt.Errorf("'%s' is not a size", value)
+		}
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > (1<<62)/multiplier {
+		return 0, fmt.Errorf("'%s' is not a size", value)
+	}
+	return size * multiplier, nil
+}
@@ -19,7 +19,8 @@ import (
 )
 
 const (
-	defaultSecretName = "nexentastor-csi-driver-config"
+	defaultSecretName     = "nexentastor-csi-driver-config"
+	defaultNodeSecretName = "nexentastor-csi-driver-node-config"
 )
 
 type config struct {
@@ -27,6 +28,7 @@ type config struct {
 	k8sDeploymentFile   string
 	k8sSecretFile       string
 	k8sSecretName       string
+	k8sNodeSecretName   string
 }
 
 var c *config
@@ -44,6 +46,7 @@ func TestMain(m *testing.M) {
 		k8sDeploymentFile   = flag.String("k8sDeploymentFile", "", "path to driver deployment yaml file")
 		k8sSecretFile       = flag.String("k8sSecretFile", "", "path to yaml driver config file (for k8s secret)")
 		k8sSecretName       = flag.String("k8sSecretName", defaultSecretName, "k8s secret name")
+		k8sNodeSecretName   = flag.String("k8sNodeSecretName", defaultNodeSecretName, "k8s node secret name")
 		fsTypeFlag          = flag.String("fsTypeFlag", "", "FS type for tests (nfs/cifs/block)")
 	)
 
@@ -65,6 +68,7 @@ func TestMain(m *testing.M) {
 		k8sDeploymentFile:   *k8sDeploymentFile,
 		k8sSecretFile:       *k8sSecretFile,
 		k8sSecretName:       *k8sSecretName,
+		k8sNodeSecretName:   *k8sNodeSecretName,
 	}
 
 	fsType = *fsTypeFlag
@@ -90,6 +94,7 @@ func TestMain(m *testing.M) {
 	l.Infof(" - driver yaml:   %s", c.k8sDeploymentFile)
 	l.Infof(" - driver config: %s", c.k8sSecretFile)
 	l.Infof(" - secret name:   %s", c.k8sSecretName)
+	l.Infof(" - node secret:   %s", c.k8sNodeSecretName)
 
 	os.Exit(m.Run())
 }
@@ -160,11 +165,12 @@ func TestDriver_deploy(t *testing.T) {
 	l.Infof("kubectl version:\n%s", out)
 
 	k8sDriver, err := k8s.NewDeployment(k8s.DeploymentArgs{
-		RemoteClient: rc,
-		ConfigFile:   c.k8sDeploymentFile,
-		SecretFile:   c.k8sSecretFile,
-		SecretName:   c.k8sSecretName,
-		Log:          l,
+		RemoteClient:   rc,
+		ConfigFile:     c.k8sDeploymentFile,
+		SecretFile:     c.k8sSecretFile,
+		SecretName:     c.k8sSecretName,
+		NodeSecretName: c.k8sNodeSecretName,
+		Log:            l,
 	})
 	defer k8sDriver.CleanUp()
 	defer k8sDriver.Delete(nil)
@@ -63,6 +63,75 @@ func TestConfig_Short(t *testing.T) {
 	}
 }
 
+func TestConfig_ControllerSharing(t *testing.T) {
+	path := "./_fixtures/test-config-controller-sharing"
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatalf("config without credentials should be valid if 'controllerSharing' is set, file '%s': %s", path, err)
+	}
+
+	cfg, ok := c.NsMap["nsNode"]
+	if !ok {
+		t.Fatalf("config '%s' should contain 'nsNode' NexentaStor, but got: %+v", path, c.NsMap)
+	}
+	if !cfg.ControllerSharing {
+		t.Errorf("Param 'ControllerSharing' expected to be true, file '%s'", path)
+	}
+	if cfg.HasCredentials() {
+		t.Errorf("Config '%s' has no NexentaStor credentials, but HasCredentials() returns true", path)
+	}
+	testParam(t, "DefaultMountOptions", testConfigParams["DefaultMountOptions"], cfg.DefaultMountOptions)
+}
+
+func TestConfig_NamespaceDatasets(t *testing.T) {
+	path := "./_fixtures/test-config-namespace-datasets"
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatalf("cannot read config file '%s': %s", path, err)
+	}
+
+	cfg := c.NsMap["nsNode"]
+	if !cfg.NamespaceDatasets || !cfg.RemoveEmptyNamespaceDatasets {
+		t.Errorf("namespace dataset options expected to be set, file '%s': %+v", path, cfg)
+	}
+	for namespace, expected := range map[string]int64{
+		"team-a": 100 * 1024 * 1024 * 1024,
+		"team-b": 1024 * 1024 * 1024 * 1024,
+		"team-c": 0,
+	} {
+		quota, err := cfg.GetNamespaceQuota(namespace)
+		if err != nil {
+			t.Errorf("cannot get quota of '%s': %s", namespace, err)
+		} else if quota != expected {
+			t.Errorf("quota of '%s' expected to be %d, but got %d", namespace, expected, quota)
+		}
+	}
+}
+
+func TestConfig_Trash(t *testing.T) {
+	path := "./_fixtures/test-config-trash"
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatalf("cannot read config file '%s': %s", path, err)
+	}
+
+	for name, expected := range map[string]time.Duration{
+		"nsNode":                 72 * time.Hour,
+		"nsNodeDefaultRetention": config.DefaultTrashRetention,
+	} {
+		retention, err := c.NsMap[name].GetTrashRetention()
+		if err != nil {
+			t.Errorf("cannot get trash retention of '%s': %s", name, err)
+		} else if retention != expected {
+			t.Errorf("trash retention of '%s' expected to be %s, but got %s", name, expected, retention)
+		}
+	}
+	testParam(t, "TrashDataset", "poolA/trash", c.NsMap["nsNode"].TrashDataset)
+}
+
 func TestConfig_Not_Valid(t *testing.T) {
 
 	t.Run("should return an error if config file if not valid", func(t *testing.T) {
@@ -99,6 +168,36 @@ func TestConfig_Not_Valid(t *testing.T) {
 		}
 	})
 
+	t.Run("should return an error if namespace quota is invalid", func(t *testing.T) {
+		path := "./_fixtures/test-config-not-valid-namespace-quota"
+		c, err := config.New(path)
+		if err == nil {
+			t.Fatalf("should return an error for file '%s' but returns config: %+v", path, c)
+		} else if !strings.Contains(err.Error(), "namespaceQuotas") {
+			t.Fatalf("should return an error with 'namespaceQuotas' text for file '%s' but returns this: %s", path, err)
+		}
+	})
+
+	t.Run("should return an error if trash retention is invalid", func(t *testing.T) {
+		path := "./_fixtures/test-config-not-valid-trash-retention"
+		c, err := config.New(path)
+		if err == nil {
+			t.Fatalf("should return an error for file '%s' but returns config: %+v", path, c)
+		} else if !strings.Contains(err.Error(), "trashRetention") {
+			t.Fatalf("should return an error with 'trashRetention' text for file '%s' but returns this: %s", path, err)
+		}
+	})
+
+	t.Run("should return an error if trash dataset is in other pool than default dataset", func(t *testing.T) {
+		path := "./_fixtures/test-config-not-valid-trash-pool"
+		c, err := config.New(path)
+		if err == nil {
+			t.Fatalf("should return an error for file '%s' but returns config: %+v", path, c)
+		} else if !strings.Contains(err.Error(), "trashDataset") {
+			t.Fatalf("should return an error with 'trashDataset' text for file '%s' but returns this: %s", path, err)
+		}
+	})
+
 	t.Run("should return an error if one of the addresses is invalid", func(t *testing.T) {
 		path := "./_fixtures/test-config-not-valid-address"
 		c, err := config.New(path)
@@ -0,0 +1,65 @@
+package connection_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/connection"
+)
+
+func TestNormalizePortal(t *testing.T) {
+	cases := map[string]string{
+		"10.1.1.1":       "10.1.1.1:3260",
+		"10.1.1.1:3261":  "10.1.1.1:3261",
+		"fd00::1":        "[fd00::1]:3260",
+		"[fd00::1]":      "[fd00::1]:3260",
+		"[fd00::1]:3261": "[fd00::1]:3261",
+		"nexenta.local":  "nexenta.local:3260",
+	}
+	for portal, expected := range cases {
+		if given := connection.NormalizePortal(portal, "3260"); given != expected {
+			t.Errorf("NormalizePortal('%s') expected to be '%s', but got '%s'", portal, expected, given)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	type testConnection struct {
+		Portal string `json:"portal"`
+		Target string `json:"target"`
+		Lun    int    `json:"lun"`
+	}
+
+	dir, err := ioutil.TempDir("", "connection-test")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "connection.json")
+	conn := testConnection{
+		Portal: "10.1.1.1:3260",
+		Target: "iqn.2005-07.com.nexenta:01:csi.pvc-1",
+		Lun:    1,
+	}
+
+	if err := connection.Save(filePath, conn); err != nil {
+		t.Fatalf("cannot save connection to '%s': %s", filePath, err)
+	}
+	loaded := testConnection{}
+	if err := connection.Load(filePath, &loaded); err != nil {
+		t.Fatalf("cannot load connection from '%s': %s", filePath, err)
+	}
+	if loaded != conn {
+		t.Errorf("loaded connection expected to be '%+v', but got '%+v'", conn, loaded)
+	}
+
+	t.Run("should return an error if file doesn't exist", func(t *testing.T) {
+		err := connection.Load(filepath.Join(dir, "not-exists.json"), &loaded)
+		if !os.IsNotExist(err) {
+			t.Errorf("not existing file should return IsNotExist error, but got: %v", err)
+		}
+	})
+}
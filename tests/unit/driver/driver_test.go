@@ -0,0 +1,31 @@
+package driver_test
+
+import (
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/driver"
+)
+
+func TestIsApplianceSegmentMatched(t *testing.T) {
+	segments := map[string]string{
+		driver.TopologyKeyZone:                     "zone-1",
+		driver.TopologyKeyAppliancePrefix + "ns-1": "true",
+		driver.TopologyKeyAppliancePrefix + "ns-2": "true",
+		driver.TopologyKeyAppliancePrefix + "ns-3": "false",
+	}
+
+	for _, name := range []string{"ns-1", "ns-2"} {
+		if !driver.IsApplianceSegmentMatched(segments, name) {
+			t.Errorf("expected '%s' to match segments reachable by several NexentaStors: %v", name, segments)
+		}
+	}
+	if driver.IsApplianceSegmentMatched(segments, "ns-3") {
+		t.Errorf("expected 'ns-3' not to match segments where it's not reachable: %v", segments)
+	}
+	if !driver.IsApplianceSegmentMatched(segments, "ns-4") {
+		t.Errorf("expected 'ns-4' to match segments without its key: %v", segments)
+	}
+	if !driver.IsApplianceSegmentMatched(nil, "ns-1") {
+		t.Error("expected 'ns-1' to match empty segments")
+	}
+}
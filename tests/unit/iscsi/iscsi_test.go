@@ -0,0 +1,26 @@
+package iscsi_test
+
+import (
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/iscsi"
+)
+
+func TestConnection_DevicePath(t *testing.T) {
+	conn := iscsi.Connection{
+		Portal: "10.1.1.1:3260",
+		Target: "iqn.2005-07.com.nexenta:01:csi.pvc-1",
+		Lun:    3,
+	}
+	expected := "/dev/disk/by-path/ip-10.1.1.1:3260-iscsi-iqn.2005-07.com.nexenta:01:csi.pvc-1-lun-3"
+	if given := conn.DevicePath(); given != expected {
+		t.Errorf("DevicePath() expected to be '%s', but got '%s'", expected, given)
+	}
+}
+
+func TestInitiatorName(t *testing.T) {
+	expected := "iqn.2005-07.com.nexenta:csi:host:worker-1"
+	if given := iscsi.InitiatorName("Worker-1"); given != expected {
+		t.Errorf("InitiatorName() expected to be '%s', but got '%s'", expected, given)
+	}
+}
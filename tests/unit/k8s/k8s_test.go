@@ -0,0 +1,90 @@
+package k8s_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/k8s"
+)
+
+func TestClient_GetNodeAnnotations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/nodes/node-1":
+			w.Write([]byte(`{"metadata":{"name":"node-1",` +
+				`"annotations":{"nexentastor-csi-driver.nexenta.com/node-ip":"fd00::1"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := k8s.NewClient(server.URL, "token", server.Client())
+
+	t.Run("should return node annotations", func(t *testing.T) {
+		annotations, err := client.GetNodeAnnotations("node-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := annotations["nexentastor-csi-driver.nexenta.com/node-ip"]; value != "fd00::1" {
+			t.Errorf("expected 'fd00::1' annotation value, but got '%s'", value)
+		}
+	})
+
+	t.Run("should return NotFoundError for not existing node", func(t *testing.T) {
+		_, err := client.GetNodeAnnotations("node-2")
+		if !k8s.IsNotFoundError(err) {
+			t.Errorf("expected NotFoundError, but got: %v", err)
+		}
+	})
+
+	t.Run("should return an error for API errors", func(t *testing.T) {
+		_, err := k8s.NewClient(server.URL, "", server.Client()).GetNodeAnnotations("node-1")
+		if err == nil || k8s.IsNotFoundError(err) {
+			t.Errorf("expected an error, but got: %v", err)
+		}
+	})
+}
+
+func TestClient_SetNodeAnnotation(t *testing.T) {
+	var method, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/nodes/node-1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		method, contentType, body = r.Method, r.Header.Get("Content-Type"), string(data)
+		w.Write([]byte(`{"metadata":{"name":"node-1"}}`))
+	}))
+	defer server.Close()
+
+	client := k8s.NewClient(server.URL, "token", server.Client())
+
+	t.Run("should send merge patch with the annotation", func(t *testing.T) {
+		if err := client.SetNodeAnnotation("node-1", "a/b", "10.3.1.1"); err != nil {
+			t.Fatal(err)
+		}
+		if method != http.MethodPatch {
+			t.Errorf("expected PATCH request, but got '%s'", method)
+		}
+		if contentType != "application/merge-patch+json" {
+			t.Errorf("expected merge patch content type, but got '%s'", contentType)
+		}
+		if expected := `{"metadata":{"annotations":{"a/b":"10.3.1.1"}}}`; body != expected {
+			t.Errorf("expected '%s' body, but got '%s'", expected, body)
+		}
+	})
+
+	t.Run("should return NotFoundError for not existing node", func(t *testing.T) {
+		if err := client.SetNodeAnnotation("node-2", "a/b", "10.3.1.1"); !k8s.IsNotFoundError(err) {
+			t.Errorf("expected NotFoundError, but got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package naming_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/naming"
+)
+
+func TestNewTemplateData(t *testing.T) {
+	t.Run("should take UID from CSI volume name", func(t *testing.T) {
+		data := naming.NewTemplateData("pvc-ns-5ac0b7f6-2d4e-4c1b-9a3f-0123456789ab", map[string]string{
+			naming.ParameterPVCName:      "data",
+			naming.ParameterPVCNamespace: "team-a",
+			naming.ParameterPVName:       "pvc-ns-5ac0b7f6-2d4e-4c1b-9a3f-0123456789ab",
+		})
+		expected := naming.TemplateData{
+			Name:         "pvc-ns-5ac0b7f6-2d4e-4c1b-9a3f-0123456789ab",
+			PVCName:      "data",
+			PVCNamespace: "team-a",
+			PVName:       "pvc-ns-5ac0b7f6-2d4e-4c1b-9a3f-0123456789ab",
+			UID:          "5ac0b7f6-2d4e-4c1b-9a3f-0123456789ab",
+			ShortUID:     "5ac0b7f6",
+		}
+		if data != expected {
+			t.Errorf("expected %+v, but got %+v", expected, data)
+		}
+	})
+
+	t.Run("should hash CSI volume name without UID", func(t *testing.T) {
+		data := naming.NewTemplateData("my-volume", nil)
+		if len(data.UID) != 32 || len(data.ShortUID) != 8 || !strings.HasPrefix(data.UID, data.ShortUID) {
+			t.Errorf("expected hash UID, but got %+v", data)
+		}
+		if again := naming.NewTemplateData("my-volume", nil); again != data {
+			t.Errorf("expected the same data for the same name, but got %+v and %+v", data, again)
+		}
+	})
+}
+
+func TestTemplate(t *testing.T) {
+	data := naming.NewTemplateData("pvc-5ac0b7f6-2d4e-4c1b-9a3f-0123456789ab", map[string]string{
+		naming.ParameterPVCName:      "data",
+		naming.ParameterPVCNamespace: "team-a",
+	})
+
+	t.Run("should render nested volume name", func(t *testing.T) {
+		template, err := naming.ParseTemplate("{{.PVCNamespace}}/{{.PVCName}}-{{.ShortUID}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, err := template.Render(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "team-a/data-5ac0b7f6" {
+			t.Errorf("expected 'team-a/data-5ac0b7f6', but got '%s'", name)
+		}
+	})
+
+	t.Run("should return an error for unknown fields", func(t *testing.T) {
+		if _, err := naming.ParseTemplate("{{.Namespace}}/{{.Name}}"); err == nil {
+			t.Error("expected an error for unknown field")
+		}
+	})
+
+	t.Run("should return an error for empty template", func(t *testing.T) {
+		if _, err := naming.ParseTemplate(" "); err == nil {
+			t.Error("expected an error for empty template")
+		}
+	})
+
+	t.Run("should return an error if metadata is missing", func(t *testing.T) {
+		template, err := naming.ParseTemplate("{{.PVCNamespace}}/{{.PVName}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := template.Render(data); err == nil {
+			t.Errorf("expected an error for empty PV name, but got '%s'", name)
+		}
+	})
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"pvc-1", "team-a/data_1.0", "a/b/c"} {
+		if err := naming.ValidateName(name); err != nil {
+			t.Errorf("expected '%s' to be valid, but got: %s", name, err)
+		}
+	}
+	for _, name := range []string{"", "/abs", "a//b", "a/", "../a", "a/./b", "a b", "a:b", "a@b", "a%b"} {
+		if err := naming.ValidateName(name); err == nil {
+			t.Errorf("expected an error for '%s'", name)
+		}
+	}
+}
+
+func TestValidateDatasetPath(t *testing.T) {
+	if err := naming.ValidateDatasetPath("pool/" + strings.Repeat("a", 250)); err != nil {
+		t.Errorf("expected 255 characters path to be valid, but got: %s", err)
+	}
+	if err := naming.ValidateDatasetPath("pool/" + strings.Repeat("a", 251)); err == nil {
+		t.Error("expected an error for 256 characters path")
+	}
+}
@@ -0,0 +1,85 @@
+package nvme_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/nvme"
+)
+
+func TestHostNQN(t *testing.T) {
+	expected := "nqn.2005-07.com.nexenta:csi:host:worker-1"
+	if given := nvme.HostNQN("Worker-1"); given != expected {
+		t.Errorf("HostNQN() expected to be '%s', but got '%s'", expected, given)
+	}
+}
+
+func TestNormalizeNGUID(t *testing.T) {
+	cases := map[string]string{
+		"6E7B6A1C-0D2F-4B5A-8C9D-1E2F3A4B5C6D": "6e7b6a1c0d2f4b5a8c9d1e2f3a4b5c6d",
+		"6e7b6a1c0d2f4b5a8c9d1e2f3a4b5c6d":     "6e7b6a1c0d2f4b5a8c9d1e2f3a4b5c6d",
+	}
+	for nguid, expected := range cases {
+		if given := nvme.NormalizeNGUID(nguid); given != expected {
+			t.Errorf("NormalizeNGUID('%s') expected to be '%s', but got '%s'", nguid, expected, given)
+		}
+	}
+}
+
+func TestFindDeviceIn(t *testing.T) {
+	sysBlockDir, err := ioutil.TempDir("", "nvme-test")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(sysBlockDir)
+
+	// namespace heads of two subsystems and a SCSI disk without nguid
+	devices := map[string]string{
+		"nvme0n1": "00000000-0000-0000-0000-000000000000\n",
+		"nvme1n1": "6e7b6a1c-0d2f-4b5a-8c9d-1e2f3a4b5c6d\n",
+		"nvme1n2": "6e7b6a1c-0d2f-4b5a-8c9d-1e2f3a4b5c6e\n",
+		"sda":     "",
+	}
+	for device, nguid := range devices {
+		dir := filepath.Join(sysBlockDir, device)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if nguid == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "nguid"), []byte(nguid), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("should find device by NGUID in any format", func(t *testing.T) {
+		for _, nguid := range []string{"6E7B6A1C-0D2F-4B5A-8C9D-1E2F3A4B5C6D", "6e7b6a1c0d2f4b5a8c9d1e2f3a4b5c6d"} {
+			device, err := nvme.FindDeviceIn(sysBlockDir, nguid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device != "/dev/nvme1n1" {
+				t.Errorf("expected '/dev/nvme1n1' for '%s', but got '%s'", nguid, device)
+			}
+		}
+	})
+
+	t.Run("should return empty device if namespace is not attached", func(t *testing.T) {
+		device, err := nvme.FindDeviceIn(sysBlockDir, "6e7b6a1c0d2f4b5a8c9d1e2f3a4b5c6f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device != "" {
+			t.Errorf("expected empty device, but got '%s'", device)
+		}
+	})
+
+	t.Run("should return an error for empty NGUID", func(t *testing.T) {
+		if _, err := nvme.FindDeviceIn(sysBlockDir, ""); err == nil {
+			t.Error("expected an error for empty NGUID")
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package pagination_test
+
+import (
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/pagination"
+)
+
+func TestToken_EncodeDecode(t *testing.T) {
+	token := pagination.Token{ConfigName: "nstor-box2", Cursor: "pool/csi/pvc-1", ListingID: pagination.NewListingID()}
+	decoded, err := pagination.Decode(token.Encode())
+	if err != nil {
+		t.Fatalf("cannot decode token: %s", err)
+	}
+	if decoded != token {
+		t.Errorf("decoded token expected to be '%+v', but got '%+v'", token, decoded)
+	}
+
+	t.Run("empty string should be a token of the list beginning", func(t *testing.T) {
+		decoded, err := pagination.Decode("")
+		if err != nil {
+			t.Fatal(err)
+		} else if decoded != (pagination.Token{}) {
+			t.Errorf("expected empty token, but got '%+v'", decoded)
+		}
+	})
+
+	t.Run("invalid token should return an error", func(t *testing.T) {
+		for _, s := range []string{"invalid-token", "pool/csi/pvc-1", pagination.Token{Cursor: "a"}.Encode()} {
+			if _, err := pagination.Decode(s); err == nil {
+				t.Errorf("token '%s' should return an error", s)
+			}
+		}
+	})
+}
+
+func TestNewListingID(t *testing.T) {
+	id := pagination.NewListingID()
+	if id == "" {
+		t.Fatal("listing ID is empty")
+	} else if another := pagination.NewListingID(); another == id {
+		t.Errorf("listing IDs expected to be different, but got '%s' twice", id)
+	}
+}
+
+func TestStartIndex(t *testing.T) {
+	names := pagination.SortedConfigNames([]string{"nstor-c", "nstor-a", "nstor-b"})
+	if names[0] != "nstor-a" || names[1] != "nstor-b" || names[2] != "nstor-c" {
+		t.Fatalf("config names are not sorted: %v", names)
+	}
+
+	cases := map[string]int{"": 0, "nstor-a": 0, "nstor-b": 1, "nstor-c": 2}
+	for name, expected := range cases {
+		index, err := pagination.StartIndex(names, pagination.Token{ConfigName: name})
+		if err != nil {
+			t.Errorf("StartIndex('%s') returned an error: %s", name, err)
+		} else if index != expected {
+			t.Errorf("StartIndex('%s') expected to be %d, but got %d", name, expected, index)
+		}
+	}
+
+	if _, err := pagination.StartIndex(names, pagination.Token{ConfigName: "nstor-x"}); err == nil {
+		t.Error("unknown config name should return an error")
+	}
+}
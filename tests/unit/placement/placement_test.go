@@ -0,0 +1,127 @@
+package placement_test
+
+import (
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/placement"
+)
+
+const gib = 1024 * 1024 * 1024
+
+var candidates = []placement.Candidate{
+	{Name: "ns1", FreeBytes: 100 * gib, PoolFreeBytes: 100 * gib, PoolSizeBytes: 1000 * gib, VolumeCount: 5, Weight: 1},
+	{Name: "ns2", FreeBytes: 300 * gib, PoolFreeBytes: 300 * gib, PoolSizeBytes: 1000 * gib, VolumeCount: 9, Weight: 3},
+	{Name: "ns3", FreeBytes: 200 * gib, PoolFreeBytes: 200 * gib, PoolSizeBytes: 1000 * gib, VolumeCount: 2},
+}
+
+func withPoolFloor(percent int) []placement.Candidate {
+	result := []placement.Candidate{}
+	for _, c := range candidates {
+		c.MinPoolFreePercent = percent
+		result = append(result, c)
+	}
+	return result
+}
+
+func selectNames(t *testing.T, placer *placement.Placer, policy string, count int) []string {
+	names := []string{}
+	for i := 0; i < count; i++ {
+		c, err := placer.Select(policy, candidates, gib)
+		if err != nil {
+			t.Fatalf("Select(%s) returned an error: %s", policy, err)
+		}
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestPlacer_Select(t *testing.T) {
+	t.Run("mostFree should pick appliance with the most free space", func(t *testing.T) {
+		c, err := placement.New().Select(placement.PolicyMostFree, candidates, gib)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.Name != "ns2" {
+			t.Errorf("expected 'ns2', but got '%s'", c.Name)
+		}
+	})
+
+	t.Run("empty policy should be mostFree", func(t *testing.T) {
+		c, err := placement.New().Select("", candidates, gib)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.Name != "ns2" {
+			t.Errorf("expected 'ns2', but got '%s'", c.Name)
+		}
+	})
+
+	t.Run("fewestVolumes should pick appliance with the fewest volumes", func(t *testing.T) {
+		c, err := placement.New().Select(placement.PolicyFewestVolumes, candidates, gib)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.Name != "ns3" {
+			t.Errorf("expected 'ns3', but got '%s'", c.Name)
+		}
+	})
+
+	t.Run("roundRobin should pick appliances in turn", func(t *testing.T) {
+		names := selectNames(t, placement.New(), placement.PolicyRoundRobin, 4)
+		expected := []string{"ns1", "ns2", "ns3", "ns1"}
+		for i := range expected {
+			if names[i] != expected[i] {
+				t.Fatalf("expected %v, but got %v", expected, names)
+			}
+		}
+	})
+
+	t.Run("weighted should pick appliances proportionally to weights", func(t *testing.T) {
+		names := selectNames(t, placement.New(), placement.PolicyWeighted, 10)
+		counts := map[string]int{}
+		for _, name := range names {
+			counts[name]++
+		}
+		if counts["ns1"] != 2 || counts["ns2"] != 6 || counts["ns3"] != 2 {
+			t.Errorf("expected ns1=2, ns2=6, ns3=2, but got %v", counts)
+		}
+	})
+
+	t.Run("should skip appliances below pool free space floor", func(t *testing.T) {
+		c, err := placement.New().Select(placement.PolicyFewestVolumes, withPoolFloor(25), gib)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.Name != "ns2" {
+			t.Errorf("expected 'ns2', but got '%s'", c.Name)
+		}
+	})
+
+	t.Run("should skip appliances without enough free space for reservation", func(t *testing.T) {
+		c, err := placement.New().Select(placement.PolicyFewestVolumes, candidates, 250*gib)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.Name != "ns2" {
+			t.Errorf("expected 'ns2', but got '%s'", c.Name)
+		}
+	})
+
+	t.Run("should overcommit free space by thin volumes", func(t *testing.T) {
+		c, err := placement.New().Select(placement.PolicyFewestVolumes, candidates, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.Name != "ns3" {
+			t.Errorf("expected 'ns3', but got '%s'", c.Name)
+		}
+	})
+
+	t.Run("should return an error if no appliance fits", func(t *testing.T) {
+		_, err := placement.New().Select(placement.PolicyMostFree, withPoolFloor(50), gib)
+		if _, ok := err.(*placement.NoCandidatesError); !ok {
+			t.Errorf("expected NoCandidatesError, but got: %v", err)
+		}
+	})
+
+	t.Run("should return an error for unknown policy", func(t *testing.T) {
+		_, err := placement.New().Select("random", candidates, gib)
+		if err == nil {
+			t.Error("unknown policy should return an error")
+		}
+	})
+}
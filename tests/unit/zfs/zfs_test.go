@@ -0,0 +1,107 @@
+package zfs_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver/pkg/zfs"
+)
+
+func TestFromParameters(t *testing.T) {
+	t.Run("should convert allowed properties to NexentaStor fields", func(t *testing.T) {
+		properties, err := zfs.FromParameters(map[string]string{
+			"zfs.compression": "LZ4",
+			"zfs.recordsize":  "16K",
+			"zfs.atime":       "off",
+			"zfs.sync":        "always",
+			"zfs.logbias":     "throughput",
+			"zfs.dedup":       "sha256,verify",
+			"zfs.copies":      "2",
+			"dataset":         "pool/dataset",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := zfs.Properties{
+			"compressionMode": "lz4",
+			"recordSize":      int64(16384),
+			"atime":           false,
+			"syncMode":        "always",
+			"logBias":         "throughput",
+			"dedupMode":       "sha256,verify",
+			"copies":          2,
+		}
+		if !reflect.DeepEqual(properties, expected) {
+			t.Errorf("expected %v, but got %v", expected, properties)
+		}
+	})
+
+	t.Run("should return empty properties if there are no zfs parameters", func(t *testing.T) {
+		properties, err := zfs.FromParameters(map[string]string{"dataset": "pool/dataset"})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(properties) != 0 {
+			t.Errorf("expected no properties, but got %v", properties)
+		}
+	})
+
+	t.Run("should accept record size in bytes and megabytes", func(t *testing.T) {
+		for value, expected := range map[string]int64{"512": 512, "131072": 131072, "1M": 1024 * 1024} {
+			properties, err := zfs.FromParameters(map[string]string{"zfs.recordsize": value})
+			if err != nil {
+				t.Errorf("record size '%s' returned an error: %s", value, err)
+			} else if properties["recordSize"] != expected {
+				t.Errorf("record size '%s': expected %d, but got %v", value, expected, properties["recordSize"])
+			}
+		}
+	})
+
+	for name, parameters := range map[string]map[string]string{
+		"unknown property":              {"zfs.foo": "bar"},
+		"unsafe property":               {"zfs.mountpoint": "/mnt"},
+		"quota managed by the driver":   {"zfs.refquota": "1G"},
+		"invalid compression":           {"zfs.compression": "brotli"},
+		"record size not power of 2":    {"zfs.recordsize": "24K"},
+		"record size too big":           {"zfs.recordsize": "2M"},
+		"record size is not a number":   {"zfs.recordsize": "big"},
+		"record size with two suffixes": {"zfs.recordsize": "1KM"},
+		"invalid atime":                 {"zfs.atime": "yes"},
+		"too many copies":               {"zfs.copies": "4"},
+	} {
+		t.Run("should reject "+name, func(t *testing.T) {
+			if _, err := zfs.FromParameters(parameters); err == nil {
+				t.Errorf("expected an error for %v", parameters)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"0":     0,
+		"4096":  4096,
+		"16K":   16 * 1024,
+		"16k":   16 * 1024,
+		"10Gi":  10 * 1024 * 1024 * 1024,
+		"2T":    2 * 1024 * 1024 * 1024 * 1024,
+		" 1M ":  1024 * 1024,
+		"512Mi": 512 * 1024 * 1024,
+	} {
+		t.Run("should parse '"+value+"'", func(t *testing.T) {
+			size, err := zfs.ParseSize(value)
+			if err != nil {
+				t.Fatal(err)
+			} else if size != expected {
+				t.Errorf("expected %d, but got %d", expected, size)
+			}
+		})
+	}
+
+	for _, value := range []string{"", "G", "10i", "-1", "1.5G", "10P", "1KM", "9999999999T"} {
+		t.Run("should reject '"+value+"'", func(t *testing.T) {
+			if size, err := zfs.ParseSize(value); err == nil {
+				t.Errorf("expected an error, but got %d", size)
+			}
+		})
+	}
+}
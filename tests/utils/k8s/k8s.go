@@ -44,6 +44,7 @@ type Deployment struct {
 
 	deploymentTmpDir string
 	secretName       string
+	nodeSecretName   string
 	log              *logrus.Entry
 }
 
@@ -61,6 +62,14 @@ func (d *Deployment) getSecretFileName() string {
 	return filepath.Base(d.SecretFile)
 }
 
+// getSecretNames - names of secrets created from the secret file: driver config and node driver config
+func (d *Deployment) getSecretNames() []string {
+	if d.nodeSecretName == "" {
+		return []string{d.secretName}
+	}
+	return []string{d.secretName, d.nodeSecretName}
+}
+
 // WaitForPodsMode - mode for WaitForPods() function (wait all pods or when none is presented)
 type WaitForPodsMode int64
 
@@ -241,14 +250,16 @@ func (d *Deployment) CreateSecret() error {
 		return fail(err)
 	}
 
-	applyCommand := fmt.Sprintf(
-		"cd %s; kubectl create secret generic %s --from-file=%s",
-		d.deploymentTmpDir,
-		d.secretName,
-		d.getSecretFileName(),
-	)
-	if _, err := d.RemoteClient.Exec(applyCommand); err != nil {
-		return fail(err)
+	for _, secretName := range d.getSecretNames() {
+		applyCommand := fmt.Sprintf(
+			"cd %s; kubectl create secret generic %s --from-file=%s",
+			d.deploymentTmpDir,
+			secretName,
+			d.getSecretFileName(),
+		)
+		if _, err := d.RemoteClient.Exec(applyCommand); err != nil {
+			return fail(err)
+		}
 	}
 
 	out, err := d.RemoteClient.Exec("kubectl get secrets")
@@ -269,8 +280,10 @@ func (d *Deployment) DeleteSecret() error {
 
 	l.Info("run...")
 
-	if _, err := d.RemoteClient.Exec(fmt.Sprintf("kubectl delete secret %s", d.secretName)); err != nil {
-		return fail(err)
+	for _, secretName := range d.getSecretNames() {
+		if _, err := d.RemoteClient.Exec(fmt.Sprintf("kubectl delete secret %s", secretName)); err != nil {
+			return fail(err)
+		}
 	}
 
 	l.Info("secret has been successfully deleted")
@@ -302,9 +315,11 @@ func (d *Deployment) CleanUp() {
 	}
 
 	if d.secretName != "" {
-		deleteCommand = fmt.Sprintf("kubectl delete secret %s | true", d.secretName)
-		if _, err := d.RemoteClient.Exec(deleteCommand); err != nil {
-			l.Errorf("failed to delete secret: %s\n", err)
+		for _, secretName := range d.getSecretNames() {
+			deleteCommand = fmt.Sprintf("kubectl delete secret %s | true", secretName)
+			if _, err := d.RemoteClient.Exec(deleteCommand); err != nil {
+				l.Errorf("failed to delete secret: %s\n", err)
+			}
 		}
 
 		if d.deploymentTmpDir != "" {
@@ -331,7 +346,9 @@ type DeploymentArgs struct {
 	ConfigFile   string
 	SecretFile   string
 	SecretName   string
-	Log          *logrus.Entry
+	// NodeSecretName - name of node driver config secret, it's created from SecretFile as well
+	NodeSecretName string
+	Log            *logrus.Entry
 }
 
 // NewDeployment - create new k8s deployment
@@ -377,6 +394,7 @@ func NewDeployment(args DeploymentArgs) (*Deployment, error) {
 		WaitInterval:     defaultWaitInterval,
 		deploymentTmpDir: deploymentTmpDir,
 		secretName:       secretName,
+		nodeSecretName:   args.NodeSecretName,
 		log:              l,
 	}, nil
 }